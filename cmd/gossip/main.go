@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
+	"io"
 	"log"
+	nethttp "net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/nats-io/go-nats-streaming"
 	"github.com/tonto/gossip/pkg/agent"
+	"github.com/tonto/gossip/pkg/attachment"
 	"github.com/tonto/gossip/pkg/broker"
 	"github.com/tonto/gossip/pkg/chat"
 	"github.com/tonto/gossip/pkg/ingest"
+	"github.com/tonto/gossip/pkg/platform/fs"
 	"github.com/tonto/gossip/pkg/platform/nats"
 	"github.com/tonto/gossip/pkg/platform/redis"
+	"github.com/tonto/gossip/pkg/platform/s3"
+	"github.com/tonto/gossip/pkg/webhook"
 	"github.com/tonto/kit/http"
 	"github.com/tonto/kit/http/adapter"
 )
@@ -26,9 +38,54 @@ func main() {
 		natsURL   = flag.String("nats-url", "nats://nats_stream:4222", "nats streaming url")
 
 		redisHost = flag.String("redis-host", "redis", "redis host url")
+
+		clientBuffer = flag.Int("client-buffer", 256, "max number of messages queued per websocket client")
+		slowPolicy   = flag.String("slow-client-policy", "drop_oldest", "slow websocket client policy (drop_oldest, disconnect or coalesce)")
+		metricsAddr  = flag.String("metrics-addr", ":9090", "expvar metrics listen address, empty disables metrics")
+
+		shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "max time to wait for clients to disconnect on shutdown")
+
+		attachmentDir     = flag.String("attachment-dir", "attachments", "local attachment storage dir, used unless s3-endpoint is set")
+		attachmentMaxSize = flag.Int64("attachment-max-size", 10<<20, "max attachment size in bytes")
+		s3Endpoint        = flag.String("s3-endpoint", "", "S3 compatible attachment storage endpoint, eg. http://minio:9000")
+		s3Bucket          = flag.String("s3-bucket", "gossip", "S3 attachment bucket")
+		s3Region          = flag.String("s3-region", "us-east-1", "S3 region")
+		s3AccessKey       = flag.String("s3-access-key", "", "S3 access key")
+		s3SecretKey       = flag.String("s3-secret-key", "", "S3 secret key")
+
+		runIngest   = flag.Bool("ingest", true, "ingest chat history, disable if history is ingested by separate ingest workers")
+		runWebhooks = flag.Bool("webhooks", true, "deliver webhooks, disable if webhooks are delivered by separate webhook workers")
+
+		replayChannel  = flag.String("channel", "", "replay: channel to rebuild history of, all channels are rebuilt if empty")
+		replayFromSeq  = flag.Uint64("from-seq", 1, "replay: seq to rebuild history from")
+		replayFromTime = flag.String("from-time", "", "replay: RFC3339 time to rebuild history from, overrides from-seq")
 	)
 
-	flag.Parse()
+	// Modes other than serving websocket clients are run as: gossip <mode> [flags]
+	// ingest - runs ingest worker for all channels
+	// webhook - runs webhook delivery worker for all channels
+	// replay - rebuilds channel history from the message queue log
+	var mode string
+
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		mode = os.Args[1]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	if mode != "" && mode != "ingest" && mode != "webhook" && mode != "replay" {
+		log.Fatalf("unknown mode: %s", mode)
+	}
+
+	policy, err := agent.ParseOverflowPolicy(*slowPolicy)
+	checkErr(err)
+
+	if *metricsAddr != "" && mode != "replay" {
+		mux := nethttp.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() { log.Fatal(nethttp.ListenAndServe(*metricsAddr, mux)) }()
+	}
 
 	store, err := redis.NewStore(*redisHost)
 	checkErr(err)
@@ -38,10 +95,31 @@ func main() {
 
 	nt := nats.New(nconn)
 
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	switch mode {
+	case "ingest":
+		serveIngest(ctx, store, nt)
+		closeConns(nconn, store, nil)
+		return
+	case "webhook":
+		serveWebhooks(ctx, store, nt)
+		closeConns(nconn, store, nil)
+		return
+	case "replay":
+		replay(ctx, store, nt, *replayChannel, *replayFromSeq, *replayFromTime)
+		closeConns(nconn, store, nil)
+		return
+	}
+
 	logger := log.New(os.Stdout, "chat/ws => ", log.Ldate|log.Ltime|log.Lshortfile)
 
+	mux := nethttp.NewServeMux()
+
 	srv := http.NewServer(
 		http.WithLogger(logger),
+		http.WithMux(mux),
 		http.WithAdapters(
 			adapter.WithRequestLogger(logger, true),
 			adapter.WithCORS(
@@ -51,22 +129,196 @@ func main() {
 		),
 	)
 
+	var ig broker.Ingester
+
+	if *runIngest {
+		ig = ingest.New(nt, store)
+	}
+
+	b := broker.New(nt, store, ig)
+
+	var blobs attachment.Blobs
+
+	if *s3Endpoint != "" {
+		blobs = s3.New(*s3Endpoint, *s3Bucket, *s3Region, *s3AccessKey, *s3SecretKey)
+	} else {
+		blobs, err = fs.New(*attachmentDir)
+		checkErr(err)
+	}
+
+	attachmentAPI := attachment.NewAPI(store, blobs, attachment.WithMaxSize(*attachmentMaxSize))
+
+	agentAPI := agent.NewAPI(b, store, agent.WithOutbox(*clientBuffer, policy), agent.WithAttachments(attachmentAPI))
+
 	srv.RegisterServices(
-		agent.NewAPI(
-			broker.New(
-				nt,
-				store,
-				ingest.New(
-					nt,
-					store,
-				),
-			),
-			store,
-		),
-		chat.NewAPI(store, *admin, *pass),
+		agentAPI,
+		chat.NewAPI(store, b, *admin, *pass),
+		attachmentAPI,
+		webhook.NewAPI(store, store, b, *admin, *pass),
+	)
+
+	webhooksDone := make(chan struct{})
+
+	go func() {
+		defer close(webhooksDone)
+		if *runWebhooks {
+			serveWebhooks(ctx, store, nt)
+		}
+	}()
+
+	httpSrv := &nethttp.Server{Addr: ":8080", Handler: mux}
+
+	go func() {
+		if err := httpSrv.ListenAndServe(); err != nil && err != nethttp.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	logger.Println("shutting down, waiting for clients to disconnect")
+
+	sctx, scancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer scancel()
+
+	// Websocket connections are hijacked, so they are not
+	// tracked by http server and are closed by agent api
+	if err := agentAPI.Shutdown(sctx); err != nil {
+		logger.Println(err)
+	}
+
+	if err := httpSrv.Shutdown(sctx); err != nil {
+		logger.Println(err)
+	}
+
+	// Ingest consumers are released along with agent subscriptions
+	<-webhooksDone
+
+	closeConns(nconn, store, logger)
+}
+
+// signalContext returns context which is canceled on SIGTERM or interrupt
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		defer signal.Stop(sig)
+
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// closeConns closes nats and redis connections once nothing uses them.
+// Errors are logged, or are fatal if logger is nil.
+func closeConns(nconn stan.Conn, store *redis.Store, logger *log.Logger) {
+	for _, c := range []io.Closer{nconn, store} {
+		err := c.Close()
+		if err == nil {
+			continue
+		}
+		if logger == nil {
+			log.Fatal(err)
+		}
+		logger.Println(err)
+	}
+}
+
+// serveIngest runs chat history ingest for all channels,
+// including channels created while the worker is running
+func serveIngest(ctx context.Context, store *redis.Store, nt *nats.NATS) {
+	logger := log.New(os.Stdout, "chat/ingest => ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	serveChannels(ctx, store, nt, func(ctx context.Context, ids []string, created <-chan string) error {
+		logger.Printf("ingesting %d channels", len(ids))
+		return ingest.New(nt, store).RunAll(ctx, ids, created)
+	}, logger)
+}
+
+// serveWebhooks runs webhook delivery for all channels,
+// including channels created while the worker is running
+func serveWebhooks(ctx context.Context, store *redis.Store, nt *nats.NATS) {
+	logger := log.New(os.Stdout, "chat/webhook => ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	serveChannels(ctx, store, nt, func(ctx context.Context, ids []string, created <-chan string) error {
+		logger.Printf("delivering webhooks of %d channels", len(ids))
+		return webhook.NewWorker(nt, store).RunAll(ctx, ids, created)
+	}, logger)
+}
+
+// serveChannels runs f for all channels until ctx is done.
+// Channels created afterwards are received on created.
+func serveChannels(ctx context.Context, store *redis.Store, nt *nats.NATS, f func(context.Context, []string, <-chan string) error, logger *log.Logger) {
+	b := broker.New(nt, store, nil)
+
+	// Subscribe before listing channels so that no creation is missed
+	created := make(chan string)
+
+	close, err := b.SubscribeChannels(created)
+	checkErr(err)
+
+	defer close()
+
+	ids, err := store.ListAllChannels()
+	checkErr(err)
+
+	if err := f(ctx, ids, created); err != nil {
+		logger.Println(err)
+	}
+}
+
+// replay rebuilds history of channel id, or of all channels if id is empty,
+// starting at seq start, or at RFC3339 time from if provided
+func replay(ctx context.Context, store *redis.Store, nt *nats.NATS, id string, start uint64, from string) {
+	logger := log.New(os.Stdout, "chat/replay => ", log.Ldate|log.Ltime)
+
+	var (
+		t   time.Time
+		err error
 	)
 
-	log.Fatal(srv.Run(8080))
+	if from != "" {
+		t, err = time.Parse(time.RFC3339, from)
+		checkErr(err)
+	}
+
+	ids := []string{id}
+
+	if id == "" {
+		ids, err = store.ListAllChannels()
+		checkErr(err)
+	}
+
+	r := ingest.NewReplay(nt, store)
+
+	progress := func(p ingest.Progress) {
+		logger.Printf("%s: replayed %d messages (seq %d/%d)", p.Chat, p.N, p.Seq, p.Last)
+	}
+
+	for i, id := range ids {
+		logger.Printf("rebuilding %s (%d/%d)", id, i+1, len(ids))
+
+		if t.IsZero() {
+			err = r.Run(ctx, id, start, progress)
+		} else {
+			err = r.RunFrom(ctx, id, t, progress)
+		}
+
+		if err != nil {
+			logger.Printf("%s: replay failed: %v", id, err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
 }
 
 func checkErr(err error) {
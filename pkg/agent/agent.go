@@ -1,45 +1,177 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
 	"github.com/tonto/gossip/pkg/broker"
 	"github.com/tonto/gossip/pkg/chat"
 )
 
 // New creates new connection agent instance
-func New(broker *broker.Broker, store ChatStore) *Agent {
+func New(broker *broker.Broker, store ChatStore, opts ...Option) *Agent {
+	cfg := newConfig(opts...)
 	return &Agent{
+		id:     ksuid.New().String(),
 		broker: broker,
 		store:  store,
-		done:   make(chan struct{}, 1),
+		cfg:    cfg,
+		out:    newOutbox(cfg.outboxSize, cfg.policy),
+		chans:  make(map[string]*channel),
+		acks:   make(map[ackKey]struct{}),
+		seqs:   make(map[string]uint64),
 	}
 }
 
-// Agent represents chat connection agent which handles end to end comm client - broker
+const (
+	defJoinTimeout = 10 * time.Second
+	defPongWait    = 60 * time.Second
+	defWriteWait   = 10 * time.Second
+	defOutboxSize  = 256
+
+	defHistoryTimeout = 5 * time.Second
+)
+
+type config struct {
+	joinTimeout time.Duration
+	pingPeriod  time.Duration
+	pongWait    time.Duration
+	writeWait   time.Duration
+	outboxSize  int
+	policy      OverflowPolicy
+
+	historyTimeout time.Duration
+	attachments    Attachments
+}
+
+func newConfig(opts ...Option) config {
+	cfg := config{
+		joinTimeout: defJoinTimeout,
+		pongWait:    defPongWait,
+		pingPeriod:  defPongWait * 9 / 10,
+		writeWait:   defWriteWait,
+		outboxSize:  defOutboxSize,
+		policy:      DropOldest,
+
+		historyTimeout: defHistoryTimeout,
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return cfg
+}
+
+// Option represents agent connection option
+type Option func(*config)
+
+// WithJoinTimeout sets max time allowed for the client
+// to send connection init request after connecting
+func WithJoinTimeout(d time.Duration) Option {
+	return func(c *config) { c.joinTimeout = d }
+}
+
+// WithHeartbeat sets ping interval and max time allowed for the client to respond.
+// Connection is considered dead if no pong or other message is received within pongWait.
+func WithHeartbeat(pingPeriod, pongWait time.Duration) Option {
+	return func(c *config) {
+		c.pingPeriod = pingPeriod
+		c.pongWait = pongWait
+	}
+}
+
+// WithOutbox sets max number of messages queued for a single client
+// and the policy applied once the client falls behind
+func WithOutbox(size int, policy OverflowPolicy) Option {
+	return func(c *config) {
+		c.outboxSize = size
+		c.policy = policy
+	}
+}
+
+// WithWriteTimeout sets max time allowed for a single write to the client
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *config) { c.writeWait = d }
+}
+
+// WithHistoryTimeout sets max time spent replaying history
+// which is no longer retained by the store
+func WithHistoryTimeout(d time.Duration) Option {
+	return func(c *config) { c.historyTimeout = d }
+}
+
+// WithAttachments sets attachment storage used to look up attachments
+// sent in chat messages. Attachment messages are rejected if it is not set.
+func WithAttachments(s Attachments) Option {
+	return func(c *config) { c.attachments = s }
+}
+
+// Agent represents chat connection agent which handles end to end comm client - broker.
+// In multiplexed mode single agent connection can be joined to multiple chats.
+// All connection writes go through the bounded out queue, which is consumed by
+// a single writer goroutine. Agent shuts down once its context is cancelled.
 type Agent struct {
-	chat          *chat.Chat
-	connectedUser string
-	done          chan struct{}
-	closeSub      func()
-	closed        bool
-
-	// TODO - Abstract ws connection and broker
-	conn   *websocket.Conn
+	id        string // Connection id, identifies messages sent by this agent
+	nick      string
+	secret    string
+	acc       *chat.Account
+	multiplex bool
+	version   int
+	cfg       config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	out    *outbox
+	slow   sync.Once
+
+	// rmu guards resume state: seqs holds next seq to be delivered
+	// per joined chat, and reason is set if the client should resume
+	rmu    sync.Mutex
+	seqs   map[string]uint64
+	reason string
+
+	mu    sync.Mutex
+	chans map[string]*channel
+	acks  map[ackKey]struct{}
+
+	// TODO - Abstract broker
+	conn   conn
 	broker *broker.Broker
 
 	store ChatStore
 }
 
+// channel represents agent subscription to a single chat
+type channel struct {
+	chat  *chat.Chat
+	user  *chat.User
+	close func()
+	done  chan struct{}
+}
+
 // ChatStore represents chat store interface
 type ChatStore interface {
 	Get(string) (*chat.Chat, error)
+	GetAccount(string) (*chat.Account, error)
 	GetRecent(string, int64) ([]broker.Msg, uint64, error)
+	GetRange(string, uint64, uint64) ([]broker.Msg, bool, error)
 	UpdateLastClientSeq(string, string, uint64)
+	SaveTicket(string, *Ticket, time.Duration) error
+	TakeTicket(string) (*Ticket, error)
+}
+
+// Attachments represents attachment storage interface
+type Attachments interface {
+	// Stat returns stored chat attachment, or nil if it does not exist
+	Stat(context.Context, string, string) (*broker.Attachment, error)
 }
 
 type msgT int
@@ -50,77 +182,213 @@ const (
 	errorMsg
 	infoMsg
 	historyReqMsg
+	eventMsg
+	joinMsg
+	leaveMsg
+	gapMsg
+	resumeMsg
+	ackMsg
 )
 
 const (
 	maxHistoryCount uint64 = 150
 )
 
+// resume represents hint for the client to reconnect
+// and resume each chat from provided seq
+type resume struct {
+	Reason  string            `json:"reason"`
+	LastSeq map[string]uint64 `json:"last_seq"`
+}
+
+// ack represents client chat message acknowledgment
+type ack struct {
+	Seq       uint64 `json:"seq,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// ackKey identifies client chat message waiting to be acknowledged
+type ackKey struct {
+	chat string
+	id   string
+}
+
 type msg struct {
-	Type  msgT        `json:"type"`
-	Data  interface{} `json:"data,omitempty"`
-	Error string      `json:"error,omitempty"`
+	Type    msgT        `json:"type"`
+	Channel string      `json:"channel,omitempty"`
+	ID      string      `json:"id,omitempty"` // Client message id
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
 }
 
-// HandleConn handles websocket communication for requested chat/client
-// TODO - Better goroutine lifecycle management in general
-func (a *Agent) HandleConn(conn *websocket.Conn, req *initConReq) {
+// HandleConn handles websocket communication for requested chat/client.
+// If multiplexing was requested, client joins and leaves chats with
+// join and leave messages, otherwise connection is bound to requested chat.
+// HandleConn blocks until the connection is closed by either side, ctx is
+// cancelled, or the client stops responding, and all agent goroutines exit.
+func (a *Agent) HandleConn(ctx context.Context, conn *websocket.Conn, req *initConReq) {
+	a.handle(ctx, newWSConn(conn, req.Version, a.cfg), req)
+}
+
+// handle runs the agent over provided client connection transport
+func (a *Agent) handle(ctx context.Context, conn conn, req *initConReq) {
+	a.rmu.Lock()
+	a.ctx, a.cancel = context.WithCancel(ctx)
+	if a.reason != "" {
+		a.cancel()
+	}
+	a.rmu.Unlock()
+
 	a.conn = conn
+	a.nick = req.Nick
+	a.secret = req.Secret
+	a.multiplex = req.Multiplex
+	a.version = req.Version
 
-	a.conn.SetCloseHandler(func(code int, text string) error {
-		a.closed = true
-		a.done <- struct{}{}
-		return nil
-	})
+	a.wg.Add(1)
+	go a.writeLoop()
 
-	ct, err := a.store.Get(req.Channel)
+	defer a.wg.Wait()
+	defer a.cancel()
+
+	// Agent was asked to go away before connection was established
+	if a.ctx.Err() != nil {
+		return
+	}
+
+	acc, err := a.store.GetAccount(req.Nick)
 	if err != nil {
-		writeFatal(a.conn, "agent: unable to find chat")
+		a.writeFatal("", "agent: unable to fetch account")
 		return
 	}
 
-	if ct == nil {
-		writeFatal(a.conn, "agent: this chat does not exist")
+	if a.multiplex && (acc == nil || acc.Auth(req.Secret) != nil) {
+		a.writeFatal("", "agent: multiplexed connections require valid account credentials")
 		return
 	}
 
-	user, err := ct.Join(req.Nick, req.Secret)
+	a.acc = acc
+
+	if req.Channel != "" {
+		if err := a.join(req.Channel, req.LastSeq); err != nil {
+			a.writeFatal(req.Channel, err.Error())
+			return
+		}
+	}
+
+	a.readLoop()
+}
+
+// join subscribes agent to chat id updates starting from lastSeq,
+// or pushes recent chat history and subscribes from there if lastSeq is nil
+func (a *Agent) join(id string, lastSeq *uint64) error {
+	if a.channel(id) != nil {
+		return fmt.Errorf("agent: already joined to this chat")
+	}
+
+	ct, err := a.store.Get(id)
 	if err != nil {
-		writeFatal(a.conn, err.Error())
-		return
+		return fmt.Errorf("agent: unable to find chat")
+	}
+
+	if ct == nil {
+		return fmt.Errorf("agent: this chat does not exist")
+	}
+
+	user, err := ct.Authenticate(a.acc, a.nick, a.secret)
+	if err != nil {
+		return err
 	}
 
-	a.chat = ct
-	a.connectedUser = user.Nick
+	ch := channel{
+		chat: ct,
+		user: user,
+		done: make(chan struct{}),
+	}
 
 	mc := make(chan *broker.Msg)
 	{
 		var close func()
 
-		if req.LastSeq != nil {
-			close, err = a.broker.Subscribe(req.Channel, user.Nick, *req.LastSeq, mc)
+		if lastSeq != nil {
+			a.setSeq(id, *lastSeq)
+			close, err = a.broker.Subscribe(id, a.id, *lastSeq, mc)
 		} else {
-			if seq, err := a.pushRecent(); err != nil {
-				writeErr(a.conn, "agent: unable to fetch chat history. try reconnecting")
-				close, err = a.broker.SubscribeNew(req.Channel, user.Nick, mc)
+			if seq, err := a.pushRecent(&ch); err != nil {
+				a.writeErr(id, "agent: unable to fetch chat history. try reconnecting")
+				close, err = a.broker.SubscribeNew(id, a.id, mc)
 			} else {
-				close, err = a.broker.Subscribe(req.Channel, user.Nick, seq, mc)
+				a.setSeq(id, seq)
+				close, err = a.broker.Subscribe(id, a.id, seq, mc)
 			}
 		}
 
 		if err != nil {
-			writeFatal(a.conn, "agent: unable to subscribe to chat updates. closing connection")
-			return
+			return fmt.Errorf("agent: unable to subscribe to chat updates")
+		}
+
+		ch.close = close
+	}
+
+	ec := make(chan *broker.Event)
+	{
+		close, err := a.broker.SubscribeEvents(id, ec)
+		if err != nil {
+			ch.close()
+			return fmt.Errorf("agent: unable to subscribe to chat events")
 		}
 
-		a.closeSub = close
+		closeSub := ch.close
+		ch.close = func() { closeSub(); close() }
 	}
 
-	a.loop(mc)
+	a.mu.Lock()
+	a.chans[id] = &ch
+	a.mu.Unlock()
+
+	a.wg.Add(1)
+	go a.forward(&ch, mc, ec)
+
+	return nil
 }
 
-func (a *Agent) pushRecent() (uint64, error) {
-	msgs, seq, err := a.store.GetRecent(a.chat.Name, 100)
+// leave unsubscribes agent from chat id
+func (a *Agent) leave(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ch, ok := a.chans[id]
+	if !ok {
+		return false
+	}
+
+	delete(a.chans, id)
+	close(ch.done)
+
+	a.rmu.Lock()
+	delete(a.seqs, id)
+	a.rmu.Unlock()
+
+	return true
+}
+
+// channel returns joined chat id. Connections which are not
+// multiplexed are bound to a single chat, so id may be omitted.
+func (a *Agent) channel(id string) *channel {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if id == "" && !a.multiplex {
+		for _, ch := range a.chans {
+			return ch
+		}
+	}
+
+	return a.chans[id]
+}
+
+func (a *Agent) pushRecent(ch *channel) (uint64, error) {
+	msgs, seq, err := a.store.GetRecent(ch.chat.Name, 100)
 	if err != nil {
 		return 0, err
 	}
@@ -129,109 +397,477 @@ func (a *Agent) pushRecent() (uint64, error) {
 		return 0, nil
 	}
 
-	a.store.UpdateLastClientSeq(a.connectedUser, a.chat.Name, msgs[len(msgs)-1].Seq)
+	a.store.UpdateLastClientSeq(ch.user.Nick, ch.chat.Name, msgs[len(msgs)-1].Seq)
 
-	return seq, a.conn.WriteJSON(msg{
-		Type: historyMsg,
-		Data: msgs,
+	return seq, a.write(msg{
+		Type:    historyMsg,
+		Channel: ch.chat.Name,
+		Data:    msgs,
 	})
+}
+
+// readLoop reads client messages until the connection fails. Read errors,
+// including read deadline timeouts, are permanent. Closing the connection
+// from the writer side also unblocks the reader.
+func (a *Agent) readLoop() {
+	for {
+		r, err := a.conn.Next()
+		if err != nil {
+			return
+		}
 
+		a.handleClientMsg(r)
+	}
 }
 
-func (a *Agent) loop(mc chan *broker.Msg) {
-	go func() {
-		for {
-			if a.closed {
+// writeLoop is the only connection writer. It sends queued messages and
+// pings until agent shuts down, after which pending messages are flushed
+// and the connection is closed.
+func (a *Agent) writeLoop() {
+	defer a.wg.Done()
+
+	t := time.NewTicker(a.cfg.pingPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-a.out.ready:
+			for {
+				m, ok := a.out.pop()
+				if !ok {
+					break
+				}
+				if err := a.send(m); err != nil {
+					a.cancel()
+					a.conn.Close(websocket.CloseAbnormalClosure, "")
+					return
+				}
+			}
+		case <-t.C:
+			if err := a.conn.Ping(); err != nil {
+				a.cancel()
+				a.conn.Close(websocket.CloseAbnormalClosure, "")
 				return
 			}
+		case <-a.ctx.Done():
+			a.flush()
+			return
+		}
+	}
+}
+
+// flush sends pending messages before closing the connection. If the client
+// was asked to resume, pending messages are discarded and resume hint is sent
+// instead, since the client will receive them after reconnecting.
+func (a *Agent) flush() {
+	code := websocket.CloseNormalClosure
+
+	a.rmu.Lock()
+	r := resume{Reason: a.reason, LastSeq: make(map[string]uint64)}
+	for id, seq := range a.seqs {
+		r.LastSeq[id] = seq
+	}
+	a.rmu.Unlock()
+
+	if r.Reason != "" {
+		a.out.clear()
+		a.send(msg{Type: resumeMsg, Data: r})
+		code = websocket.CloseGoingAway
+	}
+
+	for {
+		m, ok := a.out.pop()
+		if !ok {
+			break
+		}
+		if err := a.send(m); err != nil {
+			break
+		}
+	}
+
+	a.conn.Close(code, r.Reason)
+}
+
+func (a *Agent) send(m msg) error {
+	if err := a.conn.Write(m); err != nil {
+		return err
+	}
+
+	if bm, ok := m.Data.(*broker.Msg); ok && m.Type == chatMsg {
+		a.setSeq(m.Channel, bm.Seq+1)
+	}
+
+	return nil
+}
+
+func (a *Agent) setSeq(id string, seq uint64) {
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+	if seq > a.seqs[id] {
+		a.seqs[id] = seq
+	}
+}
+
+// forward forwards chat messages and events to the client
+// until agent leaves the chat
+func (a *Agent) forward(ch *channel, mc chan *broker.Msg, ec chan *broker.Event) {
+	defer a.wg.Done()
+	defer ch.close()
+
+	id := ch.chat.Name
+
+	for {
+		select {
+		case m := <-mc:
+			// Messages sent from this connection are only received to
+			// acknowledge client sends. Messages sent by the same user from
+			// other connections are forwarded to keep all devices in sync.
+			if m.Conn == a.id {
+				a.ack(id, m)
+				a.store.UpdateLastClientSeq(ch.user.Nick, id, m.Seq)
+				continue
+			}
 
-			_, r, err := a.conn.NextReader()
-			if err != nil {
-				writeErr(a.conn, err.Error())
+			a.write(msg{
+				Type:    chatMsg,
+				Channel: id,
+				Data:    m,
+			})
+
+			a.store.UpdateLastClientSeq(ch.user.Nick, id, m.Seq)
+		case e := <-ec:
+			if a.handleEvent(ch, e) {
 				continue
 			}
 
-			a.handleClientMsg(r)
-		}
-	}()
-
-	go func() {
-		defer a.closeSub()
-		defer a.conn.Close()
-		for {
-			select {
-			case m := <-mc:
-				a.conn.WriteJSON(msg{
-					Type: chatMsg,
-					Data: m,
-				})
-
-				a.store.UpdateLastClientSeq(a.connectedUser, a.chat.Name, m.Seq)
-			case <-a.done:
+			// Invalidated credentials are shared by all joined chats
+			if !a.multiplex || e.Type == broker.EventSecret {
+				a.cancel()
 				return
 			}
+
+			if a.leave(id) {
+				a.write(msg{Type: leaveMsg, Channel: id})
+			}
+		case <-ch.done:
+			return
+		case <-a.ctx.Done():
+			return
 		}
-	}()
+	}
 }
 
-func (a *Agent) handleClientMsg(r io.Reader) {
-	var message struct {
-		Type msgT            `json:"type"`
-		Data json.RawMessage `json:"data,omitempty"`
+// handleEvent applies chat event to connected user and forwards it to the client.
+// Returns false if the user should be removed from the chat.
+func (a *Agent) handleEvent(ch *channel, e *broker.Event) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e.Nick != ch.user.Nick {
+		if e.Type != broker.EventSecret {
+			a.write(msg{
+				Type:    eventMsg,
+				Channel: ch.chat.Name,
+				Data:    e,
+			})
+		}
+		return true
 	}
 
-	err := json.NewDecoder(r).Decode(&message)
+	a.write(msg{
+		Type:    eventMsg,
+		Channel: ch.chat.Name,
+		Data:    e,
+	})
+
+	switch e.Type {
+	case broker.EventKick, broker.EventBan, broker.EventSecret, broker.EventNick, broker.EventLeave:
+		return false
+	case broker.EventMute:
+		ch.user.MutedUntil = e.Until
+	case broker.EventRole:
+		ch.user.Role = chat.Role(e.Role)
+	}
+
+	return true
+}
+
+func (a *Agent) handleClientMsg(r io.Reader) {
+	message, err := decode(a.version, r)
 	if err != nil {
-		writeErr(a.conn, fmt.Sprintf("invalid message format: %v", err))
+		a.writeErr("", err.Error())
+		return
+	}
+
+	switch message.Type {
+	case joinMsg:
+		a.handleJoinMsg(message.Channel, message.Data)
+		return
+	case leaveMsg:
+		a.handleLeaveMsg(message.Channel)
+		return
+	}
+
+	ch := a.channel(message.Channel)
+	if ch == nil {
+		a.writeErr(message.Channel, "not joined to this chat")
 		return
 	}
 
 	switch message.Type {
 	case chatMsg:
-		a.handleChatMsg(message.Data)
+		a.handleChatMsg(ch, message.ID, message.Data)
 	case historyReqMsg:
-		a.handleHistoryReqMsg(message.Data)
+		a.handleHistoryReqMsg(ch, message.Data)
+	}
+}
+
+func (a *Agent) handleJoinMsg(id string, raw json.RawMessage) {
+	if !a.multiplex {
+		a.writeErr(id, "join is available only on multiplexed connections")
+		return
+	}
+
+	var req struct {
+		LastSeq *uint64 `json:"last_seq"`
+	}
+
+	if len(raw) > 0 {
+		err := json.Unmarshal(raw, &req)
+		if err != nil {
+			a.writeErr(id, fmt.Sprintf("invalid join message format: %v", err))
+			return
+		}
 	}
+
+	if err := a.join(id, req.LastSeq); err != nil {
+		a.writeErr(id, err.Error())
+		return
+	}
+
+	a.write(msg{Type: joinMsg, Channel: id})
 }
 
-func (a *Agent) handleChatMsg(raw json.RawMessage) {
-	var msg broker.Msg
+func (a *Agent) handleLeaveMsg(id string) {
+	if !a.multiplex {
+		a.writeErr(id, "leave is available only on multiplexed connections")
+		return
+	}
 
-	err := json.Unmarshal(raw, &msg)
+	if !a.leave(id) {
+		a.writeErr(id, "not joined to this chat")
+		return
+	}
+
+	a.write(msg{Type: leaveMsg, Channel: id})
+}
+
+// handleChatMsg sends client chat message to the broker. If client message id
+// is provided, the client receives an ack with assigned seq once the message is
+// delivered back through chat subscription, or an ack with error.
+func (a *Agent) handleChatMsg(ch *channel, clientID string, raw json.RawMessage) {
+	var bm broker.Msg
+
+	id := ch.chat.Name
+
+	err := json.Unmarshal(raw, &bm)
 	if err != nil {
-		writeErr(a.conn, fmt.Sprintf("invalid text message format: %v", err))
+		a.reject(id, clientID, fmt.Sprintf("invalid text message format: %v", err))
 		return
 	}
 
-	if msg.Text == "" {
-		writeErr(a.conn, "sent empty message")
+	a.mu.Lock()
+	user := *ch.user
+	a.mu.Unlock()
+
+	if err := prepareMsg(a.ctx, a.cfg.attachments, id, &user, &bm); err != nil {
+		a.reject(id, clientID, err.Error())
 		return
 	}
 
-	if len(msg.Text) > 1024 {
-		writeErr(a.conn, "exceeded max message length of 1024 characters")
+	bm.ID = clientID
+	bm.Conn = a.id
+
+	key := ackKey{chat: id, id: clientID}
+
+	if clientID != "" {
+		a.mu.Lock()
+		a.acks[key] = struct{}{}
+		a.mu.Unlock()
+	}
+
+	err = a.broker.Send(id, &bm)
+	if err == nil {
+		// TODO - Increment chan msg count here
+		return
+	}
+
+	a.mu.Lock()
+	delete(a.acks, key)
+	a.mu.Unlock()
+
+	if dup, ok := err.(*broker.DuplicateError); ok {
+		a.write(msg{
+			Type:    ackMsg,
+			Channel: id,
+			ID:      clientID,
+			Data:    ack{Seq: dup.Seq, Duplicate: true},
+		})
+		return
+	}
+
+	a.reject(id, clientID, fmt.Sprintf("could not forward your message. try again: %v", err))
+}
+
+// ack acknowledges own chat message m if the client is waiting for it
+func (a *Agent) ack(id string, m *broker.Msg) {
+	if m.ID == "" {
+		return
+	}
+
+	key := ackKey{chat: id, id: m.ID}
+
+	a.mu.Lock()
+	_, ok := a.acks[key]
+	delete(a.acks, key)
+	a.mu.Unlock()
+
+	if ok {
+		a.write(msg{
+			Type:    ackMsg,
+			Channel: id,
+			ID:      m.ID,
+			Data:    ack{Seq: m.Seq},
+		})
+	}
+}
+
+// reject reports chat message error as an ack if client message id was provided
+func (a *Agent) reject(id, clientID, err string) {
+	if clientID == "" {
+		a.writeErr(id, err)
 		return
 	}
+	a.write(msg{Type: ackMsg, Channel: id, ID: clientID, Error: err})
+}
+
+// prepareMsg checks whether user is allowed to send msg to chat id and stamps it
+func prepareMsg(c context.Context, atts Attachments, id string, user *chat.User, msg *broker.Msg) error {
+	if !user.CanSend() {
+		return fmt.Errorf("you don't have permission to send messages to this chat")
+	}
+
+	if user.IsMuted(time.Now()) {
+		return fmt.Errorf("you are muted until %v", user.MutedUntil.Format(time.RFC3339))
+	}
+
+	if err := validateContent(msg); err != nil {
+		return err
+	}
 
-	msg.From = a.connectedUser
+	if msg.Kind == broker.KindAttachment {
+		if err := resolveAttachment(c, atts, id, msg.Attachment); err != nil {
+			return err
+		}
+	}
+
+	msg.From = user.Nick
 	msg.Time = time.Now()
 
-	err = a.broker.Send(a.chat.Name, &msg)
+	return nil
+}
+
+// resolveAttachment replaces attachment reference sent by the client with
+// the one stored on upload, so that its name, type and size can't be forged
+func resolveAttachment(c context.Context, atts Attachments, id string, att *broker.Attachment) error {
+	if atts == nil {
+		return fmt.Errorf("attachments are not supported")
+	}
+
+	stored, err := atts.Stat(c, id, att.ID)
 	if err != nil {
-		writeErr(a.conn, fmt.Sprintf("could not forward your message. try again: %v", err))
+		return fmt.Errorf("could not fetch attachment")
+	}
+
+	if stored == nil {
+		return fmt.Errorf("attachment not found")
+	}
+
+	*att = *stored
+
+	return nil
+}
+
+const (
+	maxTextLen     = 1024
+	maxCodeLen     = 4096
+	maxLangLen     = 32
+	maxAttNameLen  = 255
+	maxAttFieldLen = 128
+)
+
+// validateContent validates msg content according to its kind.
+// System messages can not be sent by clients.
+func validateContent(msg *broker.Msg) error {
+	switch msg.Kind {
+	case "", broker.KindText, broker.KindMarkdown:
+		if msg.Text == "" {
+			return fmt.Errorf("sent empty message")
+		}
+		if len(msg.Text) > maxTextLen {
+			return fmt.Errorf("exceeded max message length of %d characters", maxTextLen)
+		}
+	case broker.KindCode:
+		if msg.Text == "" {
+			return fmt.Errorf("sent empty message")
+		}
+		if len(msg.Text) > maxCodeLen {
+			return fmt.Errorf("exceeded max code length of %d characters", maxCodeLen)
+		}
+		if len(msg.Lang) > maxLangLen {
+			return fmt.Errorf("exceeded max code language length of %d characters", maxLangLen)
+		}
+	case broker.KindAttachment:
+		att := msg.Attachment
+		if att == nil || att.ID == "" || att.Name == "" {
+			return fmt.Errorf("attachment id and name are required")
+		}
+		if len(att.ID) > maxAttFieldLen || len(att.MIME) > maxAttFieldLen || len(att.Name) > maxAttNameLen {
+			return fmt.Errorf("invalid attachment reference")
+		}
+		if att.Size < 0 {
+			return fmt.Errorf("invalid attachment size")
+		}
+		if len(msg.Text) > maxTextLen {
+			return fmt.Errorf("exceeded max message length of %d characters", maxTextLen)
+		}
+	case broker.KindSystem:
+		return fmt.Errorf("system messages can not be sent by clients")
+	default:
+		return fmt.Errorf("unsupported message kind %q", msg.Kind)
 	}
 
-	// TODO - Increment chan msg count here
+	if msg.Attachment != nil && msg.Kind != broker.KindAttachment {
+		return fmt.Errorf("attachment is allowed only in attachment messages")
+	}
+
+	if msg.Lang != "" && msg.Kind != broker.KindCode {
+		return fmt.Errorf("language is allowed only in code messages")
+	}
+
+	return nil
 }
 
-func (a *Agent) handleHistoryReqMsg(raw json.RawMessage) {
+func (a *Agent) handleHistoryReqMsg(ch *channel, raw json.RawMessage) {
 	var req struct {
 		To uint64 `json:"to"`
 	}
 
+	id := ch.chat.Name
+
 	err := json.Unmarshal(raw, &req)
 	if err != nil {
-		writeErr(a.conn, fmt.Sprintf("invalid history request message format: %v", err))
+		a.writeErr(id, fmt.Sprintf("invalid history request message format: %v", err))
 		return
 	}
 
@@ -239,54 +875,130 @@ func (a *Agent) handleHistoryReqMsg(raw json.RawMessage) {
 		return
 	}
 
-	msgs, err := a.buildHistoryBatch(req.To)
+	msgs, err := a.buildHistoryBatch(id, req.To)
 	if err != nil {
-		writeErr(a.conn, "could not fetch chat history")
+		a.writeErr(id, "could not fetch chat history")
 		return
 	}
 
 	// TODO - Save last msg here
 
-	a.conn.WriteJSON(msg{
-		Type: historyMsg,
-		Data: msgs,
+	a.write(msg{
+		Type:    historyMsg,
+		Channel: id,
+		Data:    msgs,
 	})
 }
 
-func (a *Agent) buildHistoryBatch(to uint64) ([]*broker.Msg, error) {
-	var offset uint64
+// buildHistoryBatch returns up to maxHistoryCount messages preceding seq to.
+// Batch is served from the store, and replayed from the broker only if
+// the range is no longer retained in store history.
+func (a *Agent) buildHistoryBatch(id string, to uint64) ([]*broker.Msg, error) {
+	// Broker sequences start at 1, so batch of a channel with less than
+	// maxHistoryCount messages starts at the first one
+	offset := uint64(1)
 
-	if to >= maxHistoryCount {
+	if to > maxHistoryCount {
 		offset = to - maxHistoryCount
 	}
 
+	stored, ok, err := a.store.GetRange(id, offset, to)
+	if err == nil && ok {
+		msgs := make([]*broker.Msg, len(stored))
+		for i := range stored {
+			msgs[i] = &stored[i]
+		}
+		return msgs, nil
+	}
+
+	return a.replayHistory(id, offset, to)
+}
+
+// replayHistory replays [from, to) range from the broker. Since the range
+// may contain gaps, messages received until the timeout are returned.
+func (a *Agent) replayHistory(id string, from, to uint64) ([]*broker.Msg, error) {
 	mc := make(chan *broker.Msg)
 
-	close, err := a.broker.Subscribe(a.chat.Name, "", offset, mc)
+	close, err := a.broker.Subscribe(id, "", from, mc)
 	if err != nil {
 		return nil, err
 	}
 
 	defer close()
 
+	timeout := time.NewTimer(a.cfg.historyTimeout)
+	defer timeout.Stop()
+
 	var msgs []*broker.Msg
 
 	for {
-		msg := <-mc
-		if msg.Seq >= to {
-			break
+		select {
+		case msg := <-mc:
+			if msg.Seq >= to {
+				return msgs, nil
+			}
+			msgs = append(msgs, msg)
+		case <-timeout.C:
+			return msgs, nil
+		case <-a.ctx.Done():
+			return nil, errClosed
 		}
-		msgs = append(msgs, msg)
 	}
+}
+
+var errClosed = errors.New("agent: connection closed")
+
+// metrics exposes slow client counters, published as "agent" expvar
+var metrics = expvar.NewMap("agent")
+
+// write queues message to be sent to the client. Write never blocks,
+// slow clients are handled according to configured overflow policy.
+func (a *Agent) write(m msg) error {
+	if a.ctx.Err() != nil {
+		return errClosed
+	}
+
+	n, err := a.out.push(m)
+	if n > 0 || err != nil {
+		a.slow.Do(func() { metrics.Add("slow_clients", 1) })
+		metrics.Add("dropped_messages", int64(n))
+	}
+
+	if err != nil {
+		metrics.Add("slow_disconnects", 1)
+		a.GoAway("slow consumer")
+		return err
+	}
+
+	return nil
+}
+
+// GoAway shuts the agent down hinting the client to reconnect and resume
+// from the last received seq. It is safe to call before HandleConn.
+func (a *Agent) GoAway(reason string) {
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+
+	if a.reason == "" {
+		a.reason = reason
+	}
+
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
 
-	return msgs, nil
+func (a *Agent) writeErr(channel, err string) {
+	a.write(msg{Error: err, Channel: channel, Type: errorMsg})
 }
 
-func writeErr(conn *websocket.Conn, err string) {
-	conn.WriteJSON(msg{Error: err, Type: errorMsg})
+// writeFatal sends error to the client and shuts the agent down
+func (a *Agent) writeFatal(channel, err string) {
+	a.writeErr(channel, err)
+	a.cancel()
 }
 
-func writeFatal(conn *websocket.Conn, err string) {
-	conn.WriteJSON(msg{Error: err, Type: errorMsg})
-	conn.Close()
+func writeErr(conn *websocket.Conn, version int, err string) {
+	conn.SetWriteDeadline(time.Now().Add(defWriteWait))
+	conn.WriteJSON(encode(version, msg{Error: err, Type: errorMsg}))
 }
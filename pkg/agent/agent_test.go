@@ -0,0 +1,689 @@
+package agent_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tonto/gossip/pkg/agent"
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/tonto/gossip/pkg/chat"
+	h "github.com/tonto/kit/http"
+)
+
+const (
+	joinTimeout = 100 * time.Millisecond
+	pingPeriod  = 50 * time.Millisecond
+	pongWait    = 150 * time.Millisecond
+)
+
+var initReq = map[string]interface{}{
+	"channel": "general",
+	"nick":    "joe",
+	"secret":  "secret",
+}
+
+func TestConnLifecycle(t *testing.T) {
+	cases := []struct {
+		name string
+		// client drives the client side of the connection
+		client       func(t *testing.T, conn *websocket.Conn, q *queue)
+		wantSubs     int
+		wantTeardown bool
+	}{
+		{
+			name: "join timeout",
+			client: func(t *testing.T, conn *websocket.Conn, q *queue) {
+				conn.SetReadDeadline(time.Now().Add(10 * joinTimeout))
+				if _, _, err := conn.ReadMessage(); err == nil {
+					t.Error("expected connection to be closed by the server")
+				}
+			},
+		},
+		{
+			name: "invalid init request",
+			client: func(t *testing.T, conn *websocket.Conn, q *queue) {
+				conn.WriteJSON(map[string]interface{}{"nick": "joe"})
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, _, err := conn.ReadMessage(); err != nil {
+					t.Errorf("expected error message, got: %v", err)
+				}
+				if _, _, err := conn.ReadMessage(); err == nil {
+					t.Error("expected connection to be closed by the server")
+				}
+			},
+		},
+		{
+			name: "peer stops responding",
+			client: func(t *testing.T, conn *websocket.Conn, q *queue) {
+				conn.WriteJSON(initReq)
+				// Pings are answered only while reading
+				time.Sleep(5 * pongWait)
+			},
+			wantSubs:     2,
+			wantTeardown: true,
+		},
+		{
+			name: "responsive peer is kept alive",
+			client: func(t *testing.T, conn *websocket.Conn, q *queue) {
+				conn.WriteJSON(initReq)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for {
+						if _, _, err := conn.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+				select {
+				case <-done:
+					t.Error("expected connection to be kept alive")
+				case <-time.After(5 * pongWait):
+				}
+			},
+			wantSubs: 2,
+		},
+		{
+			name: "client closes connection",
+			client: func(t *testing.T, conn *websocket.Conn, q *queue) {
+				conn.WriteJSON(initReq)
+				time.Sleep(pingPeriod)
+				conn.WriteMessage(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				)
+			},
+			wantSubs:     2,
+			wantTeardown: true,
+		},
+		{
+			name: "invalid credentials",
+			client: func(t *testing.T, conn *websocket.Conn, q *queue) {
+				conn.WriteJSON(map[string]interface{}{
+					"channel": "general",
+					"nick":    "joe",
+					"secret":  "invalid",
+				})
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, _, err := conn.ReadMessage(); err != nil {
+					t.Errorf("expected error message, got: %v", err)
+				}
+				if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					t.Errorf("expected normal closure, got: %v", err)
+				}
+			},
+		},
+		{
+			name: "kicked client is disconnected",
+			client: func(t *testing.T, conn *websocket.Conn, q *queue) {
+				conn.WriteJSON(initReq)
+				waitFor(t, func() bool {
+					subs, _ := q.count()
+					return subs == 2
+				})
+				q.publish(t, "events.general", &broker.Event{Type: broker.EventKick, Nick: "joe"})
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				var m struct {
+					Type int `json:"type"`
+				}
+				if err := conn.ReadJSON(&m); err != nil {
+					t.Errorf("expected kick event, got: %v", err)
+				}
+				if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					t.Errorf("expected normal closure, got: %v", err)
+				}
+			},
+			wantSubs:     2,
+			wantTeardown: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q queue
+			var ig ingest
+
+			b := broker.New(&q, &store{}, &ig)
+
+			srv := newServer(t, agent.NewAPI(
+				b,
+				&store{},
+				agent.WithJoinTimeout(joinTimeout),
+				agent.WithHeartbeat(pingPeriod, pongWait),
+			))
+			defer srv.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("could not connect: %v", err)
+			}
+			defer conn.Close()
+
+			tc.client(t, conn, &q)
+
+			waitFor(t, func() bool {
+				subs, _ := q.count()
+				return subs == tc.wantSubs
+			})
+
+			if !tc.wantTeardown {
+				_, closed := q.count()
+				if closed != 0 || ig.cleaned() != 0 {
+					t.Errorf("unexpected teardown of %d subscriptions and %d ingests", closed, ig.cleaned())
+				}
+				return
+			}
+
+			waitFor(t, func() bool {
+				subs, closed := q.count()
+				return subs == closed && ig.cleaned() == ig.started()
+			})
+		})
+	}
+}
+
+func newServer(t *testing.T, api *agent.API) *httptest.Server {
+	return newEndpointServer(t, api, "/connect")
+}
+
+func newEndpointServer(t *testing.T, api *agent.API, endpoint string) *httptest.Server {
+	var handler h.HandlerFunc
+	for path, ep := range api.Endpoints() {
+		if path == endpoint {
+			handler = ep.Handler
+		}
+	}
+	if handler == nil {
+		t.Fatalf("%s endpoint not registered", endpoint)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(context.Background(), w, r)
+	}))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("condition not met before deadline")
+}
+
+type queue struct {
+	sync.Mutex
+	subs   int
+	closed int
+	fs     map[string]func(uint64, []byte)
+	starts []uint64
+	sent   [][]byte
+	conn   string
+}
+
+func (q *queue) SubscribeSeq(id string, conn string, start uint64, f func(uint64, []byte)) (io.Closer, error) {
+	q.Lock()
+	q.starts = append(q.starts, start)
+	if conn != "" {
+		q.conn = conn
+	}
+	q.Unlock()
+	return q.subscribe(id, f), nil
+}
+
+func (q *queue) SubscribeTimestamp(id string, conn string, t time.Time, f func(uint64, []byte)) (io.Closer, error) {
+	q.Lock()
+	if conn != "" {
+		q.conn = conn
+	}
+	q.Unlock()
+	return q.subscribe(id, f), nil
+}
+
+func (q *queue) Send(id string, data []byte) error {
+	q.Lock()
+	defer q.Unlock()
+	q.sent = append(q.sent, data)
+	return nil
+}
+
+func (q *queue) subscribe(id string, f func(uint64, []byte)) io.Closer {
+	q.Lock()
+	defer q.Unlock()
+	if q.fs == nil {
+		q.fs = make(map[string]func(uint64, []byte))
+	}
+	q.fs[id] = f
+	q.subs++
+	return &cl{q: q}
+}
+
+func (q *queue) publish(t *testing.T, id string, e *broker.Event) {
+	data, err := broker.EncodeEvent(e)
+	if err != nil {
+		t.Fatalf("could not encode event: %v", err)
+	}
+	q.publishData(id, 1, data)
+}
+
+func (q *queue) publishData(id string, seq uint64, data []byte) {
+	q.Lock()
+	f := q.fs[id]
+	q.Unlock()
+	f(seq, data)
+}
+
+func (q *queue) count() (int, int) {
+	q.Lock()
+	defer q.Unlock()
+	return q.subs, q.closed
+}
+
+type cl struct {
+	q    *queue
+	once sync.Once
+}
+
+func (c *cl) Close() error {
+	c.once.Do(func() {
+		c.q.Lock()
+		c.q.closed++
+		c.q.Unlock()
+	})
+	return nil
+}
+
+type ingest struct {
+	sync.Mutex
+	runs     int
+	cleanups int
+}
+
+func (i *ingest) Run(string) (func(), error) {
+	i.Lock()
+	defer i.Unlock()
+	i.runs++
+	return func() {
+		i.Lock()
+		i.cleanups++
+		i.Unlock()
+	}, nil
+}
+
+func (i *ingest) started() int {
+	i.Lock()
+	defer i.Unlock()
+	return i.runs
+}
+
+func (i *ingest) cleaned() int {
+	i.Lock()
+	defer i.Unlock()
+	return i.cleanups
+}
+
+type store struct {
+	sync.Mutex
+	history []broker.Msg
+	tickets map[string]agent.Ticket
+}
+
+func (s *store) Get(id string) (*chat.Chat, error) {
+	ch := chat.NewChannel(id, false)
+	ch.Register(&chat.User{Nick: "joe"}, "secret")
+	return ch, nil
+}
+
+func (s *store) GetAccount(string) (*chat.Account, error) { return nil, nil }
+
+func (s *store) GetRecent(string, int64) ([]broker.Msg, uint64, error) { return nil, 0, nil }
+
+func (s *store) GetRange(id string, from, to uint64) ([]broker.Msg, bool, error) {
+	if len(s.history) == 0 || from < s.history[0].Seq {
+		return nil, false, nil
+	}
+
+	var msgs []broker.Msg
+	for _, m := range s.history {
+		if m.Seq >= from && m.Seq < to {
+			msgs = append(msgs, m)
+		}
+	}
+
+	return msgs, true, nil
+}
+
+func (s *store) UpdateLastClientSeq(string, string, uint64) {}
+
+func (s *store) SaveTicket(ticket string, t *agent.Ticket, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.tickets == nil {
+		s.tickets = make(map[string]agent.Ticket)
+	}
+	s.tickets[ticket] = *t
+	return nil
+}
+
+func (s *store) TakeTicket(ticket string) (*agent.Ticket, error) {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.tickets[ticket]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.tickets, ticket)
+	return &t, nil
+}
+
+func (s *store) ReserveMsgID(id, nick, msgid string, ttl time.Duration) (uint64, bool, error) {
+	if msgid == "dup" {
+		return 3, false, nil
+	}
+	return 0, true, nil
+}
+
+func (s *store) ReleaseMsgID(id, nick, msgid string) {}
+
+func TestShutdown(t *testing.T) {
+	var q queue
+	var ig ingest
+
+	api := agent.NewAPI(
+		broker.New(&q, &store{}, &ig),
+		&store{},
+		agent.WithHeartbeat(pingPeriod, pongWait),
+	)
+
+	srv := newServer(t, api)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]interface{}{
+		"channel":  "general",
+		"nick":     "joe",
+		"secret":   "secret",
+		"last_seq": 5,
+	})
+
+	waitFor(t, func() bool {
+		subs, _ := q.count()
+		return subs == 2
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := api.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+
+	subs, closed := q.count()
+	if subs != closed || ig.cleaned() != ig.started() {
+		t.Errorf("expected subscriptions to be closed on shutdown")
+	}
+
+	var m struct {
+		Data struct {
+			Reason  string            `json:"reason"`
+			LastSeq map[string]uint64 `json:"last_seq"`
+		} `json:"data"`
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatalf("expected resume message, got: %v", err)
+	}
+
+	if m.Data.Reason != "server going away" || m.Data.LastSeq["general"] != 5 {
+		t.Errorf("unexpected resume message: %+v", m.Data)
+	}
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected going away closure, got: %v", err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected new connections to be rejected, got: %v", err)
+	}
+}
+
+func TestAck(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake map[string]interface{}
+		send      map[string]interface{}
+		deliver   *broker.Msg
+		own       bool
+		want      string
+	}{
+		{
+			name:      "ack with seq",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": "chat", "id": "1", "data": map[string]interface{}{"text": "hi"}},
+			deliver:   &broker.Msg{From: "joe", Text: "hi", ID: "1"},
+			own:       true,
+			want:      `{"type":"ack","channel":"general","id":"1","data":{"seq":9}}`,
+		},
+		{
+			name:      "duplicate",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": "chat", "id": "dup", "data": map[string]interface{}{"text": "hi"}},
+			want:      `{"type":"ack","channel":"general","id":"dup","data":{"seq":3,"duplicate":true}}`,
+		},
+		{
+			name:      "error",
+			handshake: initReq,
+			send:      map[string]interface{}{"type": 0, "id": "1", "data": map[string]interface{}{"text": ""}},
+			want:      `{"type":10,"channel":"general","id":"1","error":"sent empty message"}`,
+		},
+		{
+			name:      "own messages without pending ack are not sent",
+			handshake: v1InitReq(nil),
+			deliver:   &broker.Msg{From: "joe", Text: "hi", ID: "2"},
+			own:       true,
+		},
+		{
+			name:      "own messages from other connections are sent",
+			handshake: v1InitReq(nil),
+			deliver:   &broker.Msg{From: "joe", Text: "hi", Conn: "phone"},
+			want:      `{"type":"chat","channel":"general","data":{"meta":null,"time":"0001-01-01T00:00:00Z","seq":9,"text":"hi","from":"joe"}}`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q queue
+			var ig ingest
+
+			srv := newServer(t, agent.NewAPI(broker.New(&q, &store{}, &ig), &store{}))
+			defer srv.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("could not connect: %v", err)
+			}
+			defer conn.Close()
+
+			conn.WriteJSON(tc.handshake)
+
+			waitFor(t, func() bool {
+				subs, _ := q.count()
+				return subs == 2
+			})
+
+			if tc.send != nil {
+				conn.WriteJSON(tc.send)
+			}
+
+			if tc.send != nil && tc.deliver != nil {
+				waitFor(t, func() bool {
+					q.Lock()
+					defer q.Unlock()
+					return len(q.sent) == 1
+				})
+			}
+
+			if tc.deliver != nil {
+				if tc.own {
+					q.Lock()
+					tc.deliver.Conn = q.conn
+					q.Unlock()
+				}
+				data, _ := broker.EncodeMsg(tc.deliver)
+				q.publishData("chat.general", 9, data)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+			_, data, err := conn.ReadMessage()
+			if tc.want == "" {
+				if err == nil {
+					t.Errorf("unexpected message: %s", data)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("could not read message: %v", err)
+			}
+
+			if string(data) != tc.want+"\n" {
+				t.Errorf("unexpected message. want: %s, got: %s", tc.want, data)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	cases := []struct {
+		name     string
+		history  []broker.Msg
+		to       uint64
+		replay   []uint64
+		wantSubs int
+		wantSeqs []uint64
+	}{
+		{
+			name:     "from store",
+			history:  []broker.Msg{{Seq: 1}, {Seq: 2}, {Seq: 3}, {Seq: 4}},
+			to:       4,
+			wantSubs: 2,
+			wantSeqs: []uint64{1, 2, 3},
+		},
+		{
+			name:     "replay outside retained history",
+			history:  []broker.Msg{{Seq: 3}, {Seq: 4}},
+			to:       3,
+			replay:   []uint64{1, 2, 3},
+			wantSubs: 3,
+			wantSeqs: []uint64{1, 2},
+		},
+		{
+			name:     "replay timeout",
+			to:       5,
+			replay:   []uint64{1, 2},
+			wantSubs: 3,
+			wantSeqs: []uint64{1, 2},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q queue
+			var ig ingest
+
+			s := &store{history: tc.history}
+
+			srv := newServer(t, agent.NewAPI(
+				broker.New(&q, s, &ig),
+				s,
+				agent.WithHistoryTimeout(100*time.Millisecond),
+			))
+			defer srv.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("could not connect: %v", err)
+			}
+			defer conn.Close()
+
+			conn.WriteJSON(v1InitReq(nil))
+
+			waitFor(t, func() bool {
+				subs, _ := q.count()
+				return subs == 2
+			})
+
+			conn.WriteJSON(map[string]interface{}{
+				"type": "history_request",
+				"data": map[string]interface{}{"to": tc.to},
+			})
+
+			waitFor(t, func() bool {
+				subs, _ := q.count()
+				return subs == tc.wantSubs
+			})
+
+			for _, seq := range tc.replay {
+				data, _ := broker.EncodeMsg(&broker.Msg{From: "jane", Text: "hi"})
+				q.publishData("chat.general", seq, data)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			var m struct {
+				Type string       `json:"type"`
+				Data []broker.Msg `json:"data"`
+			}
+
+			if err := conn.ReadJSON(&m); err != nil {
+				t.Fatalf("could not read message: %v", err)
+			}
+
+			if m.Type != "history" {
+				t.Fatalf("unexpected message type: %s", m.Type)
+			}
+
+			var seqs []uint64
+			for _, msg := range m.Data {
+				seqs = append(seqs, msg.Seq)
+			}
+
+			if !reflect.DeepEqual(seqs, tc.wantSeqs) {
+				t.Errorf("unexpected history. want: %v, got: %v", tc.wantSeqs, seqs)
+			}
+		})
+	}
+}
+
+type attachments map[string]*broker.Attachment
+
+func (a attachments) Stat(c context.Context, channel, id string) (*broker.Attachment, error) {
+	att, ok := a[channel+"/"+id]
+	if !ok {
+		return nil, nil
+	}
+	cp := *att
+	return &cp, nil
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/tonto/gossip/pkg/broker"
 
@@ -15,10 +18,13 @@ import (
 )
 
 // NewAPI creates new websocket api
-func NewAPI(broker *broker.Broker, store ChatStore) *API {
+func NewAPI(broker *broker.Broker, store ChatStore, opts ...Option) *API {
 	api := API{
 		broker: broker,
 		store:  store,
+		opts:   opts,
+		cfg:    newConfig(opts...),
+		agents: make(map[*Agent]struct{}),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -27,6 +33,10 @@ func NewAPI(broker *broker.Broker, store ChatStore) *API {
 	}
 
 	api.RegisterHandler("GET", "/connect", api.connect)
+	api.RegisterHandler("GET", "/protocol", api.protocol)
+	api.RegisterHandler("GET", "/events", api.events)
+	api.RegisterEndpoint("POST", "/ticket", api.ticket)
+	api.RegisterEndpoint("POST", "/send", api.send)
 
 	return &api
 }
@@ -36,13 +46,76 @@ type API struct {
 	h.BaseService
 	broker   *broker.Broker
 	store    ChatStore
+	opts     []Option
+	cfg      config
 	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	agents   map[*Agent]struct{}
+	shutdown bool
 }
 
 // Prefix returns api prefix for this service
 func (api *API) Prefix() string { return "agent" }
 
+// Shutdown stops accepting new connections and asks connected clients to
+// reconnect and resume from the last received seq. Shutdown waits for all
+// connections to close, and their chat subscriptions with them, until ctx is done.
+func (api *API) Shutdown(ctx context.Context) error {
+	api.mu.Lock()
+	api.shutdown = true
+	for a := range api.agents {
+		a.GoAway("server going away")
+	}
+	api.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		api.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("ws api: shutdown: %v", ctx.Err())
+	}
+}
+
+func (api *API) track(a *Agent) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if api.shutdown {
+		return false
+	}
+
+	api.agents[a] = struct{}{}
+	api.wg.Add(1)
+
+	return true
+}
+
+func (api *API) untrack(a *Agent) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	delete(api.agents, a)
+	api.wg.Done()
+}
+
 func (api *API) connect(c context.Context, w http.ResponseWriter, r *http.Request) {
+	agent := New(api.broker, api.store, api.opts...)
+
+	if !api.track(agent) {
+		respond.WithJSON(w, r, h.NewError(http.StatusServiceUnavailable, fmt.Errorf("ws api: server is shutting down")))
+		return
+	}
+
+	defer api.untrack(agent)
+
 	conn, err := api.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		respond.WithJSON(w, r, fmt.Errorf("ws api: unable to upgrade to ws connection: %v", err))
@@ -51,26 +124,49 @@ func (api *API) connect(c context.Context, w http.ResponseWriter, r *http.Reques
 
 	req, err := api.waitConnInit(conn)
 	if err != nil {
-		if err == errConnClosed {
-			return
+		if err != errConnClosed {
+			v := ProtocolV0
+			if req != nil {
+				v = req.Version
+			}
+			writeErr(conn, v, err.Error())
 		}
-		writeErr(conn, err.Error())
+		conn.Close()
 		return
 	}
 
-	agent := New(api.broker, api.store)
-	agent.HandleConn(conn, req)
+	agent.HandleConn(c, conn, req)
+}
+
+func (api *API) protocol(c context.Context, w http.ResponseWriter, r *http.Request) {
+	respond.WithJSON(w, r, Describe())
 }
 
 type initConReq struct {
+	// Version represents requested protocol version, see Protocol
+	Version int `json:"version"`
+
 	Channel string  `json:"channel"`
 	Nick    string  `json:"nick"`
 	Secret  string  `json:"secret"` // User secret
 	LastSeq *uint64 `json:"last_seq"`
+
+	// Multiplex enables joining multiple chats over single connection.
+	// Requires account credentials, Channel is optional in this mode.
+	Multiplex bool `json:"multiplex"`
 }
 
 func (ir *initConReq) Validate() error {
 	// TODO - Validate length alphanumeric etc...
+	if ir.Version < ProtocolV0 || ir.Version > LatestProtocol {
+		return fmt.Errorf("join fail: unsupported protocol version %d", ir.Version)
+	}
+	if ir.Multiplex {
+		if ir.Nick == "" || ir.Secret == "" {
+			return fmt.Errorf("join fail: nick and secret are required")
+		}
+		return nil
+	}
 	if ir.Channel == "" || ir.Nick == "" {
 		return fmt.Errorf("join fail: channel_id, nick and secret are required")
 	}
@@ -80,23 +176,41 @@ func (ir *initConReq) Validate() error {
 var errConnClosed = errors.New("connection closed")
 
 func (api *API) waitConnInit(conn *websocket.Conn) (*initConReq, error) {
-	// TODO - Add join timeout
+	conn.SetReadDeadline(time.Now().Add(api.cfg.joinTimeout))
 
 	t, wsr, err := conn.NextReader()
 	if err != nil || t == websocket.CloseMessage {
 		return nil, errConnClosed
 	}
 
+	data, err := ioutil.ReadAll(wsr)
+	if err != nil {
+		return nil, errConnClosed
+	}
+
 	var req initConReq
 
-	err = json.NewDecoder(wsr).Decode(&req)
+	// Version is decoded first so that errors are reported using
+	// requested protocol, and v1 handshake is validated before decoding.
+	// v0 handshake is only decoded for backward compatibility.
+	json.Unmarshal(data, &struct {
+		Version *int `json:"version"`
+	}{&req.Version})
+
+	if req.Version >= ProtocolV1 && req.Version <= LatestProtocol {
+		if err := validate(handshakeValidator, data); err != nil {
+			return &req, err
+		}
+	}
+
+	err = json.Unmarshal(data, &req)
 	if err != nil {
-		return nil, err
+		return &req, err
 	}
 
 	err = req.Validate()
 	if err != nil {
-		return nil, err
+		return &req, err
 	}
 
 	return &req, nil
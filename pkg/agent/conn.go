@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tonto/gossip/pkg/broker"
+)
+
+// conn represents agent client connection transport.
+// Writes are never called concurrently.
+type conn interface {
+	// Next blocks until next client message is received
+	Next() (io.Reader, error)
+
+	// Write sends single message to the client
+	Write(msg) error
+
+	// Ping checks whether the client is still there
+	Ping() error
+
+	// Close closes the connection with websocket close code and reason
+	Close(int, string)
+}
+
+func newWSConn(c *websocket.Conn, version int, cfg config) *wsConn {
+	ws := wsConn{Conn: c, version: version, cfg: cfg}
+
+	c.SetReadDeadline(time.Now().Add(cfg.pongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(cfg.pongWait))
+	})
+
+	return &ws
+}
+
+// wsConn represents websocket transport. Read deadline is extended on every
+// received message or pong, so the client is considered dead if it stops
+// responding to pings.
+type wsConn struct {
+	*websocket.Conn
+	version int
+	cfg     config
+}
+
+func (c *wsConn) Next() (io.Reader, error) {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(c.cfg.pongWait))
+	return r, nil
+}
+
+func (c *wsConn) Write(m msg) error {
+	c.SetWriteDeadline(time.Now().Add(c.cfg.writeWait))
+	return c.WriteJSON(encode(c.version, m))
+}
+
+func (c *wsConn) Ping() error {
+	return c.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.cfg.writeWait))
+}
+
+func (c *wsConn) Close(code int, reason string) {
+	c.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(c.cfg.writeWait),
+	)
+	c.Conn.Close()
+}
+
+func newSSEConn(w http.ResponseWriter, f http.Flusher, r *http.Request) *sseConn {
+	return &sseConn{
+		w:      w,
+		f:      f,
+		done:   r.Context().Done(),
+		closed: make(chan struct{}),
+	}
+}
+
+// sseConn represents server-sent events transport. Clients send messages
+// using regular http requests, so Next only blocks until the request is done.
+// Messages are sent as events named by v1 message type, and chat messages
+// carry seq as event id so that clients can resume using Last-Event-ID.
+type sseConn struct {
+	w         http.ResponseWriter
+	f         http.Flusher
+	done      <-chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *sseConn) Next() (io.Reader, error) {
+	select {
+	case <-c.done:
+	case <-c.closed:
+	}
+	return nil, io.EOF
+}
+
+func (c *sseConn) Write(m msg) error {
+	data, err := json.Marshal(encode(ProtocolV1, m))
+	if err != nil {
+		return err
+	}
+
+	if bm, ok := m.Data.(*broker.Msg); ok && m.Type == chatMsg {
+		if _, err := fmt.Fprintf(c.w, "id: %d\n", bm.Seq); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(c.w, "event: %s\ndata: %s\n\n", m.Type, data); err != nil {
+		return err
+	}
+
+	c.f.Flush()
+
+	return nil
+}
+
+func (c *sseConn) Ping() error {
+	if _, err := io.WriteString(c.w, ": ping\n\n"); err != nil {
+		return err
+	}
+	c.f.Flush()
+	return nil
+}
+
+func (c *sseConn) Close(int, string) {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
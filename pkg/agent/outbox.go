@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tonto/gossip/pkg/broker"
+)
+
+// OverflowPolicy represents the way agent handles clients
+// which do not read messages as fast as they are received
+type OverflowPolicy int
+
+const (
+	// DropOldest discards oldest queued chat message to make room for new ones.
+	// Discarded messages are reported with a gap message, same as in Coalesce.
+	DropOldest OverflowPolicy = iota
+
+	// Disconnect closes the connection, hinting the client
+	// to reconnect and resume from the last received seq
+	Disconnect
+
+	// Coalesce replaces queued chat messages with a single gap
+	// message which the client can use to request missed history
+	Coalesce
+)
+
+// ParseOverflowPolicy parses overflow policy name
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "drop_oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "coalesce":
+		return Coalesce, nil
+	}
+	return 0, fmt.Errorf("agent: invalid overflow policy: %s", s)
+}
+
+var errOverflow = errors.New("agent: outbound buffer overflow")
+
+// gap represents range of chat messages dropped for a slow client
+type gap struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+func newOutbox(size int, policy OverflowPolicy) *outbox {
+	return &outbox{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// outbox represents bounded client outbound message queue
+type outbox struct {
+	mu     sync.Mutex
+	msgs   []msg
+	size   int
+	policy OverflowPolicy
+	ready  chan struct{}
+}
+
+// push queues m applying overflow policy if the queue is full. Returns number of
+// chat messages that will not be delivered, or errOverflow if the client should
+// be disconnected.
+func (o *outbox) push(m msg) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var dropped int
+
+	if len(o.msgs) >= o.size {
+		switch o.policy {
+		case Disconnect:
+			return 0, errOverflow
+		case Coalesce:
+			if n := o.coalesce(m); n > 0 {
+				o.notify()
+				return n, nil
+			}
+		}
+
+		dropped = o.dropOldest()
+	}
+
+	o.msgs = append(o.msgs, m)
+	o.notify()
+
+	return dropped, nil
+}
+
+// coalesce folds chat message m and queued messages of the same chat into a
+// single gap message. Returns number of folded messages, or 0 if m could not
+// be coalesced.
+func (o *outbox) coalesce(m msg) int {
+	bm, ok := m.Data.(*broker.Msg)
+	if m.Type != chatMsg || !ok {
+		return 0
+	}
+
+	g := gap{From: bm.Seq, To: bm.Seq}
+	at := -1
+	n := 1
+
+	msgs := o.msgs[:0]
+
+	for _, qm := range o.msgs {
+		if qm.Channel != m.Channel {
+			msgs = append(msgs, qm)
+			continue
+		}
+
+		switch d := qm.Data.(type) {
+		case *broker.Msg:
+			if qm.Type != chatMsg {
+				break
+			}
+			g.extend(d.Seq, d.Seq)
+			n++
+			if at == -1 {
+				at = len(msgs)
+				msgs = append(msgs, msg{})
+			}
+			continue
+		case gap:
+			g.extend(d.From, d.To)
+			if at == -1 {
+				at = len(msgs)
+				msgs = append(msgs, msg{})
+			}
+			continue
+		}
+
+		msgs = append(msgs, qm)
+	}
+
+	o.msgs = msgs
+
+	if at == -1 {
+		return 0
+	}
+
+	o.msgs[at] = msg{Type: gapMsg, Channel: m.Channel, Data: g}
+
+	return n
+}
+
+func (g *gap) extend(from, to uint64) {
+	if from < g.From {
+		g.From = from
+	}
+	if to > g.To {
+		g.To = to
+	}
+}
+
+// dropOldest removes oldest queued chat message, recording its seq in the gap
+// message of its chat, so that the client can request missed history. If the
+// chat has no queued gap, one takes the place of removed message, so the queue
+// can exceed its size by at most one gap per chat. If no chat messages are
+// queued the oldest other message is removed. Returns number of removed messages.
+func (o *outbox) dropOldest() int {
+	i := o.oldestChat()
+	if i == -1 {
+		for i, m := range o.msgs {
+			if m.Type != gapMsg {
+				o.msgs = append(o.msgs[:i], o.msgs[i+1:]...)
+				return 1
+			}
+		}
+		return 0
+	}
+
+	m := o.msgs[i]
+	seq := m.Data.(*broker.Msg).Seq
+
+	if j := o.gapOf(m.Channel); j != -1 {
+		g := o.msgs[j].Data.(gap)
+		g.extend(seq, seq)
+		o.msgs[j].Data = g
+		o.msgs = append(o.msgs[:i], o.msgs[i+1:]...)
+		return 1
+	}
+
+	o.msgs[i] = msg{Type: gapMsg, Channel: m.Channel, Data: gap{From: seq, To: seq}}
+
+	return 1
+}
+
+// oldestChat returns index of the oldest queued chat message, or -1
+func (o *outbox) oldestChat() int {
+	for i, m := range o.msgs {
+		if _, ok := m.Data.(*broker.Msg); ok && m.Type == chatMsg {
+			return i
+		}
+	}
+	return -1
+}
+
+// gapOf returns index of queued gap message of chat id, or -1
+func (o *outbox) gapOf(id string) int {
+	for i, m := range o.msgs {
+		if _, ok := m.Data.(gap); ok && m.Type == gapMsg && m.Channel == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (o *outbox) pop() (msg, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.msgs) == 0 {
+		return msg{}, false
+	}
+
+	m := o.msgs[0]
+	o.msgs = o.msgs[1:]
+
+	return m, true
+}
+
+func (o *outbox) clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.msgs = nil
+}
+
+func (o *outbox) notify() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tonto/gossip/pkg/broker"
+)
+
+func chatMessage(channel string, seq uint64) msg {
+	return msg{Type: chatMsg, Channel: channel, Data: &broker.Msg{Seq: seq}}
+}
+
+func TestOutboxPush(t *testing.T) {
+	cases := []struct {
+		name        string
+		policy      OverflowPolicy
+		queued      []msg
+		push        msg
+		want        []msg
+		wantDropped int
+		wantErr     bool
+	}{
+		{
+			name:   "not full",
+			policy: Disconnect,
+			queued: []msg{chatMessage("general", 1)},
+			push:   chatMessage("general", 2),
+			want:   []msg{chatMessage("general", 1), chatMessage("general", 2)},
+		},
+		{
+			name:    "disconnect",
+			policy:  Disconnect,
+			queued:  []msg{chatMessage("general", 1), chatMessage("general", 2)},
+			push:    chatMessage("general", 3),
+			want:    []msg{chatMessage("general", 1), chatMessage("general", 2)},
+			wantErr: true,
+		},
+		{
+			name:   "drop oldest",
+			policy: DropOldest,
+			queued: []msg{chatMessage("general", 1), chatMessage("general", 2)},
+			push:   chatMessage("general", 3),
+			want: []msg{
+				{Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 1}},
+				chatMessage("general", 2),
+				chatMessage("general", 3),
+			},
+			wantDropped: 1,
+		},
+		{
+			name:   "drop oldest extends gap",
+			policy: DropOldest,
+			queued: []msg{{Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 1}}, chatMessage("general", 2)},
+			push:   chatMessage("general", 3),
+			want: []msg{
+				{Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 2}},
+				chatMessage("general", 3),
+			},
+			wantDropped: 1,
+		},
+		{
+			name:   "drop oldest keeps events",
+			policy: DropOldest,
+			queued: []msg{{Type: eventMsg}, chatMessage("general", 2)},
+			push:   chatMessage("general", 3),
+			want: []msg{
+				{Type: eventMsg},
+				{Type: gapMsg, Channel: "general", Data: gap{From: 2, To: 2}},
+				chatMessage("general", 3),
+			},
+			wantDropped: 1,
+		},
+		{
+			name:   "drop oldest keeps gaps",
+			policy: DropOldest,
+			queued: []msg{
+				{Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 1}},
+				{Type: gapMsg, Channel: "offtopic", Data: gap{From: 2, To: 2}},
+			},
+			push: msg{Type: eventMsg},
+			want: []msg{
+				{Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 1}},
+				{Type: gapMsg, Channel: "offtopic", Data: gap{From: 2, To: 2}},
+				{Type: eventMsg},
+			},
+		},
+		{
+			name:        "coalesce",
+			policy:      Coalesce,
+			queued:      []msg{{Type: eventMsg}, chatMessage("general", 1), chatMessage("general", 2)},
+			push:        chatMessage("general", 3),
+			want:        []msg{{Type: eventMsg}, {Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 3}}},
+			wantDropped: 3,
+		},
+		{
+			name:   "coalesce extends gap",
+			policy: Coalesce,
+			queued: []msg{
+				{Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 3}},
+				chatMessage("offtopic", 4),
+			},
+			push: chatMessage("general", 5),
+			want: []msg{
+				{Type: gapMsg, Channel: "general", Data: gap{From: 1, To: 5}},
+				chatMessage("offtopic", 4),
+			},
+			wantDropped: 1,
+		},
+		{
+			name:   "coalesce falls back to drop oldest",
+			policy: Coalesce,
+			queued: []msg{chatMessage("offtopic", 1), chatMessage("offtopic", 2)},
+			push:   chatMessage("general", 3),
+			want: []msg{
+				{Type: gapMsg, Channel: "offtopic", Data: gap{From: 1, To: 1}},
+				chatMessage("offtopic", 2),
+				chatMessage("general", 3),
+			},
+			wantDropped: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newOutbox(2, tc.policy)
+			o.msgs = append(o.msgs, tc.queued...)
+
+			n, err := o.push(tc.push)
+			if tc.wantErr != (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if n != tc.wantDropped {
+				t.Errorf("unexpected dropped count. want: %d, got: %d", tc.wantDropped, n)
+			}
+
+			var got []msg
+			for {
+				m, ok := o.pop()
+				if !ok {
+					break
+				}
+				got = append(got, m)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected queue. want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
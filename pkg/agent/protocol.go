@@ -0,0 +1,461 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Websocket protocol versions. Protocol version is requested by the client
+// in connection init (handshake) message, and defaults to ProtocolV0.
+const (
+	// ProtocolV0 is the legacy protocol, using integer message types
+	// and no message validation apart from decoding
+	ProtocolV0 = 0
+
+	// ProtocolV1 uses string message types. All client messages,
+	// including handshake, are validated against protocol JSON Schema.
+	ProtocolV1 = 1
+
+	// LatestProtocol is the latest supported protocol version
+	LatestProtocol = ProtocolV1
+)
+
+var msgNames = map[msgT]string{
+	chatMsg:       "chat",
+	historyMsg:    "history",
+	errorMsg:      "error",
+	infoMsg:       "info",
+	historyReqMsg: "history_request",
+	eventMsg:      "event",
+	joinMsg:       "join",
+	leaveMsg:      "leave",
+	gapMsg:        "gap",
+	resumeMsg:     "resume",
+	ackMsg:        "ack",
+}
+
+func (t msgT) String() string { return msgNames[t] }
+
+// wireMsg represents v1 server message
+type wireMsg struct {
+	Type    string      `json:"type"`
+	Channel string      `json:"channel,omitempty"`
+	ID      string      `json:"id,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// encode converts m to wire format of protocol version v
+func encode(v int, m msg) interface{} {
+	if v == ProtocolV0 {
+		return m
+	}
+	return wireMsg{
+		Type:    m.Type.String(),
+		Channel: m.Channel,
+		ID:      m.ID,
+		Data:    m.Data,
+		Error:   m.Error,
+	}
+}
+
+type clientMsg struct {
+	Type    msgT            `json:"type"`
+	Channel string          `json:"channel,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// decode reads client message in wire format of protocol version v
+func decode(v int, r io.Reader) (*clientMsg, error) {
+	var m clientMsg
+
+	if v == ProtocolV0 {
+		if err := json.NewDecoder(r).Decode(&m); err != nil {
+			return nil, fmt.Errorf("invalid message format: %v", err)
+		}
+		return &m, nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message format: %v", err)
+	}
+
+	var wm struct {
+		Type    string          `json:"type"`
+		Channel string          `json:"channel"`
+		ID      string          `json:"id"`
+		Data    json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(data, &wm); err != nil {
+		return nil, fmt.Errorf("invalid message format: %v", err)
+	}
+
+	t, ok := clientMsgTypes[wm.Type]
+	if !ok {
+		return nil, fmt.Errorf("invalid message type: %q", wm.Type)
+	}
+
+	if err := validate(clientValidators[wm.Type], data); err != nil {
+		return nil, err
+	}
+
+	m.Type = t
+	m.Channel = wm.Channel
+	m.ID = wm.ID
+	m.Data = wm.Data
+
+	return &m, nil
+}
+
+var clientMsgTypes = map[string]msgT{
+	"chat":            chatMsg,
+	"history_request": historyReqMsg,
+	"join":            joinMsg,
+	"leave":           leaveMsg,
+}
+
+var (
+	handshakeValidator = mustCompile(handshakeSchema)
+	clientValidators   = compileAll(clientSchemas)
+)
+
+func mustCompile(schema string) *gojsonschema.Schema {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		panic(fmt.Sprintf("agent: invalid protocol schema: %v", err))
+	}
+	return s
+}
+
+func compileAll(schemas map[string]string) map[string]*gojsonschema.Schema {
+	m := make(map[string]*gojsonschema.Schema)
+	for name, s := range schemas {
+		m[name] = mustCompile(s)
+	}
+	return m
+}
+
+func validate(s *gojsonschema.Schema, data []byte) error {
+	res, err := s.Validate(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return fmt.Errorf("invalid message format: %v", err)
+	}
+
+	if !res.Valid() {
+		return fmt.Errorf("invalid message: %s", res.Errors()[0])
+	}
+
+	return nil
+}
+
+// Protocol represents websocket protocol description
+// containing JSON Schema of every message
+type Protocol struct {
+	Version   int                        `json:"version"`
+	Handshake json.RawMessage            `json:"handshake"`
+	Client    map[string]json.RawMessage `json:"client"`
+	Server    map[string]json.RawMessage `json:"server"`
+}
+
+// Describe returns latest websocket protocol description
+func Describe() *Protocol {
+	p := Protocol{
+		Version:   LatestProtocol,
+		Handshake: json.RawMessage(handshakeSchema),
+		Client:    make(map[string]json.RawMessage),
+		Server:    make(map[string]json.RawMessage),
+	}
+	for name, s := range clientSchemas {
+		p.Client[name] = json.RawMessage(s)
+	}
+	for name, s := range serverSchemas {
+		p.Server[name] = json.RawMessage(s)
+	}
+	return &p
+}
+
+const handshakeSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "handshake",
+	"description": "Connection init message, sent by the client right after connecting",
+	"type": "object",
+	"properties": {
+		"version": {"type": "integer", "enum": [0, 1]},
+		"channel": {"type": "string", "maxLength": 25},
+		"nick": {"type": "string", "pattern": "^[a-zA-Z0-9_]{1,20}$"},
+		"secret": {"type": "string", "minLength": 1},
+		"last_seq": {"type": "integer", "minimum": 0},
+		"multiplex": {"type": "boolean"}
+	},
+	"required": ["version", "nick", "secret"],
+	"additionalProperties": false
+}`
+
+// Client message schemas by message type
+var clientSchemas = map[string]string{
+	"chat": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "chat",
+	"description": "Sends message to the chat. If id is provided, server responds with ack",
+	"type": "object",
+	"properties": {
+		"type": {"const": "chat"},
+		"channel": {"type": "string"},
+		"id": {"type": "string", "minLength": 1, "maxLength": 64},
+		"data": {
+			"type": "object",
+			"properties": {
+				"kind": {"enum": ["text", "markdown", "code", "attachment"]},
+				"text": {"type": "string", "maxLength": 4096},
+				"lang": {"type": "string", "maxLength": 32},
+				"attachment": ` + attachmentDef + `
+			},
+			"if": {"properties": {"kind": {"const": "attachment"}}, "required": ["kind"]},
+			"then": {"required": ["attachment"]},
+			"else": {"properties": {"text": {"minLength": 1}}, "required": ["text"]}
+		}
+	},
+	"required": ["type", "data"],
+	"additionalProperties": false
+}`,
+	"history_request": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "history_request",
+	"description": "Requests chat messages preceding seq to",
+	"type": "object",
+	"properties": {
+		"type": {"const": "history_request"},
+		"channel": {"type": "string"},
+		"data": {
+			"type": "object",
+			"properties": {
+				"to": {"type": "integer", "minimum": 1}
+			},
+			"required": ["to"],
+			"additionalProperties": false
+		}
+	},
+	"required": ["type", "data"],
+	"additionalProperties": false
+}`,
+	"join": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "join",
+	"description": "Joins chat on multiplexed connection",
+	"type": "object",
+	"properties": {
+		"type": {"const": "join"},
+		"channel": {"type": "string", "minLength": 1, "maxLength": 25},
+		"data": {
+			"type": "object",
+			"properties": {
+				"last_seq": {"type": "integer", "minimum": 0}
+			},
+			"additionalProperties": false
+		}
+	},
+	"required": ["type", "channel"],
+	"additionalProperties": false
+}`,
+	"leave": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "leave",
+	"description": "Leaves chat on multiplexed connection",
+	"type": "object",
+	"properties": {
+		"type": {"const": "leave"},
+		"channel": {"type": "string", "minLength": 1}
+	},
+	"required": ["type", "channel"],
+	"additionalProperties": false
+}`,
+}
+
+const attachmentDef = `{
+	"type": "object",
+	"properties": {
+		"id": {"type": "string", "minLength": 1, "maxLength": 128},
+		"name": {"type": "string", "minLength": 1, "maxLength": 255},
+		"mime": {"type": "string", "maxLength": 128},
+		"size": {"type": "integer", "minimum": 0}
+	},
+	"required": ["id", "name"]
+}`
+
+const msgDef = `{
+	"type": "object",
+	"properties": {
+		"meta": {"type": ["object", "null"], "additionalProperties": {"type": "string"}},
+		"time": {"type": "string", "format": "date-time"},
+		"seq": {"type": "integer", "minimum": 0},
+		"text": {"type": "string"},
+		"from": {"type": "string"},
+		"kind": {"enum": ["text", "markdown", "code", "attachment", "system"]},
+		"lang": {"type": "string"},
+		"attachment": ` + attachmentDef + `
+	},
+	"required": ["time", "seq", "text", "from"]
+}`
+
+// Server message schemas by message type
+var serverSchemas = map[string]string{
+	"chat": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "chat",
+	"description": "Chat message",
+	"type": "object",
+	"properties": {
+		"type": {"const": "chat"},
+		"channel": {"type": "string"},
+		"data": ` + msgDef + `
+	},
+	"required": ["type", "data"]
+}`,
+	"history": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "history",
+	"description": "Batch of chat messages ordered by seq",
+	"type": "object",
+	"properties": {
+		"type": {"const": "history"},
+		"channel": {"type": "string"},
+		"data": {"type": "array", "items": ` + msgDef + `}
+	},
+	"required": ["type"]
+}`,
+	"error": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "error",
+	"description": "Error caused by the last client action, or a fatal error followed by disconnect",
+	"type": "object",
+	"properties": {
+		"type": {"const": "error"},
+		"channel": {"type": "string"},
+		"error": {"type": "string"}
+	},
+	"required": ["type", "error"]
+}`,
+	"info": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "info",
+	"description": "Informational message",
+	"type": "object",
+	"properties": {
+		"type": {"const": "info"},
+		"channel": {"type": "string"},
+		"data": {}
+	},
+	"required": ["type"]
+}`,
+	"event": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "event",
+	"description": "Chat control event, eg. moderation action",
+	"type": "object",
+	"properties": {
+		"type": {"const": "event"},
+		"channel": {"type": "string"},
+		"data": {
+			"type": "object",
+			"properties": {
+				"type": {"enum": ["kick", "ban", "mute", "role", "secret", "nick", "leave", "join"]},
+				"nick": {"type": "string"},
+				"by": {"type": "string"},
+				"reason": {"type": "string"},
+				"role": {"type": "string"},
+				"new_nick": {"type": "string"},
+				"until": {"type": "string", "format": "date-time"},
+				"time": {"type": "string", "format": "date-time"}
+			},
+			"required": ["type", "nick", "time"]
+		}
+	},
+	"required": ["type", "data"]
+}`,
+	"join": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "join",
+	"description": "Confirms that multiplexed connection joined the chat",
+	"type": "object",
+	"properties": {
+		"type": {"const": "join"},
+		"channel": {"type": "string"}
+	},
+	"required": ["type", "channel"]
+}`,
+	"leave": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "leave",
+	"description": "Multiplexed connection left or was removed from the chat",
+	"type": "object",
+	"properties": {
+		"type": {"const": "leave"},
+		"channel": {"type": "string"}
+	},
+	"required": ["type", "channel"]
+}`,
+	"gap": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "gap",
+	"description": "Chat messages from seq to seq were dropped for slow client and can be fetched with history request",
+	"type": "object",
+	"properties": {
+		"type": {"const": "gap"},
+		"channel": {"type": "string"},
+		"data": {
+			"type": "object",
+			"properties": {
+				"from": {"type": "integer", "minimum": 0},
+				"to": {"type": "integer", "minimum": 0}
+			},
+			"required": ["from", "to"]
+		}
+	},
+	"required": ["type", "channel", "data"]
+}`,
+	"ack": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "ack",
+	"description": "Acknowledges client chat message with id, either with assigned seq or an error. Duplicate messages are not sent again, and carry seq of the original message if known",
+	"type": "object",
+	"properties": {
+		"type": {"const": "ack"},
+		"channel": {"type": "string"},
+		"id": {"type": "string"},
+		"data": {
+			"type": "object",
+			"properties": {
+				"seq": {"type": "integer", "minimum": 1},
+				"duplicate": {"type": "boolean"}
+			}
+		},
+		"error": {"type": "string"}
+	},
+	"required": ["type", "id"]
+}`,
+	"resume": `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "resume",
+	"description": "Server is closing the connection. Client should reconnect using last_seq of every chat",
+	"type": "object",
+	"properties": {
+		"type": {"const": "resume"},
+		"data": {
+			"type": "object",
+			"properties": {
+				"reason": {"type": "string"},
+				"last_seq": {"type": "object", "additionalProperties": {"type": "integer", "minimum": 0}}
+			},
+			"required": ["reason", "last_seq"]
+		}
+	},
+	"required": ["type", "data"]
+}`,
+}
@@ -0,0 +1,194 @@
+package agent_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tonto/gossip/pkg/agent"
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+func TestProtocol(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake map[string]interface{}
+		send      interface{}
+		event     *broker.Event
+		wantType  interface{}
+		wantErr   string
+	}{
+		{
+			name:      "v0 client",
+			handshake: initReq,
+			send:      map[string]interface{}{"type": 0, "data": map[string]interface{}{"text": ""}},
+			wantType:  float64(2),
+			wantErr:   "sent empty message",
+		},
+		{
+			name:      "v1 invalid message",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": "chat", "data": map[string]interface{}{"text": ""}},
+			wantType:  "error",
+			wantErr:   "invalid message",
+		},
+		{
+			name:      "v1 attachment without reference",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": "chat", "data": map[string]interface{}{"kind": "attachment", "text": "hi"}},
+			wantType:  "error",
+			wantErr:   "invalid message",
+		},
+		{
+			name:      "v1 system message",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": "chat", "data": map[string]interface{}{"kind": "system", "text": "hi"}},
+			wantType:  "error",
+			wantErr:   "invalid message",
+		},
+		{
+			name:      "v1 markdown too long",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": "chat", "data": map[string]interface{}{"kind": "markdown", "text": strings.Repeat("x", 2048)}},
+			wantType:  "error",
+			wantErr:   "exceeded max message length",
+		},
+		{
+			name:      "v1 unknown message type",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": "info"},
+			wantType:  "error",
+			wantErr:   "invalid message type",
+		},
+		{
+			name:      "v1 legacy message type",
+			handshake: v1InitReq(nil),
+			send:      map[string]interface{}{"type": 0, "data": map[string]interface{}{"text": "hi"}},
+			wantType:  "error",
+			wantErr:   "invalid message format",
+		},
+		{
+			name:      "v1 event",
+			handshake: v1InitReq(nil),
+			event:     &broker.Event{Type: broker.EventMute, Nick: "jane", By: "joe", Time: time.Now()},
+			wantType:  "event",
+		},
+		{
+			name:      "v1 invalid handshake",
+			handshake: v1InitReq(map[string]interface{}{"last_seq": -1}),
+			wantType:  "error",
+			wantErr:   "invalid message",
+		},
+		{
+			name:      "unsupported version",
+			handshake: v1InitReq(map[string]interface{}{"version": 2}),
+			wantType:  "error",
+			wantErr:   "unsupported protocol version",
+		},
+	}
+
+	p := agent.Describe()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q queue
+			var ig ingest
+
+			srv := newServer(t, agent.NewAPI(broker.New(&q, &store{}, &ig), &store{}))
+			defer srv.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("could not connect: %v", err)
+			}
+			defer conn.Close()
+
+			conn.WriteJSON(tc.handshake)
+
+			if tc.send != nil {
+				conn.WriteJSON(tc.send)
+			}
+
+			if tc.event != nil {
+				waitFor(t, func() bool {
+					subs, _ := q.count()
+					return subs == 2
+				})
+				q.publish(t, "events.general", tc.event)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("could not read message: %v", err)
+			}
+
+			var m struct {
+				Type  interface{} `json:"type"`
+				Error string      `json:"error"`
+			}
+
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatalf("could not decode message: %v", err)
+			}
+
+			if m.Type != tc.wantType {
+				t.Errorf("unexpected message type. want: %v, got: %v", tc.wantType, m.Type)
+			}
+
+			if !strings.Contains(m.Error, tc.wantErr) {
+				t.Errorf("unexpected error. want: %q, got: %q", tc.wantErr, m.Error)
+			}
+
+			name, ok := m.Type.(string)
+			if !ok {
+				return
+			}
+
+			res, err := gojsonschema.Validate(
+				gojsonschema.NewBytesLoader(p.Server[name]),
+				gojsonschema.NewBytesLoader(data),
+			)
+			if err != nil {
+				t.Fatalf("could not validate message: %v", err)
+			}
+
+			if !res.Valid() {
+				t.Errorf("message does not match %s schema: %v", name, res.Errors())
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	p := agent.Describe()
+
+	schemas := []json.RawMessage{p.Handshake}
+	for _, s := range p.Client {
+		schemas = append(schemas, s)
+	}
+	for _, s := range p.Server {
+		schemas = append(schemas, s)
+	}
+
+	for _, s := range schemas {
+		if _, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(s)); err != nil {
+			t.Errorf("invalid schema: %v", err)
+		}
+	}
+}
+
+func v1InitReq(override map[string]interface{}) map[string]interface{} {
+	req := map[string]interface{}{"version": agent.ProtocolV1}
+	for k, v := range initReq {
+		req[k] = v
+	}
+	for k, v := range override {
+		req[k] = v
+	}
+	return req
+}
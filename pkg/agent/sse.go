@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tonto/gossip/pkg/broker"
+	h "github.com/tonto/kit/http"
+	"github.com/tonto/kit/http/respond"
+)
+
+// Ticket represents short lived single use event stream credentials,
+// for EventSource clients which can not send Authorization header
+type Ticket struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+}
+
+const ticketTTL = 30 * time.Second
+
+// events streams chat messages and events using server-sent events, for
+// clients unable to use websockets. Connection is bound to a single chat and
+// is resumed from last_seq query param, or Last-Event-ID header sent by
+// reconnecting EventSource clients. Messages are sent using send endpoint.
+// Clients authenticate with ticket query param, or with nick and secret sent
+// in basic Authorization header.
+func (api *API) events(c context.Context, w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		respond.WithJSON(w, r, h.NewError(http.StatusInternalServerError, fmt.Errorf("sse api: streaming unsupported")))
+		return
+	}
+
+	q := r.URL.Query()
+
+	req := initConReq{
+		Version: LatestProtocol,
+		Channel: q.Get("channel"),
+	}
+
+	if ticket := q.Get("ticket"); ticket != "" {
+		t, err := api.store.TakeTicket(ticket)
+		if err != nil {
+			respond.WithJSON(w, r, h.NewError(http.StatusInternalServerError, fmt.Errorf("sse api: could not fetch ticket")))
+			return
+		}
+		if t == nil {
+			respond.WithJSON(w, r, h.NewError(http.StatusForbidden, fmt.Errorf("sse api: invalid or expired ticket")))
+			return
+		}
+		req.Channel, req.Nick, req.Secret = t.Channel, t.Nick, t.Secret
+	} else {
+		req.Nick, req.Secret = credentials(r)
+	}
+
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, fmt.Errorf("sse api: invalid Last-Event-ID")))
+			return
+		}
+		seq++
+		req.LastSeq = &seq
+	} else if s := q.Get("last_seq"); s != "" {
+		seq, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, fmt.Errorf("sse api: invalid last_seq")))
+			return
+		}
+		req.LastSeq = &seq
+	}
+
+	if err := req.Validate(); err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, err))
+		return
+	}
+
+	agent := New(api.broker, api.store, api.opts...)
+
+	if !api.track(agent) {
+		respond.WithJSON(w, r, h.NewError(http.StatusServiceUnavailable, fmt.Errorf("sse api: server is shutting down")))
+		return
+	}
+
+	defer api.untrack(agent)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	agent.handle(c, newSSEConn(w, f, r), &req)
+}
+
+// credentials returns nick and secret sent in basic Authorization
+// header, or in nick and secret query params kept for older clients
+func credentials(r *http.Request) (string, string) {
+	if nick, secret, ok := r.BasicAuth(); ok {
+		return nick, secret
+	}
+	q := r.URL.Query()
+	return q.Get("nick"), q.Get("secret")
+}
+
+type ticketReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+}
+
+func (r *ticketReq) Validate() error {
+	if r.Channel == "" || r.Nick == "" || r.Secret == "" {
+		return fmt.Errorf("channel, nick and secret are required")
+	}
+	return nil
+}
+
+type ticketResp struct {
+	Ticket  string    `json:"ticket"`
+	Expires time.Time `json:"expires"`
+}
+
+// ticket issues single use ticket, used to open event stream
+// by EventSource clients without sending credentials in the url
+func (api *API) ticket(c context.Context, w http.ResponseWriter, req *ticketReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil || ch == nil {
+		return nil, fmt.Errorf("could not fetch chat")
+	}
+
+	acc, err := api.store.GetAccount(req.Nick)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch account")
+	}
+
+	if _, err := ch.Authenticate(acc, req.Nick, req.Secret); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("could not create ticket")
+	}
+
+	ticket := hex.EncodeToString(b)
+
+	err = api.store.SaveTicket(ticket, &Ticket{Channel: req.Channel, Nick: req.Nick, Secret: req.Secret}, ticketTTL)
+	if err != nil {
+		return nil, fmt.Errorf("could not create ticket")
+	}
+
+	return h.NewResponse(ticketResp{Ticket: ticket, Expires: time.Now().Add(ticketTTL)}, http.StatusOK), nil
+}
+
+type sendReq struct {
+	Channel string            `json:"channel"`
+	Nick    string            `json:"nick"`
+	Secret  string            `json:"secret"`
+	Text    string            `json:"text"`
+	Meta    map[string]string `json:"meta"`
+	ID      string            `json:"id"` // Optional client message id
+
+	Kind       broker.Kind        `json:"kind"`
+	Lang       string             `json:"lang"`
+	Attachment *broker.Attachment `json:"attachment"`
+}
+
+func (r *sendReq) Validate() error {
+	if r.Channel == "" || r.Nick == "" || r.Secret == "" {
+		return fmt.Errorf("channel, nick and secret are required")
+	}
+	if len(r.ID) > 64 {
+		return fmt.Errorf("exceeded max message id length of 64")
+	}
+	return nil
+}
+
+// send sends chat message on behalf of clients which receive
+// messages using server-sent events
+func (api *API) send(c context.Context, w http.ResponseWriter, req *sendReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil || ch == nil {
+		return nil, fmt.Errorf("could not fetch chat")
+	}
+
+	acc, err := api.store.GetAccount(req.Nick)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch account")
+	}
+
+	user, err := ch.Authenticate(acc, req.Nick, req.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := broker.Msg{
+		Text:       req.Text,
+		Meta:       req.Meta,
+		Kind:       req.Kind,
+		Lang:       req.Lang,
+		Attachment: req.Attachment,
+	}
+
+	if err := prepareMsg(c, api.cfg.attachments, req.Channel, user, &msg); err != nil {
+		return nil, err
+	}
+
+	msg.ID = req.ID
+
+	err = api.broker.Send(req.Channel, &msg)
+	if dup, ok := err.(*broker.DuplicateError); ok {
+		return h.NewResponse(ack{Seq: dup.Seq, Duplicate: true}, http.StatusOK), nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not forward your message. try again")
+	}
+
+	// Seq is not known until the message is delivered. Message is
+	// delivered back through the event stream, carrying its seq
+	return h.NewResponse(ack{}, http.StatusOK), nil
+}
@@ -0,0 +1,359 @@
+package agent_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonto/gossip/pkg/agent"
+	"github.com/tonto/gossip/pkg/broker"
+)
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.event != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	cases := []struct {
+		name      string
+		query     string
+		lastID    string
+		basic     string // Basic auth secret of joe
+		wantCode  int
+		wantStart uint64
+		want      []sseEvent
+	}{
+		{
+			name:     "missing credentials",
+			query:    "?channel=general",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid Last-Event-ID",
+			query:    "?channel=general&nick=joe&secret=secret",
+			lastID:   "abc",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid secret",
+			query:    "?channel=general&nick=joe&secret=invalid",
+			wantCode: http.StatusOK,
+			want:     []sseEvent{{event: "error"}},
+		},
+		{
+			name:      "resume from last_seq",
+			query:     "?channel=general&nick=joe&secret=secret&last_seq=3",
+			wantCode:  http.StatusOK,
+			wantStart: 3,
+			want:      []sseEvent{{id: "8", event: "chat"}},
+		},
+		{
+			name:      "resume from Last-Event-ID",
+			query:     "?channel=general&nick=joe&secret=secret&last_seq=3",
+			lastID:    "7",
+			wantCode:  http.StatusOK,
+			wantStart: 8,
+			want:      []sseEvent{{id: "8", event: "chat"}},
+		},
+		{
+			name:      "basic auth",
+			query:     "?channel=general&last_seq=3",
+			basic:     "secret",
+			wantCode:  http.StatusOK,
+			wantStart: 3,
+			want:      []sseEvent{{id: "8", event: "chat"}},
+		},
+		{
+			name:     "basic auth invalid secret",
+			query:    "?channel=general",
+			basic:    "invalid",
+			wantCode: http.StatusOK,
+			want:     []sseEvent{{event: "error"}},
+		},
+		{
+			name:     "invalid ticket",
+			query:    "?channel=general&ticket=invalid",
+			wantCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q queue
+			var ig ingest
+
+			srv := newEndpointServer(t, agent.NewAPI(broker.New(&q, &store{}, &ig), &store{}), "/events")
+			defer srv.Close()
+
+			req, _ := http.NewRequest("GET", srv.URL+tc.query, nil)
+			if tc.lastID != "" {
+				req.Header.Set("Last-Event-ID", tc.lastID)
+			}
+			if tc.basic != "" {
+				req.SetBasicAuth("joe", tc.basic)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not connect: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("unexpected response code. want: %d, got: %d", tc.wantCode, resp.StatusCode)
+			}
+
+			if tc.wantStart > 0 {
+				waitFor(t, func() bool {
+					subs, _ := q.count()
+					return subs == 2
+				})
+
+				q.Lock()
+				start := q.starts[0]
+				q.Unlock()
+
+				if start != tc.wantStart {
+					t.Errorf("unexpected subscription start. want: %d, got: %d", tc.wantStart, start)
+				}
+
+				data, _ := broker.EncodeMsg(&broker.Msg{From: "jane", Text: "hi", Time: time.Now()})
+				q.publishData("chat.general", 8, data)
+			}
+
+			r := bufio.NewReader(resp.Body)
+
+			for _, want := range tc.want {
+				e := readEvent(t, r)
+				if e.id != want.id || e.event != want.event {
+					t.Errorf("unexpected event. want: %s/%s, got: %s/%s", want.id, want.event, e.id, e.event)
+				}
+			}
+		})
+	}
+}
+
+func TestTicket(t *testing.T) {
+	var q queue
+
+	st := store{}
+	api := agent.NewAPI(broker.New(&q, &st, &ingest{}), &st)
+
+	tickets := newEndpointServer(t, api, "/ticket")
+	defer tickets.Close()
+
+	events := newEndpointServer(t, api, "/events")
+	defer events.Close()
+
+	issue := func(secret string) (string, int) {
+		body, _ := json.Marshal(map[string]string{"channel": "general", "nick": "joe", "secret": secret})
+
+		rw := httptest.NewRecorder()
+		tickets.Config.Handler.ServeHTTP(rw, httptest.NewRequest("POST", "/ticket", bytes.NewReader(body)))
+
+		var resp struct {
+			Data struct {
+				Ticket  string    `json:"ticket"`
+				Expires time.Time `json:"expires"`
+			} `json:"data"`
+		}
+		json.NewDecoder(rw.Body).Decode(&resp)
+
+		return resp.Data.Ticket, rw.Code
+	}
+
+	if _, code := issue("invalid"); code == http.StatusOK {
+		t.Errorf("ticket issued for invalid secret")
+	}
+
+	ticket, code := issue("secret")
+	if code != http.StatusOK || ticket == "" {
+		t.Fatalf("could not issue ticket. code: %d", code)
+	}
+
+	connect := func() *http.Response {
+		resp, err := http.Get(events.URL + "?ticket=" + ticket)
+		if err != nil {
+			t.Fatalf("could not connect: %v", err)
+		}
+		return resp
+	}
+
+	resp := connect()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response code. want: %d, got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	waitFor(t, func() bool {
+		subs, _ := q.count()
+		return subs == 2
+	})
+
+	reuse := connect()
+	defer reuse.Body.Close()
+
+	if reuse.StatusCode != http.StatusForbidden {
+		t.Errorf("ticket should be single use. got: %d", reuse.StatusCode)
+	}
+}
+
+func TestSend(t *testing.T) {
+	cases := []struct {
+		name     string
+		req      map[string]interface{}
+		wantCode int
+		wantSent bool
+		wantKind broker.Kind
+	}{
+		{
+			name:     "missing credentials",
+			req:      map[string]interface{}{"channel": "general", "text": "hi"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid secret",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "invalid", "text": "hi"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "empty message",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "secret"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "send",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "secret", "text": "hi"},
+			wantCode: http.StatusOK,
+			wantSent: true,
+		},
+		{
+			name:     "send markdown",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "secret", "text": "hi", "kind": "markdown"},
+			wantCode: http.StatusOK,
+			wantSent: true,
+			wantKind: broker.KindMarkdown,
+		},
+		{
+			name:     "send code",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "secret", "text": "hi", "kind": "code", "lang": "go"},
+			wantCode: http.StatusOK,
+			wantSent: true,
+			wantKind: broker.KindCode,
+		},
+		{
+			name: "send attachment",
+			req: map[string]interface{}{
+				"channel": "general", "nick": "joe", "secret": "secret", "text": "hi", "kind": "attachment",
+				"attachment": map[string]interface{}{"id": "a1", "name": "cat.exe", "mime": "application/x-msdownload", "size": 1},
+			},
+			wantCode: http.StatusOK,
+			wantSent: true,
+			wantKind: broker.KindAttachment,
+		},
+		{
+			name: "attachment not found",
+			req: map[string]interface{}{
+				"channel": "general", "nick": "joe", "secret": "secret", "text": "hi", "kind": "attachment",
+				"attachment": map[string]interface{}{"id": "a2", "name": "cat.png"},
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "attachment without reference",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "secret", "kind": "attachment"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name: "attachment in text message",
+			req: map[string]interface{}{
+				"channel": "general", "nick": "joe", "secret": "secret", "text": "hi",
+				"attachment": map[string]interface{}{"id": "a1", "name": "cat.png"},
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "system message",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "secret", "text": "hi", "kind": "system"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "unsupported kind",
+			req:      map[string]interface{}{"channel": "general", "nick": "joe", "secret": "secret", "text": "hi", "kind": "video"},
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q queue
+
+			atts := attachments{"general/a1": {ID: "a1", Name: "cat.png", MIME: "image/png", Size: 10}}
+
+			srv := newEndpointServer(t, agent.NewAPI(broker.New(&q, &store{}, &ingest{}), &store{}, agent.WithAttachments(atts)), "/send")
+			defer srv.Close()
+
+			body, _ := json.Marshal(tc.req)
+
+			rw := httptest.NewRecorder()
+			srv.Config.Handler.ServeHTTP(rw, httptest.NewRequest("POST", "/send", bytes.NewReader(body)))
+
+			if rw.Code != tc.wantCode {
+				t.Errorf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+			}
+
+			if !tc.wantSent {
+				if len(q.sent) != 0 {
+					t.Errorf("unexpected message sent")
+				}
+				return
+			}
+
+			if len(q.sent) != 1 {
+				t.Fatalf("expected message to be sent")
+			}
+
+			msg, err := broker.DecodeMsg(q.sent[0])
+			if err != nil {
+				t.Fatalf("could not decode sent message: %v", err)
+			}
+
+			if msg.From != "joe" || msg.Text != "hi" || msg.Kind != tc.wantKind {
+				t.Errorf("unexpected message sent: %+v", msg)
+			}
+
+			if tc.wantKind == broker.KindAttachment && (msg.Attachment == nil || *msg.Attachment != *atts["general/a1"]) {
+				t.Errorf("stored attachment not sent: %+v", msg.Attachment)
+			}
+		})
+	}
+}
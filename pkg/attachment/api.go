@@ -0,0 +1,292 @@
+// Package attachment provides chat file attachments api
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/tonto/gossip/pkg/chat"
+	h "github.com/tonto/kit/http"
+	"github.com/tonto/kit/http/respond"
+)
+
+// NewAPI creates new attachment api
+func NewAPI(store ChatStore, blobs Blobs, opts ...Option) *API {
+	cfg := config{
+		maxSize: defMaxSize,
+		mimes:   defMIMETypes,
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	api := API{
+		store: store,
+		blobs: blobs,
+		cfg:   cfg,
+	}
+
+	api.RegisterHandler("POST", "/upload", api.upload)
+	api.RegisterHandler("GET", "/download", api.download)
+
+	return &api
+}
+
+// API represents attachment api service
+type API struct {
+	h.BaseService
+	store ChatStore
+	blobs Blobs
+	cfg   config
+}
+
+// ChatStore represents chat store interface
+type ChatStore interface {
+	Get(string) (*chat.Chat, error)
+	GetAccount(string) (*chat.Account, error)
+}
+
+// Blobs represents attachment blob storage interface
+type Blobs interface {
+	Put(context.Context, string, io.Reader, Info) error
+	Get(context.Context, string) (io.ReadCloser, *Info, error)
+	Stat(context.Context, string) (*Info, error)
+}
+
+// Info represents stored attachment info
+type Info struct {
+	Name string `json:"name"`
+	MIME string `json:"mime"`
+	Size int64  `json:"size"`
+}
+
+// ErrNotFound is returned by Blobs if attachment does not exist
+var ErrNotFound = errors.New("attachment: not found")
+
+const defMaxSize = 10 << 20
+
+var defMIMETypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"application/pdf",
+	"application/zip",
+	"text/plain",
+}
+
+type config struct {
+	maxSize int64
+	mimes   []string
+}
+
+// Option represents attachment api option
+type Option func(*config)
+
+// WithMaxSize sets max attachment size in bytes
+func WithMaxSize(n int64) Option {
+	return func(c *config) { c.maxSize = n }
+}
+
+// WithMIMETypes sets allowed attachment media types
+func WithMIMETypes(types ...string) Option {
+	return func(c *config) { c.mimes = types }
+}
+
+// Prefix returns api prefix for this service
+func (api *API) Prefix() string { return "attachment" }
+
+const maxNameLen = 255
+
+var idRe = regexp.MustCompile("^[a-zA-Z0-9]+$")
+
+// upload stores multipart form file to the chat, on behalf of a member allowed
+// to send messages. Media type is detected from file contents. Returned
+// attachment reference is sent to the chat as attachment message.
+func (api *API) upload(c context.Context, w http.ResponseWriter, r *http.Request) {
+	channel := r.URL.Query().Get("channel")
+
+	user, err := api.authenticate(channel, r)
+	if err != nil {
+		respond.WithJSON(w, r, err)
+		return
+	}
+
+	if !user.CanSend() || user.IsMuted(time.Now()) {
+		respond.WithJSON(w, r, h.NewError(http.StatusForbidden, fmt.Errorf("you don't have permission to send messages to this chat")))
+		return
+	}
+
+	// Allow for multipart overhead, file size is checked separately
+	r.Body = http.MaxBytesReader(w, r.Body, api.cfg.maxSize+1<<20)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, fmt.Errorf("file is required")))
+		return
+	}
+
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, api.cfg.maxSize+1))
+	if err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, fmt.Errorf("could not read file")))
+		return
+	}
+
+	if int64(len(data)) > api.cfg.maxSize {
+		respond.WithJSON(w, r, h.NewError(http.StatusRequestEntityTooLarge, fmt.Errorf("exceeded max attachment size of %d bytes", api.cfg.maxSize)))
+		return
+	}
+
+	mt, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !api.allowed(mt) {
+		respond.WithJSON(w, r, h.NewError(http.StatusUnsupportedMediaType, fmt.Errorf("unsupported attachment type %s", mt)))
+		return
+	}
+
+	name := path.Base(header.Filename)
+	if name == "." || name == "/" {
+		name = "attachment"
+	}
+	if len(name) > maxNameLen {
+		name = name[len(name)-maxNameLen:]
+	}
+
+	att := broker.Attachment{
+		ID:   ksuid.New().String(),
+		Name: name,
+		MIME: mt,
+		Size: int64(len(data)),
+	}
+
+	err = api.blobs.Put(c, key(channel, att.ID), bytes.NewReader(data), Info{
+		Name: att.Name,
+		MIME: att.MIME,
+		Size: att.Size,
+	})
+	if err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusInternalServerError, fmt.Errorf("could not store attachment")))
+		return
+	}
+
+	respond.WithJSON(w, r, h.NewResponse(att, http.StatusOK))
+}
+
+// download serves chat attachment to chat members
+func (api *API) download(c context.Context, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	channel, id := q.Get("channel"), q.Get("id")
+
+	if !idRe.MatchString(id) {
+		respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, fmt.Errorf("invalid attachment id")))
+		return
+	}
+
+	if _, err := api.authenticate(channel, r); err != nil {
+		respond.WithJSON(w, r, err)
+		return
+	}
+
+	rc, info, err := api.blobs.Get(c, key(channel, id))
+	if err == ErrNotFound {
+		respond.WithJSON(w, r, h.NewError(http.StatusNotFound, fmt.Errorf("attachment not found")))
+		return
+	}
+
+	if err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusInternalServerError, fmt.Errorf("could not fetch attachment")))
+		return
+	}
+
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", info.MIME)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	io.Copy(w, rc)
+}
+
+// Stat returns reference of stored chat attachment id,
+// or nil if the attachment does not exist
+func (api *API) Stat(c context.Context, channel, id string) (*broker.Attachment, error) {
+	if !idRe.MatchString(id) {
+		return nil, nil
+	}
+
+	info, err := api.blobs.Stat(c, key(channel, id))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &broker.Attachment{
+		ID:   id,
+		Name: info.Name,
+		MIME: info.MIME,
+		Size: info.Size,
+	}, nil
+}
+
+// authenticate authenticates chat member using nick and secret sent in basic
+// Authorization header, or in nick and secret query params kept for older clients
+func (api *API) authenticate(channel string, r *http.Request) (*chat.User, error) {
+	nick, secret, ok := r.BasicAuth()
+	if !ok {
+		q := r.URL.Query()
+		nick, secret = q.Get("nick"), q.Get("secret")
+	}
+
+	if channel == "" || nick == "" || secret == "" {
+		return nil, h.NewError(http.StatusBadRequest, fmt.Errorf("channel, nick and secret are required"))
+	}
+
+	ch, err := api.store.Get(channel)
+	if err != nil || ch == nil {
+		return nil, h.NewError(http.StatusNotFound, fmt.Errorf("could not fetch chat"))
+	}
+
+	acc, err := api.store.GetAccount(nick)
+	if err != nil {
+		return nil, h.NewError(http.StatusInternalServerError, fmt.Errorf("could not fetch account"))
+	}
+
+	user, err := ch.Authenticate(acc, nick, secret)
+	if err != nil {
+		return nil, h.NewError(http.StatusForbidden, err)
+	}
+
+	return user, nil
+}
+
+func (api *API) allowed(mt string) bool {
+	for _, m := range api.cfg.mimes {
+		if m == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns blob key of chat attachment id
+func key(channel, id string) string {
+	return channel + "/" + id
+}
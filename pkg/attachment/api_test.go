@@ -0,0 +1,311 @@
+package attachment_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tonto/gossip/pkg/attachment"
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/tonto/gossip/pkg/chat"
+)
+
+var png = append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), make([]byte, 32)...)
+
+func TestUpload(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    string
+		basic    string // Basic auth nick:secret
+		file     []byte
+		fileName string
+		wantCode int
+	}{
+		{
+			name:     "upload",
+			query:    "?channel=general&nick=joe&secret=secret",
+			file:     png,
+			fileName: "cat.png",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "upload with basic auth",
+			query:    "?channel=general",
+			basic:    "joe:secret",
+			file:     png,
+			fileName: "cat.png",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "missing credentials",
+			query:    "?channel=general",
+			file:     png,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid secret",
+			query:    "?channel=general&nick=joe&secret=invalid",
+			file:     png,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "muted user",
+			query:    "?channel=general&nick=muted&secret=secret",
+			file:     png,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "missing file",
+			query:    "?channel=general&nick=joe&secret=secret",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "too large",
+			query:    "?channel=general&nick=joe&secret=secret",
+			file:     append(png, make([]byte, 100)...),
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "unsupported type",
+			query:    "?channel=general&nick=joe&secret=secret",
+			file:     []byte("<html><body>hi</body></html>"),
+			wantCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := blobs{data: make(map[string][]byte)}
+
+			handler := handler(t, attachment.NewAPI(&store{}, &b, attachment.WithMaxSize(64)), "/upload")
+
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			if tc.file != nil {
+				name := tc.fileName
+				if name == "" {
+					name = "file"
+				}
+				fw, _ := mw.CreateFormFile("file", name)
+				fw.Write(tc.file)
+			}
+			mw.Close()
+
+			req := httptest.NewRequest("POST", "/upload"+tc.query, &body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			if tc.basic != "" {
+				cred := strings.SplitN(tc.basic, ":", 2)
+				req.SetBasicAuth(cred[0], cred[1])
+			}
+			rw := httptest.NewRecorder()
+
+			handler(context.Background(), rw, req)
+
+			if rw.Code != tc.wantCode {
+				t.Fatalf("unexpected response code. want: %d, got: %d (%s)", tc.wantCode, rw.Code, rw.Body)
+			}
+
+			if rw.Code != http.StatusOK {
+				if len(b.data) != 0 {
+					t.Errorf("unexpected attachment stored")
+				}
+				return
+			}
+
+			var resp struct {
+				Data broker.Attachment `json:"data"`
+			}
+
+			json.NewDecoder(rw.Body).Decode(&resp)
+
+			att := resp.Data
+
+			if att.ID == "" || att.Name != tc.fileName || att.MIME != "image/png" || att.Size != int64(len(tc.file)) {
+				t.Errorf("unexpected attachment: %+v", att)
+			}
+
+			if !bytes.Equal(b.data["general/"+att.ID], tc.file) {
+				t.Errorf("attachment not stored")
+			}
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    string
+		basic    string // Basic auth nick:secret
+		wantCode int
+	}{
+		{
+			name:     "download",
+			query:    "?channel=general&nick=joe&secret=secret&id=1",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "download with basic auth",
+			query:    "?channel=general&id=1",
+			basic:    "joe:secret",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "basic auth invalid secret",
+			query:    "?channel=general&id=1",
+			basic:    "joe:invalid",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "not a member",
+			query:    "?channel=general&nick=jane&secret=secret&id=1",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "not found",
+			query:    "?channel=general&nick=joe&secret=secret&id=2",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid id",
+			query:    "?channel=general&nick=joe&secret=secret&id=../1",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := blobs{data: map[string][]byte{"general/1": png}}
+
+			handler := handler(t, attachment.NewAPI(&store{}, &b), "/download")
+
+			req := httptest.NewRequest("GET", "/download"+tc.query, nil)
+			if tc.basic != "" {
+				cred := strings.SplitN(tc.basic, ":", 2)
+				req.SetBasicAuth(cred[0], cred[1])
+			}
+
+			rw := httptest.NewRecorder()
+
+			handler(context.Background(), rw, req)
+
+			if rw.Code != tc.wantCode {
+				t.Fatalf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+			}
+
+			if rw.Code != http.StatusOK {
+				return
+			}
+
+			if !bytes.Equal(rw.Body.Bytes(), png) {
+				t.Errorf("unexpected attachment")
+			}
+
+			if ct := rw.Header().Get("Content-Type"); ct != "image/png" {
+				t.Errorf("unexpected content type: %s", ct)
+			}
+
+			if cd := rw.Header().Get("Content-Disposition"); !strings.Contains(cd, "cat.png") {
+				t.Errorf("unexpected content disposition: %s", cd)
+			}
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	cases := []struct {
+		name string
+		id   string
+		want *broker.Attachment
+	}{
+		{
+			name: "stored",
+			id:   "1",
+			want: &broker.Attachment{ID: "1", Name: "cat.png", MIME: "image/png", Size: int64(len(png))},
+		},
+		{
+			name: "not found",
+			id:   "2",
+		},
+		{
+			name: "invalid id",
+			id:   "../1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := blobs{data: map[string][]byte{"general/1": png}}
+
+			got, err := attachment.NewAPI(&store{}, &b).Stat(context.Background(), "general", tc.id)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected attachment. want: %+v, got: %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func handler(t *testing.T, api *attachment.API, path string) func(context.Context, http.ResponseWriter, *http.Request) {
+	for p, ep := range api.Endpoints() {
+		if p == path {
+			return ep.Handler
+		}
+	}
+	t.Fatalf("endpoint %s not registered", path)
+	return nil
+}
+
+type store struct{}
+
+func (s *store) Get(id string) (*chat.Chat, error) {
+	ch := chat.NewChannel(id, false)
+	ch.Register(&chat.User{Nick: "joe"}, "secret")
+	ch.Register(&chat.User{Nick: "muted", MutedUntil: time.Now().Add(time.Hour)}, "secret")
+	return ch, nil
+}
+
+func (s *store) GetAccount(string) (*chat.Account, error) { return nil, nil }
+
+type blobs struct {
+	sync.Mutex
+	data map[string][]byte
+}
+
+func (b *blobs) Put(c context.Context, key string, r io.Reader, info attachment.Info) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.data[key] = data
+	b.Unlock()
+	return nil
+}
+
+func (b *blobs) Get(c context.Context, key string) (io.ReadCloser, *attachment.Info, error) {
+	b.Lock()
+	data, ok := b.data[key]
+	b.Unlock()
+	if !ok {
+		return nil, nil, attachment.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), &attachment.Info{Name: "cat.png", MIME: "image/png", Size: int64(len(data))}, nil
+}
+
+func (b *blobs) Stat(c context.Context, key string) (*attachment.Info, error) {
+	_, info, err := b.Get(c, key)
+	return info, err
+}
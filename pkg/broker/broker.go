@@ -4,10 +4,12 @@ package broker
 import (
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
-// New creates new chat broker instance
+// New creates new chat broker instance. Ingester may be nil
+// if chat history is ingested by separate ingest workers.
 func New(mq MQ, store ChatStore, ig Ingester) *Broker {
 	return &Broker{
 		mq:    mq,
@@ -38,12 +40,34 @@ type Ingester interface {
 // ChatStore represents chat store interface
 type ChatStore interface {
 	UpdateLastClientSeq(string, string, uint64)
+	ReserveMsgID(string, string, string, time.Duration) (uint64, bool, error)
+	ReleaseMsgID(string, string, string)
 }
 
-// Subscribe subscribes to provided chat id at start sequence
+// channelsSubj represents subject chat creations are announced to
+const channelsSubj = "channels"
+
+// DedupWindow represents period within which messages sent by the
+// same nick with the same client message id are considered duplicates
+const DedupWindow = 10 * time.Minute
+
+// DuplicateError is returned by Send if message with the same
+// client message id was already sent within DedupWindow
+type DuplicateError struct {
+	// Seq of the original message, or 0 if it was not stored yet
+	Seq uint64
+}
+
+func (e *DuplicateError) Error() string { return "broker: duplicate message" }
+
+// Subscribe subscribes connection conn to provided chat id at start sequence.
+// Messages sent from the same connection are delivered only if they carry client
+// message id, so that other connections of the same user stay in sync.
 // Returns close subscription func, or an error.
-func (b *Broker) Subscribe(id string, nick string, start uint64, c chan *Msg) (func(), error) {
-	closer, err := b.mq.SubscribeSeq("chat."+id, nick, start, func(seq uint64, data []byte) {
+func (b *Broker) Subscribe(id string, conn string, start uint64, c chan *Msg) (func(), error) {
+	done := make(chan struct{})
+
+	closer, err := b.mq.SubscribeSeq("chat."+id, conn, start, func(seq uint64, data []byte) {
 		msg, err := DecodeMsg(data)
 		if err != nil {
 			msg = &Msg{
@@ -55,8 +79,11 @@ func (b *Broker) Subscribe(id string, nick string, start uint64, c chan *Msg) (f
 
 		msg.Seq = seq
 
-		if msg.From != nick {
-			c <- msg
+		if !msg.sentFrom(conn) {
+			select {
+			case c <- msg:
+			case <-done:
+			}
 		} else {
 			b.store.UpdateLastClientSeq(msg.From, id, seq)
 		}
@@ -66,19 +93,22 @@ func (b *Broker) Subscribe(id string, nick string, start uint64, c chan *Msg) (f
 		return nil, err
 	}
 
-	cleanup, err := b.ig.Run(id)
+	cleanup, err := b.runIngest(id)
 	if err != nil {
 		closer.Close()
 		return nil, fmt.Errorf("broker: unable to run ingest for chat. try again")
 	}
 
-	return func() { closer.Close(); cleanup() }, nil
+	return closeFunc(done, closer, cleanup), nil
 }
 
-// SubscribeNew subscribes to provided chat id subject starting from time.Now()
+// SubscribeNew subscribes connection conn to provided chat id subject starting
+// from time.Now(). Own messages are handled the same way as in Subscribe.
 // Returns close subscription func, or an error.
-func (b *Broker) SubscribeNew(id string, nick string, c chan *Msg) (func(), error) {
-	closer, err := b.mq.SubscribeTimestamp("chat."+id, nick, time.Now(), func(seq uint64, data []byte) {
+func (b *Broker) SubscribeNew(id string, conn string, c chan *Msg) (func(), error) {
+	done := make(chan struct{})
+
+	closer, err := b.mq.SubscribeTimestamp("chat."+id, conn, time.Now(), func(seq uint64, data []byte) {
 		msg, err := DecodeMsg(data)
 		if err != nil {
 			msg = &Msg{
@@ -90,8 +120,11 @@ func (b *Broker) SubscribeNew(id string, nick string, c chan *Msg) (func(), erro
 
 		msg.Seq = seq
 
-		if msg.From != nick {
-			c <- msg
+		if !msg.sentFrom(conn) {
+			select {
+			case c <- msg:
+			case <-done:
+			}
 		}
 	})
 
@@ -99,21 +132,123 @@ func (b *Broker) SubscribeNew(id string, nick string, c chan *Msg) (func(), erro
 		return nil, err
 	}
 
-	cleanup, err := b.ig.Run(id)
+	cleanup, err := b.runIngest(id)
 	if err != nil {
 		closer.Close()
 		return nil, fmt.Errorf("broker: unable to run ingest for chat. try again")
 	}
 
-	return func() { closer.Close(); cleanup() }, nil
+	return closeFunc(done, closer, cleanup), nil
 }
 
-// Send sends new message to a given chat
+// Send sends new message to a given chat. Messages with client message id
+// already sent within DedupWindow are rejected with DuplicateError.
 func (b *Broker) Send(id string, msg *Msg) error {
 	data, err := EncodeMsg(msg)
 	if err != nil {
 		return err
 	}
 
-	return b.mq.Send("chat."+id, data)
+	if msg.ID == "" {
+		return b.mq.Send("chat."+id, data)
+	}
+
+	seq, ok, err := b.store.ReserveMsgID(id, msg.From, msg.ID, DedupWindow)
+	if err != nil {
+		return fmt.Errorf("broker: unable to check message id: %v", err)
+	}
+
+	if !ok {
+		return &DuplicateError{Seq: seq}
+	}
+
+	if err := b.mq.Send("chat."+id, data); err != nil {
+		// Allow client to retry
+		b.store.ReleaseMsgID(id, msg.From, msg.ID)
+		return err
+	}
+
+	return nil
+}
+
+func (b *Broker) runIngest(id string) (func(), error) {
+	if b.ig == nil {
+		return func() {}, nil
+	}
+	return b.ig.Run(id)
+}
+
+// AnnounceChannel notifies channel subscribers that chat id was created
+func (b *Broker) AnnounceChannel(id string) error {
+	return b.mq.Send(channelsSubj, []byte(id))
+}
+
+// SubscribeChannels subscribes to created chat ids starting from time.Now()
+// Returns close subscription func, or an error.
+func (b *Broker) SubscribeChannels(c chan string) (func(), error) {
+	done := make(chan struct{})
+
+	closer, err := b.mq.SubscribeTimestamp(channelsSubj, "", time.Now(), func(seq uint64, data []byte) {
+		select {
+		case c <- string(data):
+		case <-done:
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return closeFunc(done, closer, nil), nil
+}
+
+// SendEvent broadcasts chat event to all chat event subscribers
+func (b *Broker) SendEvent(id string, e *Event) error {
+	data, err := EncodeEvent(e)
+	if err != nil {
+		return err
+	}
+
+	return b.mq.Send("events."+id, data)
+}
+
+// SubscribeEvents subscribes to provided chat id events starting from time.Now()
+// Returns close subscription func, or an error.
+func (b *Broker) SubscribeEvents(id string, c chan *Event) (func(), error) {
+	done := make(chan struct{})
+
+	closer, err := b.mq.SubscribeTimestamp("events."+id, "", time.Now(), func(seq uint64, data []byte) {
+		e, err := DecodeEvent(data)
+		if err != nil {
+			return
+		}
+
+		select {
+		case c <- e:
+		case <-done:
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return closeFunc(done, closer, nil), nil
+}
+
+// closeFunc returns subscription close func. Done is closed before the
+// subscription, so that mq handlers blocked on subscribers which stopped
+// reading return instead of leaking. Cleanup may be nil.
+func closeFunc(done chan struct{}, closer io.Closer, cleanup func()) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			closer.Close()
+			if cleanup != nil {
+				cleanup()
+			}
+		})
+	}
 }
@@ -53,19 +53,20 @@ func TestSubscribe(t *testing.T) {
 			wantErr: true,
 		},
 		{
-			name:  "dont send own messages",
+			name:  "dont send own connection messages",
 			chat:  "general",
 			nick:  "me",
 			start: 0,
-			n:     3,
+			n:     4,
 			queue: queue{
 				SubscribeSeqFunc: func(c string, n string, s uint64, f func(uint64, []byte)) (io.Closer, error) {
 					msgs := []broker.Msg{
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
+						{From: "me", Conn: "phone", Text: "foo msg"},
 					}
 
 					go func() {
@@ -86,9 +87,43 @@ func TestSubscribe(t *testing.T) {
 				{From: "john", Text: "foo msg", Seq: 0},
 				{From: "john", Text: "foo msg", Seq: 2},
 				{From: "john", Text: "foo msg", Seq: 3},
+				{From: "me", Conn: "phone", Text: "foo msg", Seq: 5},
 			},
 			wantErr: false,
 		},
+		{
+			name:  "send own messages with client id",
+			chat:  "general",
+			nick:  "me",
+			start: 0,
+			n:     2,
+			queue: queue{
+				SubscribeSeqFunc: func(c string, n string, s uint64, f func(uint64, []byte)) (io.Closer, error) {
+					msgs := []broker.Msg{
+						{From: "me", Conn: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg", ID: "1"},
+						{From: "john", Text: "foo msg"},
+					}
+
+					go func() {
+						for i, m := range msgs {
+							var buff bytes.Buffer
+							gob.NewEncoder(&buff).Encode(m)
+							f(uint64(i), buff.Bytes())
+						}
+					}()
+
+					return &cl{}, nil
+				},
+			},
+			ingest: ingest{
+				RunFunc: func(string) (func(), error) { return func() {}, nil },
+			},
+			want: []broker.Msg{
+				{From: "me", Conn: "me", Text: "foo msg", ID: "1", Seq: 1},
+				{From: "john", Text: "foo msg", Seq: 2},
+			},
+		},
 		{
 			name: "decoding error",
 			chat: "general",
@@ -98,10 +133,10 @@ func TestSubscribe(t *testing.T) {
 				SubscribeSeqFunc: func(c string, n string, s uint64, f func(uint64, []byte)) (io.Closer, error) {
 					msgs := []broker.Msg{
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
 					}
 
 					go func() {
@@ -219,7 +254,7 @@ func TestSubscribeNew(t *testing.T) {
 			wantErr: true,
 		},
 		{
-			name: "dont send own messages",
+			name: "dont send own connection messages",
 			chat: "general",
 			nick: "me",
 			n:    3,
@@ -227,10 +262,10 @@ func TestSubscribeNew(t *testing.T) {
 				SubscribeTimestampFunc: func(c string, n string, t time.Time, f func(uint64, []byte)) (io.Closer, error) {
 					msgs := []broker.Msg{
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
 					}
 
 					go func() {
@@ -263,10 +298,10 @@ func TestSubscribeNew(t *testing.T) {
 				SubscribeTimestampFunc: func(c string, n string, t time.Time, f func(uint64, []byte)) (io.Closer, error) {
 					msgs := []broker.Msg{
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
 						{From: "john", Text: "foo msg"},
-						{From: n, Text: "foo msg"},
+						{From: "me", Conn: n, Text: "foo msg"},
 					}
 
 					go func() {
@@ -346,10 +381,276 @@ func TestSubscribeNew(t *testing.T) {
 }
 
 func TestSend(t *testing.T) {
+	cases := []struct {
+		name         string
+		msg          broker.Msg
+		ids          map[string]uint64
+		storeErr     error
+		sendErr      error
+		wantSent     bool
+		wantErr      bool
+		wantDup      *broker.DuplicateError
+		wantReserved bool
+	}{
+		{
+			name:     "send without id",
+			msg:      broker.Msg{From: "joe", Text: "hi"},
+			wantSent: true,
+		},
+		{
+			name:         "send with id",
+			msg:          broker.Msg{From: "joe", Text: "hi", ID: "1"},
+			wantSent:     true,
+			wantReserved: true,
+		},
+		{
+			name:         "duplicate id",
+			msg:          broker.Msg{From: "joe", Text: "hi", ID: "1"},
+			ids:          map[string]uint64{"general/joe/1": 5},
+			wantErr:      true,
+			wantDup:      &broker.DuplicateError{Seq: 5},
+			wantReserved: true,
+		},
+		{
+			name:         "duplicate id not stored yet",
+			msg:          broker.Msg{From: "joe", Text: "hi", ID: "1"},
+			ids:          map[string]uint64{"general/joe/1": 0},
+			wantErr:      true,
+			wantDup:      &broker.DuplicateError{},
+			wantReserved: true,
+		},
+		{
+			name:     "store error",
+			msg:      broker.Msg{From: "joe", Text: "hi", ID: "1"},
+			storeErr: fmt.Errorf("error"),
+			wantErr:  true,
+		},
+		{
+			name:     "id released on send error",
+			msg:      broker.Msg{From: "joe", Text: "hi", ID: "1"},
+			sendErr:  fmt.Errorf("error"),
+			wantSent: true,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var sent bool
+
+			q := queue{
+				SendFunc: func(s string, data []byte) error {
+					sent = true
+					return tc.sendErr
+				},
+			}
+
+			st := store{ids: make(map[string]uint64), err: tc.storeErr}
+			for k, v := range tc.ids {
+				st.ids[k] = v
+			}
+
+			b := broker.New(&q, st, &ingest{})
+
+			err := b.Send("general", &tc.msg)
+			if tc.wantErr != (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if tc.wantDup != nil {
+				dup, ok := err.(*broker.DuplicateError)
+				if !ok || *dup != *tc.wantDup {
+					t.Errorf("unexpected duplicate error. want: %+v, got: %v", tc.wantDup, err)
+				}
+			}
+
+			if sent != tc.wantSent {
+				t.Errorf("unexpected send. want: %v, got: %v", tc.wantSent, sent)
+			}
+
+			if _, ok := st.ids["general/joe/1"]; ok != tc.wantReserved {
+				t.Errorf("unexpected id reservation. want: %v, got: %v", tc.wantReserved, ok)
+			}
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var subj string
+	var sub func(uint64, []byte)
+
+	q := queue{
+		SendFunc: func(s string, data []byte) error {
+			subj = s
+			sub(1, data)
+			return nil
+		},
+		SubscribeTimestampFunc: func(c string, n string, t time.Time, f func(uint64, []byte)) (io.Closer, error) {
+			sub = f
+			return &cl{}, nil
+		},
+	}
+
+	b := broker.New(&q, store{}, &ingest{})
+
+	c := make(chan *broker.Event, 1)
+
+	close, err := b.SubscribeEvents("general", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer close()
 
+	want := broker.Event{Type: broker.EventBan, Nick: "joe", By: "mod", Reason: "spam"}
+
+	if err := b.SendEvent("general", &want); err != nil {
+		t.Fatal(err)
+	}
+
+	if subj != "events.general" {
+		t.Errorf("unexpected subject. want: events.general, got: %s", subj)
+	}
+
+	got := <-c
+	if *got != want {
+		t.Errorf("unexpected event. want: %+v, got: %+v", want, *got)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	var subj string
+	var sub func(uint64, []byte)
+
+	q := queue{
+		SendFunc: func(s string, data []byte) error {
+			subj = s
+			sub(1, data)
+			return nil
+		},
+		SubscribeTimestampFunc: func(c string, n string, t time.Time, f func(uint64, []byte)) (io.Closer, error) {
+			sub = f
+			return &cl{}, nil
+		},
+	}
+
+	// Ingest is disabled on nodes served by separate ingest workers
+	b := broker.New(&q, store{}, nil)
+
+	c := make(chan string, 1)
+
+	close, err := b.SubscribeChannels(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer close()
+
+	if err := b.AnnounceChannel("general"); err != nil {
+		t.Fatal(err)
+	}
+
+	if subj != "channels" {
+		t.Errorf("unexpected subject. want: channels, got: %s", subj)
+	}
+
+	if got := <-c; got != "general" {
+		t.Errorf("unexpected channel. want: general, got: %s", got)
+	}
+
+	mc := make(chan *broker.Msg)
+
+	closeMsgs, err := b.SubscribeNew("general", "", mc)
+	if err != nil {
+		t.Fatalf("unexpected subscribe error without ingest: %v", err)
+	}
+
+	closeMsgs()
+}
+
+func TestUnsubscribeStalled(t *testing.T) {
+	msg, _ := broker.EncodeMsg(&broker.Msg{From: "john", Text: "foo msg"})
+	ev, _ := broker.EncodeEvent(&broker.Event{Type: broker.EventKick, Nick: "joe", By: "mod"})
+
+	cases := []struct {
+		name      string
+		data      []byte
+		subscribe func(*broker.Broker) (func(), error)
+	}{
+		{
+			name: "subscribe",
+			data: msg,
+			subscribe: func(b *broker.Broker) (func(), error) {
+				return b.Subscribe("general", "me", 0, make(chan *broker.Msg))
+			},
+		},
+		{
+			name: "subscribe new",
+			data: msg,
+			subscribe: func(b *broker.Broker) (func(), error) {
+				return b.SubscribeNew("general", "me", make(chan *broker.Msg))
+			},
+		},
+		{
+			name: "subscribe events",
+			data: ev,
+			subscribe: func(b *broker.Broker) (func(), error) {
+				return b.SubscribeEvents("general", make(chan *broker.Event))
+			},
+		},
+		{
+			name: "subscribe channels",
+			data: []byte("general"),
+			subscribe: func(b *broker.Broker) (func(), error) {
+				return b.SubscribeChannels(make(chan string))
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			handled := make(chan struct{})
+
+			deliver := func(f func(uint64, []byte)) {
+				go func() {
+					f(1, tc.data)
+					close(handled)
+				}()
+			}
+
+			q := queue{
+				SubscribeSeqFunc: func(c string, n string, s uint64, f func(uint64, []byte)) (io.Closer, error) {
+					deliver(f)
+					return &cl{}, nil
+				},
+				SubscribeTimestampFunc: func(c string, n string, t time.Time, f func(uint64, []byte)) (io.Closer, error) {
+					deliver(f)
+					return &cl{}, nil
+				},
+			}
+
+			b := broker.New(&q, store{}, &ingest{RunFunc: func(string) (func(), error) { return func() {}, nil }})
+
+			// Subscriber never reads from its channel
+			unsubscribe, err := tc.subscribe(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unsubscribe()
+			unsubscribe()
+
+			select {
+			case <-handled:
+			case <-time.After(time.Second):
+				t.Fatalf("mq handler blocked after unsubscribe")
+			}
+		})
+	}
 }
 
 type queue struct {
+	SendFunc               func(string, []byte) error
 	SubscribeSeqFunc       func(string, string, uint64, func(uint64, []byte)) (io.Closer, error)
 	SubscribeTimestampFunc func(string, string, time.Time, func(uint64, []byte)) (io.Closer, error)
 }
@@ -362,8 +663,8 @@ func (q *queue) SubscribeTimestamp(id string, nick string, t time.Time, f func(u
 	return q.SubscribeTimestampFunc(id, nick, t, f)
 }
 
-func (q *queue) Send(string, []byte) error {
-	panic("not implemented")
+func (q *queue) Send(id string, data []byte) error {
+	return q.SendFunc(id, data)
 }
 
 type cl struct{}
@@ -380,6 +681,25 @@ func (i *ingest) Run(s string) (func(), error) {
 	return i.RunFunc(s)
 }
 
-type store struct{}
+type store struct {
+	ids map[string]uint64
+	err error
+}
 
 func (s store) UpdateLastClientSeq(string, string, uint64) {}
+
+func (s store) ReserveMsgID(id, nick, msgid string, ttl time.Duration) (uint64, bool, error) {
+	if s.err != nil {
+		return 0, false, s.err
+	}
+	key := id + "/" + nick + "/" + msgid
+	if seq, ok := s.ids[key]; ok {
+		return seq, false, nil
+	}
+	s.ids[key] = 0
+	return 0, true, nil
+}
+
+func (s store) ReleaseMsgID(id, nick, msgid string) {
+	delete(s.ids, id+"/"+nick+"/"+msgid)
+}
@@ -0,0 +1,334 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentType represents encoding of enveloped message payload
+type ContentType byte
+
+// Supported message content types
+const (
+	ContentJSON  ContentType = 1
+	ContentProto ContentType = 2
+)
+
+// Encoded messages and events are prefixed with envelope header:
+//
+//	0x00 | envelope version | content type | payload
+//
+// Gob streams never start with a zero byte, which tells
+// legacy gob encoded messages apart from enveloped ones.
+const (
+	envelopeMark    byte = 0
+	envelopeVersion byte = 1
+	envelopeHeader       = 3
+)
+
+// DecodeMsg decodes enveloped Msg in b, or legacy gob encoded Msg
+func DecodeMsg(b []byte) (*Msg, error) {
+	if len(b) == 0 || b[0] != envelopeMark {
+		return decodeGob(b)
+	}
+
+	ct, payload, err := openEnvelope(b)
+	if err != nil {
+		return &Msg{}, err
+	}
+
+	switch ct {
+	case ContentJSON:
+		return decodeJSON(payload)
+	case ContentProto:
+		return decodeProto(payload)
+	default:
+		return &Msg{}, fmt.Errorf("broker: unsupported message content type %d", ct)
+	}
+}
+
+// openEnvelope checks envelope header of b, returning
+// content type and payload of the enveloped message
+func openEnvelope(b []byte) (ContentType, []byte, error) {
+	if len(b) < envelopeHeader {
+		return 0, nil, fmt.Errorf("broker: truncated message envelope")
+	}
+
+	if b[1] != envelopeVersion {
+		return 0, nil, fmt.Errorf("broker: unsupported message envelope version %d", b[1])
+	}
+
+	return ContentType(b[2]), b[envelopeHeader:], nil
+}
+
+// EncodeMsg encodes provided chat Msg as protobuf envelope
+func EncodeMsg(msg *Msg) ([]byte, error) {
+	return EncodeMsgAs(msg, ContentProto)
+}
+
+// EncodeMsgAs encodes provided chat Msg as envelope of content type ct.
+// Seq is not encoded since it is assigned by the message queue.
+func EncodeMsgAs(msg *Msg, ct ContentType) ([]byte, error) {
+	b := []byte{envelopeMark, envelopeVersion, byte(ct)}
+
+	switch ct {
+	case ContentJSON:
+		data, err := json.Marshal(wireMsg{
+			Meta:       msg.Meta,
+			Time:       msg.Time,
+			Text:       msg.Text,
+			From:       msg.From,
+			ID:         msg.ID,
+			Conn:       msg.Conn,
+			Kind:       msg.Kind,
+			Lang:       msg.Lang,
+			Attachment: msg.Attachment,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(b, data...), nil
+	case ContentProto:
+		return appendProto(b, msg), nil
+	default:
+		return nil, fmt.Errorf("broker: unsupported message content type %d", ct)
+	}
+}
+
+// wireMsg represents JSON encoded message payload. Unlike Msg
+// it carries the connection message was sent from.
+type wireMsg struct {
+	Meta map[string]string `json:"meta,omitempty"`
+	Time time.Time         `json:"time"`
+	Text string            `json:"text"`
+	From string            `json:"from"`
+	ID   string            `json:"id,omitempty"`
+	Conn string            `json:"conn,omitempty"`
+
+	Kind       Kind        `json:"kind,omitempty"`
+	Lang       string      `json:"lang,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+func decodeJSON(b []byte) (*Msg, error) {
+	var m wireMsg
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		return &Msg{}, err
+	}
+
+	return &Msg{
+		Meta:       m.Meta,
+		Time:       m.Time,
+		Text:       m.Text,
+		From:       m.From,
+		ID:         m.ID,
+		Conn:       m.Conn,
+		Kind:       m.Kind,
+		Lang:       m.Lang,
+		Attachment: m.Attachment,
+	}, nil
+}
+
+func decodeGob(b []byte) (*Msg, error) {
+	var msg Msg
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&msg)
+	return &msg, err
+}
+
+// Protobuf payload is encoded according to msg.proto
+const (
+	protoMeta protowire.Number = 1
+	protoTime protowire.Number = 2
+	protoText protowire.Number = 3
+	protoFrom protowire.Number = 4
+	protoID   protowire.Number = 5
+	protoConn protowire.Number = 6
+	protoKind protowire.Number = 7
+	protoLang protowire.Number = 8
+	protoAtt  protowire.Number = 9
+
+	// map entry and google.protobuf.Timestamp fields
+	protoKey     protowire.Number = 1
+	protoValue   protowire.Number = 2
+	protoSeconds protowire.Number = 1
+	protoNanos   protowire.Number = 2
+
+	// Attachment fields
+	protoAttID   protowire.Number = 1
+	protoAttName protowire.Number = 2
+	protoAttMIME protowire.Number = 3
+	protoAttSize protowire.Number = 4
+)
+
+func appendProto(b []byte, msg *Msg) []byte {
+	for k, v := range msg.Meta {
+		var entry []byte
+		entry = appendString(entry, protoKey, k)
+		entry = appendString(entry, protoValue, v)
+		b = protowire.AppendTag(b, protoMeta, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	if !msg.Time.IsZero() {
+		var ts []byte
+		ts = protowire.AppendTag(ts, protoSeconds, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(msg.Time.Unix()))
+		ts = protowire.AppendTag(ts, protoNanos, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(msg.Time.Nanosecond()))
+		b = protowire.AppendTag(b, protoTime, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	b = appendString(b, protoText, msg.Text)
+	b = appendString(b, protoFrom, msg.From)
+	b = appendString(b, protoID, msg.ID)
+	b = appendString(b, protoConn, msg.Conn)
+	b = appendString(b, protoKind, string(msg.Kind))
+	b = appendString(b, protoLang, msg.Lang)
+
+	if att := msg.Attachment; att != nil {
+		var ab []byte
+		ab = appendString(ab, protoAttID, att.ID)
+		ab = appendString(ab, protoAttName, att.Name)
+		ab = appendString(ab, protoAttMIME, att.MIME)
+		if att.Size != 0 {
+			ab = protowire.AppendTag(ab, protoAttSize, protowire.VarintType)
+			ab = protowire.AppendVarint(ab, uint64(att.Size))
+		}
+		b = protowire.AppendTag(b, protoAtt, protowire.BytesType)
+		b = protowire.AppendBytes(b, ab)
+	}
+
+	return b
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func decodeProto(b []byte) (*Msg, error) {
+	var msg Msg
+
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+
+		switch num {
+		case protoMeta:
+			var key, val string
+			err := consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch num {
+				case protoKey:
+					key = string(v)
+				case protoValue:
+					val = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if msg.Meta == nil {
+				msg.Meta = make(map[string]string)
+			}
+			msg.Meta[key] = val
+		case protoTime:
+			var sec, nsec uint64
+			err := consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if typ != protowire.VarintType {
+					return nil
+				}
+				n, _ := protowire.ConsumeVarint(v)
+				switch num {
+				case protoSeconds:
+					sec = n
+				case protoNanos:
+					nsec = n
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Time = time.Unix(int64(sec), int64(nsec))
+		case protoText:
+			msg.Text = string(v)
+		case protoFrom:
+			msg.From = string(v)
+		case protoID:
+			msg.ID = string(v)
+		case protoConn:
+			msg.Conn = string(v)
+		case protoKind:
+			msg.Kind = Kind(v)
+		case protoLang:
+			msg.Lang = string(v)
+		case protoAtt:
+			var att Attachment
+			err := consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == protoAttID && typ == protowire.BytesType:
+					att.ID = string(v)
+				case num == protoAttName && typ == protowire.BytesType:
+					att.Name = string(v)
+				case num == protoAttMIME && typ == protowire.BytesType:
+					att.MIME = string(v)
+				case num == protoAttSize && typ == protowire.VarintType:
+					n, _ := protowire.ConsumeVarint(v)
+					att.Size = int64(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Attachment = &att
+		}
+
+		return nil
+	})
+
+	return &msg, err
+}
+
+// consumeFields calls f with every field in protobuf encoded b. For varint
+// fields v holds the encoded varint, and for length delimited fields the
+// field contents. Unknown fields are skipped by f.
+func consumeFields(b []byte, f func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("broker: invalid protobuf message: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return fmt.Errorf("broker: invalid protobuf message: %v", protowire.ParseError(n))
+		}
+
+		v := b[:n]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package broker_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tonto/gossip/pkg/broker"
+)
+
+func TestMsgEncoding(t *testing.T) {
+	msg := broker.Msg{
+		Meta: map[string]string{"color": "red", "lang": "en"},
+		Time: time.Unix(1500000000, 123456789),
+		Text: "foo msg",
+		From: "joe",
+		ID:   "1",
+		Conn: "conn",
+	}
+
+	att := broker.Msg{
+		Text:       "see attached",
+		From:       "joe",
+		Kind:       broker.KindAttachment,
+		Attachment: &broker.Attachment{ID: "a1", Name: "cat.png", MIME: "image/png", Size: 1024},
+	}
+
+	code := broker.Msg{
+		Text: "fmt.Println()",
+		From: "joe",
+		Kind: broker.KindCode,
+		Lang: "go",
+	}
+
+	legacy := func(m broker.Msg) []byte {
+		var buff bytes.Buffer
+		gob.NewEncoder(&buff).Encode(m)
+		return buff.Bytes()
+	}
+
+	encode := func(m broker.Msg, ct broker.ContentType) []byte {
+		data, err := broker.EncodeMsgAs(&m, ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	cases := []struct {
+		name    string
+		data    []byte
+		want    broker.Msg
+		wantErr bool
+	}{
+		{
+			name: "json",
+			data: encode(msg, broker.ContentJSON),
+			want: msg,
+		},
+		{
+			name: "protobuf",
+			data: encode(msg, broker.ContentProto),
+			want: msg,
+		},
+		{
+			name: "json attachment",
+			data: encode(att, broker.ContentJSON),
+			want: att,
+		},
+		{
+			name: "protobuf attachment",
+			data: encode(att, broker.ContentProto),
+			want: att,
+		},
+		{
+			name: "protobuf code",
+			data: encode(code, broker.ContentProto),
+			want: code,
+		},
+		{
+			name: "protobuf empty message",
+			data: encode(broker.Msg{}, broker.ContentProto),
+			want: broker.Msg{},
+		},
+		{
+			name: "legacy gob",
+			data: legacy(msg),
+			want: msg,
+		},
+		{
+			name:    "truncated envelope",
+			data:    []byte{0, 1},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported version",
+			data:    []byte{0, 9, byte(broker.ContentJSON), '{', '}'},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported content type",
+			data:    []byte{0, 1, 9},
+			wantErr: true,
+		},
+		{
+			name:    "invalid protobuf",
+			data:    []byte{0, 1, byte(broker.ContentProto), 0x1a, 0x05, 'f'},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := broker.DecodeMsg(tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if !got.Time.Equal(tc.want.Time) {
+				t.Errorf("unexpected time. want: %v, got: %v", tc.want.Time, got.Time)
+			}
+
+			got.Time, tc.want.Time = time.Time{}, time.Time{}
+
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("unexpected message. want: %+v, got: %+v", tc.want, *got)
+			}
+		})
+	}
+}
+
+func TestEncodeMsgUnsupportedContentType(t *testing.T) {
+	if _, err := broker.EncodeMsgAs(&broker.Msg{}, broker.ContentType(9)); err == nil {
+		t.Errorf("expected unsupported content type error")
+	}
+}
+
+func TestEventEncoding(t *testing.T) {
+	e := broker.Event{
+		Type:    broker.EventNick,
+		Nick:    "joe",
+		By:      "joe",
+		NewNick: "joseph",
+		Time:    time.Unix(1500000000, 123456789),
+	}
+
+	legacy := func(e broker.Event) []byte {
+		var buff bytes.Buffer
+		gob.NewEncoder(&buff).Encode(e)
+		return buff.Bytes()
+	}
+
+	encode := func(e broker.Event) []byte {
+		data, err := broker.EncodeEvent(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	cases := []struct {
+		name    string
+		data    []byte
+		want    broker.Event
+		wantErr bool
+	}{
+		{
+			name: "json",
+			data: encode(e),
+			want: e,
+		},
+		{
+			name: "legacy gob",
+			data: legacy(e),
+			want: e,
+		},
+		{
+			name:    "truncated envelope",
+			data:    []byte{0, 1},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported version",
+			data:    []byte{0, 9, byte(broker.ContentJSON), '{', '}'},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported content type",
+			data:    []byte{0, 1, byte(broker.ContentProto)},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := broker.DecodeEvent(tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if !got.Time.Equal(tc.want.Time) {
+				t.Errorf("unexpected time. want: %v, got: %v", tc.want.Time, got.Time)
+			}
+
+			got.Time, tc.want.Time = time.Time{}, time.Time{}
+
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("unexpected event. want: %+v, got: %+v", tc.want, *got)
+			}
+		})
+	}
+}
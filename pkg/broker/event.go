@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EventT represents chat event type
+type EventT string
+
+// Chat event types
+const (
+	EventKick EventT = "kick"
+	EventBan  EventT = "ban"
+	EventMute EventT = "mute"
+	EventRole EventT = "role"
+
+	// EventSecret signals that user credentials were
+	// rotated and existing sessions are no longer valid
+	EventSecret EventT = "secret"
+
+	// EventNick signals that user changed nick to NewNick
+	EventNick EventT = "nick"
+
+	// EventLeave signals that user left the chat
+	EventLeave EventT = "leave"
+
+	// EventJoin signals that user joined the chat
+	EventJoin EventT = "join"
+)
+
+// Event represents chat control event (eg. moderation action)
+// broadcast to all gossip instances serving the chat
+type Event struct {
+	Type    EventT    `json:"type"`
+	Nick    string    `json:"nick"`
+	By      string    `json:"by"`
+	Reason  string    `json:"reason,omitempty"`
+	Role    string    `json:"role,omitempty"`
+	NewNick string    `json:"new_nick,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// DecodeEvent decodes enveloped Event in b, or legacy gob encoded Event
+func DecodeEvent(b []byte) (*Event, error) {
+	var e Event
+
+	if len(b) == 0 || b[0] != envelopeMark {
+		err := gob.NewDecoder(bytes.NewReader(b)).Decode(&e)
+		return &e, err
+	}
+
+	ct, payload, err := openEnvelope(b)
+	if err != nil {
+		return &e, err
+	}
+
+	if ct != ContentJSON {
+		return &e, fmt.Errorf("broker: unsupported event content type %d", ct)
+	}
+
+	err = json.Unmarshal(payload, &e)
+	return &e, err
+}
+
+// EncodeEvent encodes provided chat Event as JSON envelope
+func EncodeEvent(e *Event) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{envelopeMark, envelopeVersion, byte(ContentJSON)}, data...), nil
+}
@@ -1,11 +1,29 @@
 package broker
 
-import (
-	"bytes"
-	"encoding/gob"
-	"time"
+import "time"
+
+// Kind represents chat message content kind
+type Kind string
+
+// Chat message content kinds. Messages without kind are plain text.
+const (
+	KindText       Kind = "text"
+	KindMarkdown   Kind = "markdown"
+	KindCode       Kind = "code"
+	KindAttachment Kind = "attachment"
+
+	// KindSystem represents message sent by gossip itself (eg. on chat events)
+	KindSystem Kind = "system"
 )
 
+// Attachment represents reference to uploaded attachment
+type Attachment struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	MIME string `json:"mime"`
+	Size int64  `json:"size"`
+}
+
 // Msg represents chat message
 type Msg struct {
 	Meta map[string]string `json:"meta"`
@@ -13,19 +31,21 @@ type Msg struct {
 	Seq  uint64            `json:"seq"`
 	Text string            `json:"text"`
 	From string            `json:"from"`
-}
 
-// DecodeMsg tries to decode gob in b to Msg
-func DecodeMsg(b []byte) (*Msg, error) {
-	var msg Msg
-	r := bytes.NewReader(b)
-	err := gob.NewDecoder(r).Decode(&msg)
-	return &msg, err
+	Kind       Kind        `json:"kind,omitempty"`
+	Lang       string      `json:"lang,omitempty"` // Code language
+	Attachment *Attachment `json:"attachment,omitempty"`
+
+	// ID represents optional client supplied message id,
+	// used to acknowledge and deduplicate client sends
+	ID string `json:"id,omitempty"`
+
+	// Conn represents id of the connection message was sent from
+	Conn string `json:"-"`
 }
 
-// EncodeMsg gob encodes provided chat Msg
-func EncodeMsg(msg *Msg) ([]byte, error) {
-	var buff bytes.Buffer
-	err := gob.NewEncoder(&buff).Encode(msg)
-	return buff.Bytes(), err
+// sentFrom checks whether msg was sent from connection conn
+// and does not need to be acknowledged
+func (msg *Msg) sentFrom(conn string) bool {
+	return conn != "" && msg.Conn == conn && msg.ID == ""
 }
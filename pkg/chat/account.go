@@ -0,0 +1,212 @@
+package chat
+
+import (
+	"fmt"
+)
+
+// NewAccount creates new global user account
+func NewAccount(nick, fullName, email, secret string) *Account {
+	acc := Account{
+		Nick:     nick,
+		FullName: fullName,
+		Email:    email,
+		Secret:   secret,
+	}
+
+	if secret == "" {
+		acc.Secret = newSecret()
+	}
+
+	return &acc
+}
+
+// Account represents global user account. Account credentials
+// grant access to all channels account is a member of.
+type Account struct {
+	Nick     string   `json:"nick"`
+	FullName string   `json:"full_name"`
+	Email    string   `json:"email"`
+	Secret   string   `json:"secret"`
+	Channels []string `json:"channels"`
+
+	// Version is incremented on every save, so that stores can
+	// reject saving account modified since it was fetched
+	Version uint64 `json:"version"`
+}
+
+// Auth checks provided account secret
+func (a *Account) Auth(secret string) error {
+	if a.Secret == "" || a.Secret != secret {
+		return fmt.Errorf("chat: invalid secret")
+	}
+	return nil
+}
+
+// IsMember checks whether account is a member of chat id
+func (a *Account) IsMember(id string) bool {
+	for _, ch := range a.Channels {
+		if ch == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Account) addChannel(id string) {
+	if !a.IsMember(id) {
+		a.Channels = append(a.Channels, id)
+	}
+}
+
+// RemoveChannel removes chat id from account channel list
+func (a *Account) RemoveChannel(id string) {
+	for i, ch := range a.Channels {
+		if ch == id {
+			a.Channels = append(a.Channels[:i], a.Channels[i+1:]...)
+			return
+		}
+	}
+}
+
+// RegisterAccount adds account to chat members with provided role
+func (c *Chat) RegisterAccount(acc *Account, role Role) error {
+	u := User{
+		Nick:     acc.Nick,
+		FullName: acc.FullName,
+		Email:    acc.Email,
+		Role:     role,
+		Account:  true,
+	}
+
+	// Account nicks are unique, so former account member
+	// rejoining the chat takes back its nicks
+	f, rejoin := c.Left[u.Nick]
+	rejoin = rejoin && f.Account
+
+	if !rejoin && c.isTaken(u.Nick) {
+		return fmt.Errorf("chat: this nick is already taken")
+	}
+	if c.isBanned(&u) {
+		return fmt.Errorf("chat: this nick or email is banned from the chat")
+	}
+	if u.Role == "" {
+		u.Role = RoleMember
+	}
+	if rejoin {
+		u.PreviousNicks = f.PreviousNicks
+		delete(c.Left, u.Nick)
+	}
+
+	c.Members[u.Nick] = u
+	acc.addChannel(c.Name)
+
+	return nil
+}
+
+// Authenticate joins user to chat using global account credentials
+// if acc is provided, falling back to per chat member credentials
+func (c *Chat) Authenticate(acc *Account, nick, secret string) (*User, error) {
+	if acc != nil && acc.Auth(secret) == nil {
+		u, ok := c.Members[nick]
+		if ok && u.Account {
+			u.Secret = ""
+			return &u, nil
+		}
+	}
+	return c.Join(nick, secret)
+}
+
+// MigrationStore represents account migration store interface
+type MigrationStore interface {
+	Save(*Chat) error
+	Get(string) (*Chat, error)
+	ListAllChannels() ([]string, error)
+	GetAccount(string) (*Account, error)
+	SaveAccount(*Account) error
+}
+
+// Migration represents account migration report
+type Migration struct {
+	Channels  int      `json:"channels"`
+	Created   int      `json:"created"`
+	Linked    int      `json:"linked"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// MigrateAccounts links per channel members of all chats to global accounts.
+// Account is created for every nick not yet taken. Members are linked to an
+// existing account only if their secret matches, otherwise they are left
+// as per channel members and reported as conflicts.
+// If dryRun is set, migration report is built without storing any changes.
+func MigrateAccounts(s MigrationStore, dryRun bool) (*Migration, error) {
+	ids, err := s.ListAllChannels()
+	if err != nil {
+		return nil, fmt.Errorf("chat: unable to list channels: %v", err)
+	}
+
+	m := Migration{Conflicts: []string{}}
+
+	// Accounts created or linked during this run, since dry
+	// run does not store them
+	accounts := make(map[string]*Account)
+
+	for _, id := range ids {
+		ch, err := s.Get(id)
+		if err != nil {
+			return &m, fmt.Errorf("chat: unable to fetch channel %s: %v", id, err)
+		}
+
+		for nick, u := range ch.Members {
+			if u.Account {
+				continue
+			}
+
+			acc, ok := accounts[nick]
+			if !ok {
+				acc, err = s.GetAccount(nick)
+				if err != nil {
+					return &m, fmt.Errorf("chat: unable to fetch account %s: %v", nick, err)
+				}
+			}
+
+			switch {
+			case acc == nil:
+				acc = NewAccount(u.Nick, u.FullName, u.Email, u.Secret)
+				m.Created++
+			case acc.Auth(u.Secret) == nil:
+				m.Linked++
+			default:
+				m.Conflicts = append(m.Conflicts, fmt.Sprintf("%s/%s", id, nick))
+				continue
+			}
+
+			acc.addChannel(ch.Name)
+			accounts[nick] = acc
+
+			if dryRun {
+				continue
+			}
+
+			if err := s.SaveAccount(acc); err != nil {
+				return &m, fmt.Errorf("chat: unable to save account %s: %v", nick, err)
+			}
+
+			u.Account = true
+			u.Secret = ""
+			ch.Members[nick] = u
+		}
+
+		m.Channels++
+
+		if dryRun {
+			continue
+		}
+
+		// TODO - Need transaction
+		if err := s.Save(ch); err != nil {
+			return &m, fmt.Errorf("chat: unable to save channel %s: %v", id, err)
+		}
+	}
+
+	return &m, nil
+}
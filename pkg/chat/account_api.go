@@ -0,0 +1,315 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tonto/gossip/pkg/broker"
+	h "github.com/tonto/kit/http"
+)
+
+type registerAccountReq struct {
+	Nick     string `json:"nick"`
+	FullName string `json:"name"`
+	Email    string `json:"email"`
+	Secret   string `json:"secret"`
+}
+
+func (r *registerAccountReq) Validate() error {
+	if err := validateNick(r.Nick); err != nil {
+		return err
+	}
+	if len(r.FullName) > defMaxLen || len(r.Email) > defMaxLen {
+		return fmt.Errorf("exceeded max field length of %d", defMaxLen)
+	}
+	if r.Secret != "" {
+		return validateSecret(r.Secret)
+	}
+	return nil
+}
+
+func (api *API) registerAccount(c context.Context, w http.ResponseWriter, req *registerAccountReq) (*h.Response, error) {
+	bot, err := api.store.IsBot(req.Nick)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch account")
+	}
+
+	if bot {
+		return nil, fmt.Errorf("this nick is reserved for a bot")
+	}
+
+	acc := NewAccount(req.Nick, req.FullName, req.Email, req.Secret)
+
+	err = api.store.CreateAccount(acc)
+	if err == ErrConflict {
+		return nil, fmt.Errorf("this nick is already taken")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create account")
+	}
+
+	return h.NewResponse(registerNickResp{Secret: acc.Secret}, http.StatusOK), nil
+}
+
+type loginReq struct {
+	Nick   string `json:"nick"`
+	Secret string `json:"secret"`
+}
+
+func (r *loginReq) Validate() error {
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	return validateNick(r.Nick)
+}
+
+func (api *API) login(c context.Context, w http.ResponseWriter, req *loginReq) (*h.Response, error) {
+	acc, err := api.authAccount(req.Nick, req.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	acc.Secret = ""
+
+	return h.NewResponse(acc, http.StatusOK), nil
+}
+
+type joinChannelReq struct {
+	Nick          string `json:"nick"`
+	Secret        string `json:"secret"`
+	Channel       string `json:"channel"`
+	ChannelSecret string `json:"channel_secret"`
+	Invite        string `json:"invite"` // Used instead of channel secret
+}
+
+func (r *joinChannelReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if len(r.ChannelSecret) > maxChanSecretLen {
+		return fmt.Errorf("exceeded max channel secret length of %d", maxChanSecretLen)
+	}
+	if len(r.Invite) > maxChanSecretLen {
+		return fmt.Errorf("exceeded max invite length of %d", maxChanSecretLen)
+	}
+	return validateNick(r.Nick)
+}
+
+func (api *API) joinChannel(c context.Context, w http.ResponseWriter, req *joinChannelReq) (*h.Response, error) {
+	acc, err := api.authAccount(req.Nick, req.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := api.store.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	var role Role
+
+	if req.Invite != "" {
+		role, err = ch.RedeemInvite(req.Invite, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	} else if ch.Secret != req.ChannelSecret {
+		return nil, fmt.Errorf("invalid secret")
+	}
+
+	if err := ch.RegisterAccount(acc, role); err != nil {
+		return nil, err
+	}
+
+	// TODO - Need transaction
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not update channel membership")
+	}
+
+	acc, err = api.updateAccountFunc(acc.Nick, func(a *Account) error {
+		a.addChannel(ch.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	api.announceJoin(ch.Name, acc.Nick)
+
+	acc.Secret = ""
+
+	return h.NewResponse(acc, http.StatusOK), nil
+}
+
+type updateAccountReq struct {
+	Nick     string `json:"nick"`
+	Secret   string `json:"secret"`
+	FullName string `json:"name"`
+	Email    string `json:"email"`
+}
+
+func (r *updateAccountReq) Validate() error {
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if len(r.FullName) > defMaxLen || len(r.Email) > defMaxLen {
+		return fmt.Errorf("exceeded max field length of %d", defMaxLen)
+	}
+	return validateNick(r.Nick)
+}
+
+func (api *API) updateAccount(c context.Context, w http.ResponseWriter, req *updateAccountReq) (*h.Response, error) {
+	acc, err := api.authAccount(req.Nick, req.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Channels are updated before the account, so that failed
+	// update can be retried until all channels are up to date
+	for _, id := range acc.Channels {
+		ch, err := api.store.Get(id)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch channel %s", id)
+		}
+
+		u, ok := ch.Members[acc.Nick]
+		if !ok || (u.FullName == req.FullName && u.Email == req.Email) {
+			continue
+		}
+
+		if _, err := ch.UpdateProfile(acc.Nick, req.FullName, req.Email); err != nil {
+			return nil, fmt.Errorf("could not update channel %s membership: %v", id, err)
+		}
+
+		if err := api.store.Save(ch); err != nil {
+			return nil, fmt.Errorf("could not update channel %s membership", id)
+		}
+	}
+
+	acc, err = api.updateAccountFunc(acc.Nick, func(a *Account) error {
+		a.FullName = req.FullName
+		a.Email = req.Email
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	acc.Secret = ""
+
+	return h.NewResponse(acc, http.StatusOK), nil
+}
+
+type migrateAccountsReq struct {
+	DryRun bool `json:"dry_run"`
+}
+
+func (api *API) migrateAccounts(c context.Context, w http.ResponseWriter, req *migrateAccountsReq) (*h.Response, error) {
+	m, err := MigrateAccounts(api.store, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return h.NewResponse(m, http.StatusOK), nil
+}
+
+// updateAccountSecret replaces account secret and disconnects sessions
+// established using the old one in all account channels. Once saved,
+// the new secret is returned even if sessions could not be disconnected
+// in some channels, since the old one is no longer valid, and those
+// channels are reported as failed.
+func (api *API) updateAccountSecret(by, nick, secret string) (*h.Response, error) {
+	if secret == "" {
+		secret = newSecret()
+	}
+
+	acc, err := api.updateAccountFunc(nick, func(a *Account) error {
+		a.Secret = secret
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := registerNickResp{Secret: acc.Secret}
+
+	for _, id := range acc.Channels {
+		err = api.publish(id, &broker.Event{
+			Type: broker.EventSecret,
+			Nick: nick,
+			By:   by,
+			Time: time.Now(),
+		})
+		if err != nil {
+			log.Printf("chat api: could not disconnect %s sessions in channel %s: %v", nick, id, err)
+			resp.Failed = append(resp.Failed, id)
+		}
+	}
+
+	return h.NewResponse(resp, http.StatusOK), nil
+}
+
+// leaveAccount removes chat id from account channel list
+func (api *API) leaveAccount(nick, id string) error {
+	_, err := api.updateAccountFunc(nick, func(a *Account) error {
+		a.RemoveChannel(id)
+		return nil
+	})
+
+	return err
+}
+
+// updateAccountFunc fetches account, applies fn and saves it.
+// If account was modified concurrently, it is fetched again and fn
+// reapplied, up to maxAccountRetries times, before giving up.
+func (api *API) updateAccountFunc(nick string, fn func(*Account) error) (*Account, error) {
+	for i := 0; ; i++ {
+		acc, err := api.store.GetAccount(nick)
+		if err != nil || acc == nil {
+			return nil, fmt.Errorf("could not fetch account")
+		}
+
+		if err := fn(acc); err != nil {
+			return nil, err
+		}
+
+		err = api.store.SaveAccount(acc)
+		if err == nil {
+			return acc, nil
+		}
+
+		if err != ErrConflict {
+			return nil, fmt.Errorf("could not update account")
+		}
+
+		if i+1 >= maxAccountRetries {
+			return nil, h.NewError(http.StatusConflict, fmt.Errorf("account was modified concurrently, try again"))
+		}
+	}
+}
+
+func (api *API) authAccount(nick, secret string) (*Account, error) {
+	acc, err := api.store.GetAccount(nick)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch account")
+	}
+
+	if acc == nil {
+		return nil, fmt.Errorf("account not registered")
+	}
+
+	if err := acc.Auth(secret); err != nil {
+		return nil, err
+	}
+
+	return acc, nil
+}
@@ -0,0 +1,160 @@
+package chat_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tonto/gossip/pkg/chat"
+)
+
+func TestChannelAuthenticate(t *testing.T) {
+	ch := chat.NewChannel("general", false)
+
+	acc := chat.NewAccount("joe", "", "", "accsecret")
+	if err := ch.RegisterAccount(acc, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "bob"}, "bobsecret"); err != nil {
+		t.Fatal(err)
+	}
+
+	other := chat.NewAccount("bob", "", "", "othersecret")
+
+	cases := []struct {
+		name    string
+		acc     *chat.Account
+		nick    string
+		secret  string
+		wantErr bool
+	}{
+		{name: "test account", acc: acc, nick: "joe", secret: "accsecret"},
+		{name: "test account invalid secret", acc: acc, nick: "joe", secret: "xxx", wantErr: true},
+		{name: "test account empty secret", acc: nil, nick: "joe", secret: "", wantErr: true},
+		{name: "test legacy member", acc: nil, nick: "bob", secret: "bobsecret"},
+		{name: "test account not linked to member", acc: other, nick: "bob", secret: "othersecret", wantErr: true},
+		{name: "test legacy fallback", acc: other, nick: "bob", secret: "bobsecret"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := ch.Authenticate(tc.acc, tc.nick, tc.secret)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && (u.Nick != tc.nick || u.Secret != "") {
+				t.Errorf("unexpected user: %+v", u)
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(acc.Channels, []string{"general"}) {
+		t.Errorf("channel not added to account: %v", acc.Channels)
+	}
+}
+
+func TestMigrateAccounts(t *testing.T) {
+	general := chat.NewChannel("general", false)
+	general.Register(&chat.User{Nick: "joe", FullName: "Joe"}, "joesecret")
+	general.Register(&chat.User{Nick: "bob"}, "bobsecret")
+
+	private := chat.NewChannel("private", true)
+	private.Register(&chat.User{Nick: "joe"}, "joesecret")
+	private.Register(&chat.User{Nick: "bob"}, "othersecret")
+
+	for _, dryRun := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dry run %v", dryRun), func(t *testing.T) {
+			s := migrationStore{
+				chats: map[string]chat.Chat{
+					"general": copyChat(general),
+					"private": copyChat(private),
+				},
+				accounts: map[string]chat.Account{},
+			}
+
+			m, err := chat.MigrateAccounts(&s, dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := chat.Migration{
+				Channels:  2,
+				Created:   2,
+				Linked:    1,
+				Conflicts: []string{"private/bob"},
+			}
+
+			if !reflect.DeepEqual(*m, want) {
+				t.Errorf("unexpected migration report. want: %+v, got: %+v", want, *m)
+			}
+
+			if dryRun {
+				if len(s.accounts) != 0 || s.chats["general"].Members["joe"].Account {
+					t.Errorf("dry run should not store any changes")
+				}
+				return
+			}
+
+			joe := s.accounts["joe"]
+			sort.Strings(joe.Channels)
+			if joe.Secret != "joesecret" || joe.FullName != "Joe" || !reflect.DeepEqual(joe.Channels, []string{"general", "private"}) {
+				t.Errorf("unexpected account: %+v", joe)
+			}
+
+			if !reflect.DeepEqual(s.accounts["bob"].Channels, []string{"general"}) {
+				t.Errorf("unexpected account: %+v", s.accounts["bob"])
+			}
+
+			ch := s.chats["private"]
+			acc := s.accounts["joe"]
+			if _, err := ch.Authenticate(&acc, "joe", "joesecret"); err != nil {
+				t.Errorf("migrated member unable to authenticate: %v", err)
+			}
+
+			if u := ch.Members["bob"]; u.Account || u.Secret != "othersecret" {
+				t.Errorf("conflicting member should be left intact: %+v", u)
+			}
+		})
+	}
+}
+
+func copyChat(c *chat.Chat) chat.Chat {
+	cp := *c
+	cp.Members = make(map[string]chat.User)
+	for k, v := range c.Members {
+		cp.Members[k] = v
+	}
+	return cp
+}
+
+type migrationStore struct {
+	chats    map[string]chat.Chat
+	accounts map[string]chat.Account
+}
+
+func (s *migrationStore) Save(c *chat.Chat) error { s.chats[c.Name] = *c; return nil }
+
+func (s *migrationStore) Get(id string) (*chat.Chat, error) {
+	c := s.chats[id]
+	cp := copyChat(&c)
+	return &cp, nil
+}
+
+func (s *migrationStore) ListAllChannels() ([]string, error) {
+	return []string{"general", "private"}, nil
+}
+
+func (s *migrationStore) GetAccount(nick string) (*chat.Account, error) {
+	acc, ok := s.accounts[nick]
+	if !ok {
+		return nil, nil
+	}
+	return &acc, nil
+}
+
+func (s *migrationStore) SaveAccount(acc *chat.Account) error {
+	s.accounts[acc.Nick] = *acc
+	return nil
+}
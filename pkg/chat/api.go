@@ -3,9 +3,12 @@ package chat
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"regexp"
+	"time"
 
+	"github.com/tonto/gossip/pkg/broker"
 	h "github.com/tonto/kit/http"
 	"github.com/tonto/kit/http/respond"
 )
@@ -21,12 +24,22 @@ const (
 	minChanNameLen   = 3
 	maxChanNameLen   = 25
 	maxChanSecretLen = 64
+
+	maxReasonLen = 140
+
+	maxMuteDuration = 365 * 24 * time.Hour
+
+	defInviteTTL = 24 * time.Hour
+	maxInviteTTL = 30 * 24 * time.Hour
+
+	maxAccountRetries = 3
 )
 
 // NewAPI creates new websocket api
-func NewAPI(store Store, admin, password string) *API {
+func NewAPI(store Store, events Broadcaster, admin, password string) *API {
 	api := API{
-		store: store,
+		store:  store,
+		events: events,
 	}
 
 	api.RegisterEndpoint(
@@ -43,9 +56,77 @@ func NewAPI(store Store, admin, password string) *API {
 		WithHTTPBasicAuth(admin, password),
 	)
 
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/grant_role",
+		api.adminGrantRole,
+		WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/revoke_role",
+		api.adminRevokeRole,
+		WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/moderate",
+		api.adminModerate,
+		WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/moderation_log",
+		api.moderationLog,
+		WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/rotate_channel_secret",
+		api.rotateChannelSecret,
+		WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/reset_secret",
+		api.resetSecret,
+		WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/create_invite",
+		api.adminCreateInvite,
+		WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/migrate_accounts",
+		api.migrateAccounts,
+		WithHTTPBasicAuth(admin, password),
+	)
+
 	api.RegisterHandler("GET", "/list_channels", api.listChannels)
 	api.RegisterEndpoint("POST", "/register_nick", api.registerNick)
 	api.RegisterEndpoint("POST", "/channel_members", api.channelMembers)
+	api.RegisterEndpoint("POST", "/grant_role", api.grantRole)
+	api.RegisterEndpoint("POST", "/revoke_role", api.revokeRole)
+	api.RegisterEndpoint("POST", "/moderate", api.moderate)
+	api.RegisterEndpoint("POST", "/rotate_secret", api.rotateSecret)
+	api.RegisterEndpoint("POST", "/create_invite", api.createInvite)
+	api.RegisterEndpoint("POST", "/update_profile", api.updateProfile)
+	api.RegisterEndpoint("POST", "/change_nick", api.changeNick)
+	api.RegisterEndpoint("POST", "/leave", api.leave)
+	api.RegisterEndpoint("POST", "/register_account", api.registerAccount)
+	api.RegisterEndpoint("POST", "/login", api.login)
+	api.RegisterEndpoint("POST", "/join_channel", api.joinChannel)
+	api.RegisterEndpoint("POST", "/update_account", api.updateAccount)
 
 	return &api
 }
@@ -53,7 +134,8 @@ func NewAPI(store Store, admin, password string) *API {
 // API represents websocket api service
 type API struct {
 	h.BaseService
-	store Store
+	store  Store
+	events Broadcaster
 }
 
 // Store represents chat store interface
@@ -62,6 +144,20 @@ type Store interface {
 	Get(string) (*Chat, error)
 	ListChannels() ([]string, error)
 	GetUnreadCount(string, string) uint64
+	RenameLastClientSeq(string, string, string)
+	AppendModerationLog(string, *broker.Event) error
+	GetModerationLog(string) ([]broker.Event, error)
+	ListAllChannels() ([]string, error)
+	GetAccount(string) (*Account, error)
+	CreateAccount(*Account) error
+	SaveAccount(*Account) error
+	IsBot(string) (bool, error)
+}
+
+// Broadcaster represents chat event broadcaster interface
+type Broadcaster interface {
+	SendEvent(string, *broker.Event) error
+	AnnounceChannel(string) error
 }
 
 // Prefix returns api prefix for this service
@@ -94,6 +190,12 @@ func (api *API) createChannel(c context.Context, w http.ResponseWriter, req *cre
 	if err := api.store.Save(ch); err != nil {
 		return nil, fmt.Errorf("could not create channel at this moment")
 	}
+	// Announced so that ingest and webhook workers start consuming the channel.
+	// Channel is already saved, so it is picked up when workers are restarted
+	// if the announcement fails.
+	if err := api.events.AnnounceChannel(ch.Name); err != nil {
+		log.Printf("chat api: could not announce channel %s: %v", ch.Name, err)
+	}
 	return h.NewResponse(createChanResp{Secret: ch.Secret}, http.StatusOK), nil
 }
 
@@ -104,10 +206,15 @@ type registerNickReq struct {
 	Secret        string `json:"secret"`
 	Channel       string `json:"channel"`
 	ChannelSecret string `json:"channel_secret"` // Tennant
+	Invite        string `json:"invite"`         // Used instead of channel secret
 }
 
 type registerNickResp struct {
 	Secret string `json:"secret"`
+
+	// Failed lists channels in which sessions established using the
+	// old secret could not be disconnected, after secret was updated
+	Failed []string `json:"failed_channels,omitempty"`
 }
 
 func (r *registerNickReq) Validate() error {
@@ -129,6 +236,9 @@ func (r *registerNickReq) Validate() error {
 	if len(r.ChannelSecret) > maxChanSecretLen {
 		return fmt.Errorf("exceeded max channel secret length of %d", maxChanSecretLen)
 	}
+	if len(r.Invite) > maxChanSecretLen {
+		return fmt.Errorf("exceeded max invite length of %d", maxChanSecretLen)
+	}
 	if r.Secret != "" && (len(r.Secret) < minNickSecretLen || len(r.Secret) > maxNickSecretLen) {
 		return fmt.Errorf("secret should be between %d and %d characters long", minNickSecretLen, maxNickSecretLen)
 	}
@@ -139,12 +249,28 @@ func (r *registerNickReq) Validate() error {
 }
 
 func (api *API) registerNick(c context.Context, w http.ResponseWriter, req *registerNickReq) (*h.Response, error) {
+	acc, err := api.store.GetAccount(req.Nick)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch account")
+	}
+
+	if acc != nil {
+		return nil, fmt.Errorf("nick is registered to an account. use join_channel instead")
+	}
+
 	ch, err := api.store.Get(req.Channel)
 	if err != nil {
 		return nil, fmt.Errorf("could not fetch channel")
 	}
 
-	if ch.Secret != req.ChannelSecret {
+	var role Role
+
+	if req.Invite != "" {
+		role, err = ch.RedeemInvite(req.Invite, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	} else if ch.Secret != req.ChannelSecret {
 		return nil, fmt.Errorf("invalid secret")
 	}
 
@@ -152,6 +278,7 @@ func (api *API) registerNick(c context.Context, w http.ResponseWriter, req *regi
 		Nick:     req.Nick,
 		FullName: req.FullName,
 		Email:    req.Email,
+		Role:     role,
 	}, req.Secret)
 
 	if err != nil {
@@ -164,9 +291,25 @@ func (api *API) registerNick(c context.Context, w http.ResponseWriter, req *regi
 		return nil, fmt.Errorf("could not update channel membership")
 	}
 
+	api.announceJoin(ch.Name, req.Nick)
+
 	return h.NewResponse(registerNickResp{Secret: secret}, http.StatusOK), nil
 }
 
+// announceJoin broadcasts that nick joined the chat. Broadcast is best
+// effort, since membership is already saved and join can't be undone.
+func (api *API) announceJoin(id, nick string) {
+	err := api.events.SendEvent(id, &broker.Event{
+		Type: broker.EventJoin,
+		Nick: nick,
+		By:   nick,
+		Time: time.Now(),
+	})
+	if err != nil {
+		log.Printf("chat api: could not broadcast %s join in channel %s: %v", nick, id, err)
+	}
+}
+
 type unreadCountReq struct {
 	Channel string `json:"channel"`
 	Nick    string `json:"nick"`
@@ -228,6 +371,738 @@ func (api *API) channelMembers(c context.Context, w http.ResponseWriter, req *ch
 	return h.NewResponse(members, http.StatusOK), nil
 }
 
+type adminRoleReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Role    string `json:"role"`
+}
+
+func (r *adminRoleReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	return validateNick(r.Nick)
+}
+
+func (api *API) adminGrantRole(c context.Context, w http.ResponseWriter, req *adminRoleReq) (*h.Response, error) {
+	role, err := ParseRole(req.Role)
+	if err != nil {
+		return nil, err
+	}
+	return api.updateRole(req.Channel, "", "", req.Nick, role)
+}
+
+func (api *API) adminRevokeRole(c context.Context, w http.ResponseWriter, req *adminRoleReq) (*h.Response, error) {
+	return api.updateRole(req.Channel, "", "", req.Nick, RoleMember)
+}
+
+type roleReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+	Target  string `json:"target"`
+	Role    string `json:"role"`
+}
+
+func (r *roleReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if err := validateNick(r.Nick); err != nil {
+		return err
+	}
+	if err := validateNick(r.Target); err != nil {
+		return fmt.Errorf("target %v", err)
+	}
+	return nil
+}
+
+func (api *API) grantRole(c context.Context, w http.ResponseWriter, req *roleReq) (*h.Response, error) {
+	role, err := ParseRole(req.Role)
+	if err != nil {
+		return nil, err
+	}
+	return api.updateRole(req.Channel, req.Nick, req.Secret, req.Target, role)
+}
+
+func (api *API) revokeRole(c context.Context, w http.ResponseWriter, req *roleReq) (*h.Response, error) {
+	return api.updateRole(req.Channel, req.Nick, req.Secret, req.Target, RoleMember)
+}
+
+// updateRole assigns role to target on behalf of nick,
+// or on behalf of chat administrator if nick is empty
+func (api *API) updateRole(channel, nick, secret, target string, role Role) (*h.Response, error) {
+	ch, err := api.store.Get(channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	var by *User
+
+	if nick != "" {
+		by, err = api.join(ch, nick, secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ch.GrantRole(by, target, role); err != nil {
+		return nil, err
+	}
+
+	// TODO - Need transaction
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not update channel membership")
+	}
+
+	err = api.publish(ch.Name, &broker.Event{
+		Type: broker.EventRole,
+		Nick: target,
+		By:   nick,
+		Role: string(role),
+		Time: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return h.NewResponse(ch.Members[target].Role, http.StatusOK), nil
+}
+
+type adminModerateReq struct {
+	Channel  string `json:"channel"`
+	Nick     string `json:"nick"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	Duration int64  `json:"duration"` // Mute duration in seconds
+}
+
+func (r *adminModerateReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if err := validateNick(r.Nick); err != nil {
+		return err
+	}
+	return validateModeration(r.Action, r.Reason, r.Duration)
+}
+
+func (api *API) adminModerate(c context.Context, w http.ResponseWriter, req *adminModerateReq) (*h.Response, error) {
+	return api.applyModeration(req.Channel, "", "", req.Nick, req.Action, req.Reason, req.Duration)
+}
+
+type moderateReq struct {
+	Channel  string `json:"channel"`
+	Nick     string `json:"nick"`
+	Secret   string `json:"secret"`
+	Target   string `json:"target"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	Duration int64  `json:"duration"` // Mute duration in seconds
+}
+
+func (r *moderateReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if err := validateNick(r.Nick); err != nil {
+		return err
+	}
+	if err := validateNick(r.Target); err != nil {
+		return fmt.Errorf("target %v", err)
+	}
+	return validateModeration(r.Action, r.Reason, r.Duration)
+}
+
+func (api *API) moderate(c context.Context, w http.ResponseWriter, req *moderateReq) (*h.Response, error) {
+	return api.applyModeration(req.Channel, req.Nick, req.Secret, req.Target, req.Action, req.Reason, req.Duration)
+}
+
+// applyModeration applies moderation action to target on behalf of nick,
+// or on behalf of chat administrator if nick is empty
+func (api *API) applyModeration(channel, nick, secret, target, action, reason string, duration int64) (*h.Response, error) {
+	ch, err := api.store.Get(channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	var by *User
+
+	if nick != "" {
+		by, err = api.join(ch, nick, secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	account := ch.Members[target].Account
+
+	e := broker.Event{
+		Type:   broker.EventT(action),
+		Nick:   target,
+		By:     nick,
+		Reason: reason,
+		Time:   time.Now(),
+	}
+
+	switch e.Type {
+	case broker.EventKick:
+		err = ch.Kick(by, target)
+	case broker.EventBan:
+		err = ch.Ban(by, target, reason)
+	case broker.EventMute:
+		if duration > 0 {
+			e.Until = e.Time.Add(time.Duration(duration) * time.Second)
+		}
+		err = ch.Mute(by, target, e.Until)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Type != broker.EventKick {
+		// TODO - Need transaction
+		err = api.store.Save(ch)
+		if err != nil {
+			return nil, fmt.Errorf("could not update channel membership")
+		}
+	}
+
+	if e.Type == broker.EventBan && account {
+		if err := api.leaveAccount(target, ch.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	err = api.publish(ch.Name, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.NewResponse(e, http.StatusOK), nil
+}
+
+// publish records event to chat moderation log and
+// broadcasts it to all connected chat agents
+func (api *API) publish(id string, e *broker.Event) error {
+	if err := api.store.AppendModerationLog(id, e); err != nil {
+		return fmt.Errorf("could not record moderation action")
+	}
+
+	if err := api.events.SendEvent(id, e); err != nil {
+		return fmt.Errorf("could not broadcast moderation action")
+	}
+
+	return nil
+}
+
+func validateModeration(action, reason string, duration int64) error {
+	switch broker.EventT(action) {
+	case broker.EventKick, broker.EventBan, broker.EventMute:
+	default:
+		return fmt.Errorf("action must be one of: kick, ban, mute")
+	}
+	if len(reason) > maxReasonLen {
+		return fmt.Errorf("reason must not exceed %d characters", maxReasonLen)
+	}
+	if duration < 0 || duration > int64(maxMuteDuration/time.Second) {
+		return fmt.Errorf("duration must be between 0 and %d seconds", int64(maxMuteDuration/time.Second))
+	}
+	return nil
+}
+
+type moderationLogReq struct {
+	Channel string `json:"channel"`
+}
+
+func (r *moderationLogReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	return nil
+}
+
+func (api *API) moderationLog(c context.Context, w http.ResponseWriter, req *moderationLogReq) (*h.Response, error) {
+	log, err := api.store.GetModerationLog(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch moderation log")
+	}
+	if log == nil {
+		log = []broker.Event{}
+	}
+	return h.NewResponse(log, http.StatusOK), nil
+}
+
+type rotateChanSecretReq struct {
+	Channel string `json:"channel"`
+}
+
+func (r *rotateChanSecretReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	return nil
+}
+
+func (api *API) rotateChannelSecret(c context.Context, w http.ResponseWriter, req *rotateChanSecretReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	secret, err := ch.RotateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not update channel secret")
+	}
+
+	return h.NewResponse(createChanResp{Secret: secret}, http.StatusOK), nil
+}
+
+type resetSecretReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+}
+
+func (r *resetSecretReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	return validateNick(r.Nick)
+}
+
+func (api *API) resetSecret(c context.Context, w http.ResponseWriter, req *resetSecretReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	return api.updateSecret(ch, "", req.Nick, "")
+}
+
+type rotateSecretReq struct {
+	Channel   string `json:"channel"`
+	Nick      string `json:"nick"`
+	Secret    string `json:"secret"`
+	NewSecret string `json:"new_secret"`
+}
+
+func (r *rotateSecretReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if err := validateNick(r.Nick); err != nil {
+		return err
+	}
+	if r.NewSecret == "" {
+		return nil
+	}
+	return validateSecret(r.NewSecret)
+}
+
+func (api *API) rotateSecret(c context.Context, w http.ResponseWriter, req *rotateSecretReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	if _, err := api.join(ch, req.Nick, req.Secret); err != nil {
+		return nil, err
+	}
+
+	return api.updateSecret(ch, req.Nick, req.Nick, req.NewSecret)
+}
+
+// updateSecret replaces secret of user nick and disconnects all sessions
+// established using the old one. Once saved, the new secret is returned
+// even if sessions could not be disconnected, since the old one is no
+// longer valid, and the chat is reported as failed.
+func (api *API) updateSecret(ch *Chat, by, nick, secret string) (*h.Response, error) {
+	if u, ok := ch.Members[nick]; ok && u.Account {
+		return api.updateAccountSecret(by, nick, secret)
+	}
+
+	secret, err := ch.ResetSecret(nick, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not update channel membership")
+	}
+
+	resp := registerNickResp{Secret: secret}
+
+	err = api.publish(ch.Name, &broker.Event{
+		Type: broker.EventSecret,
+		Nick: nick,
+		By:   by,
+		Time: time.Now(),
+	})
+	if err != nil {
+		log.Printf("chat api: could not disconnect %s sessions in channel %s: %v", nick, ch.Name, err)
+		resp.Failed = []string{ch.Name}
+	}
+
+	return h.NewResponse(resp, http.StatusOK), nil
+}
+
+type updateProfileReq struct {
+	Channel  string `json:"channel"`
+	Nick     string `json:"nick"`
+	Secret   string `json:"secret"`
+	FullName string `json:"name"`
+	Email    string `json:"email"`
+}
+
+func (r *updateProfileReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if len(r.FullName) > defMaxLen || len(r.Email) > defMaxLen {
+		return fmt.Errorf("exceeded max field length of %d", defMaxLen)
+	}
+	return validateNick(r.Nick)
+}
+
+func (api *API) updateProfile(c context.Context, w http.ResponseWriter, req *updateProfileReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	if _, err := api.join(ch, req.Nick, req.Secret); err != nil {
+		return nil, err
+	}
+
+	u, err := ch.UpdateProfile(req.Nick, req.FullName, req.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO - Need transaction
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not update channel membership")
+	}
+
+	return h.NewResponse(u, http.StatusOK), nil
+}
+
+type changeNickReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+	NewNick string `json:"new_nick"`
+}
+
+func (r *changeNickReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if err := validateNick(r.Nick); err != nil {
+		return err
+	}
+	if err := validateNick(r.NewNick); err != nil {
+		return fmt.Errorf("new %v", err)
+	}
+	return nil
+}
+
+func (api *API) changeNick(c context.Context, w http.ResponseWriter, req *changeNickReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	if _, err := api.join(ch, req.Nick, req.Secret); err != nil {
+		return nil, err
+	}
+
+	if err := ch.ChangeNick(req.Nick, req.NewNick); err != nil {
+		return nil, err
+	}
+
+	// TODO - Need transaction
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not update channel membership")
+	}
+
+	api.store.RenameLastClientSeq(req.Nick, req.NewNick, ch.Name)
+
+	err = api.events.SendEvent(ch.Name, &broker.Event{
+		Type:    broker.EventNick,
+		Nick:    req.Nick,
+		By:      req.Nick,
+		NewNick: req.NewNick,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		// Nick change is saved, so it is reported as successful
+		log.Printf("chat api: could not broadcast nick change in channel %s: %v", ch.Name, err)
+	}
+
+	u := ch.Members[req.NewNick]
+	u.Secret = ""
+
+	return h.NewResponse(u, http.StatusOK), nil
+}
+
+type leaveReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+}
+
+func (r *leaveReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	return validateNick(r.Nick)
+}
+
+func (api *API) leave(c context.Context, w http.ResponseWriter, req *leaveReq) (*h.Response, error) {
+	ch, err := api.store.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	if _, err := api.join(ch, req.Nick, req.Secret); err != nil {
+		return nil, err
+	}
+
+	account := ch.Members[req.Nick].Account
+
+	if err := ch.Leave(req.Nick); err != nil {
+		return nil, err
+	}
+
+	// TODO - Need transaction
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not update channel membership")
+	}
+
+	if account {
+		if err := api.leaveAccount(req.Nick, ch.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	err = api.events.SendEvent(ch.Name, &broker.Event{
+		Type: broker.EventLeave,
+		Nick: req.Nick,
+		By:   req.Nick,
+		Time: time.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not broadcast leave")
+	}
+
+	return h.NewResponse(nil, http.StatusOK), nil
+}
+
+type adminInviteReq struct {
+	Channel string `json:"channel"`
+	Role    string `json:"role"`
+	MaxUses int    `json:"max_uses"`
+	TTL     int64  `json:"ttl"` // Invite validity in seconds
+}
+
+func (r *adminInviteReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	return validateInvite(r.Role, r.MaxUses, r.TTL)
+}
+
+func (api *API) adminCreateInvite(c context.Context, w http.ResponseWriter, req *adminInviteReq) (*h.Response, error) {
+	return api.newInvite(req.Channel, "", "", req.Role, req.MaxUses, req.TTL)
+}
+
+type inviteReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+	Role    string `json:"role"`
+	MaxUses int    `json:"max_uses"`
+	TTL     int64  `json:"ttl"` // Invite validity in seconds
+}
+
+func (r *inviteReq) Validate() error {
+	if r.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(r.Channel) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	if r.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if err := validateNick(r.Nick); err != nil {
+		return err
+	}
+	return validateInvite(r.Role, r.MaxUses, r.TTL)
+}
+
+func (api *API) createInvite(c context.Context, w http.ResponseWriter, req *inviteReq) (*h.Response, error) {
+	return api.newInvite(req.Channel, req.Nick, req.Secret, req.Role, req.MaxUses, req.TTL)
+}
+
+// newInvite creates chat invite on behalf of nick,
+// or on behalf of chat administrator if nick is empty
+func (api *API) newInvite(channel, nick, secret, r string, maxUses int, ttl int64) (*h.Response, error) {
+	ch, err := api.store.Get(channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	var by *User
+
+	if nick != "" {
+		by, err = api.join(ch, nick, secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	role := RoleMember
+	if r != "" {
+		role = Role(r)
+	}
+
+	if maxUses == 0 {
+		maxUses = 1
+	}
+
+	expires := time.Now().Add(defInviteTTL)
+	if ttl > 0 {
+		expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	inv, err := ch.CreateInvite(by, role, maxUses, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO - Need transaction
+	err = api.store.Save(ch)
+	if err != nil {
+		return nil, fmt.Errorf("could not store invite")
+	}
+
+	return h.NewResponse(inv, http.StatusOK), nil
+}
+
+func validateInvite(role string, maxUses int, ttl int64) error {
+	if role != "" {
+		if _, err := ParseRole(role); err != nil {
+			return fmt.Errorf("role must be one of: owner, moderator, member, guest")
+		}
+	}
+	if maxUses < 0 {
+		return fmt.Errorf("max_uses must not be negative")
+	}
+	if ttl < 0 || ttl > int64(maxInviteTTL/time.Second) {
+		return fmt.Errorf("ttl must be between 0 and %d seconds", int64(maxInviteTTL/time.Second))
+	}
+	return nil
+}
+
+// join authenticates nick with chat using account or per chat member credentials
+func (api *API) join(ch *Chat, nick, secret string) (*User, error) {
+	acc, err := api.store.GetAccount(nick)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch account")
+	}
+	return ch.Authenticate(acc, nick, secret)
+}
+
+func validateSecret(secret string) error {
+	if len(secret) < minNickSecretLen || len(secret) > maxNickSecretLen {
+		return fmt.Errorf("secret should be between %d and %d characters long", minNickSecretLen, maxNickSecretLen)
+	}
+	if match, err := regexp.Match("^[a-zA-Z0-9_]*$", []byte(secret)); !match || err != nil {
+		return fmt.Errorf("secret must contain only alphanumeric and underscores")
+	}
+	return nil
+}
+
+func validateNick(nick string) error {
+	if nick == "" {
+		return fmt.Errorf("nick is required")
+	}
+	if len(nick) < minNickLen || len(nick) > maxNickLen {
+		return fmt.Errorf("nick must be between %d and %d characters long", minNickLen, maxNickLen)
+	}
+	if match, err := regexp.Match("^[a-zA-Z0-9_]*$", []byte(nick)); !match || err != nil {
+		return fmt.Errorf("nick must contain only alphanumeric and underscores")
+	}
+	return nil
+}
+
 func (api *API) listChannels(c context.Context, w http.ResponseWriter, r *http.Request) {
 	chans, err := api.store.ListChannels()
 	if err != nil {
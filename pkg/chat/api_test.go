@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/tonto/gossip/pkg/broker"
 	"github.com/tonto/gossip/pkg/chat"
 	h "github.com/tonto/kit/http"
 )
@@ -36,6 +39,7 @@ func TestCreateChannel(t *testing.T) {
 		username string
 		password string
 		store    *store
+		events   *events
 		req      createChanReq
 		want     *createChanResp
 		wantErr  bool
@@ -121,13 +125,31 @@ func TestCreateChannel(t *testing.T) {
 			wantErr:  true,
 			wantCode: http.StatusInternalServerError,
 		},
+		{
+			store: &store{
+				SaveFunc: func(c *chat.Chat) error {
+					return nil
+				},
+			},
+			events:   &events{err: fmt.Errorf("nats down")},
+			name:     "test announce error",
+			req:      createChanReq{Name: "general"},
+			username: "admin",
+			password: "test",
+			wantErr:  false,
+			wantCode: http.StatusOK,
+		},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
+			if tc.events == nil {
+				tc.events = &events{}
+			}
+
 			var handler h.HandlerFunc
 			{
-				api := chat.NewAPI(tc.store, "admin", "test")
+				api := chat.NewAPI(tc.store, tc.events, "admin", "test")
 				api.Prefix() // only for coverage
 				for path, ep := range api.Endpoints() {
 					if path == "/admin/create_channel" {
@@ -164,6 +186,10 @@ func TestCreateChannel(t *testing.T) {
 					t.Errorf("unexpected err response. want: %v, got: %+v", tc.wantErr, resp.Errors)
 				}
 			}
+
+			if rw.Code == http.StatusOK && tc.events.err == nil && !reflect.DeepEqual(tc.events.announced, []string{tc.req.Name}) {
+				t.Errorf("channel not announced. got: %v", tc.events.announced)
+			}
 		})
 	}
 }
@@ -175,10 +201,12 @@ type registerNickReq struct {
 	Secret        string `json:"secret"`
 	Channel       string `json:"channel"`
 	ChannelSecret string `json:"channel_secret"` // Tennant
+	Invite        string `json:"invite"`
 }
 
 type registerNickResp struct {
-	Secret string `json:"secret"`
+	Secret string   `json:"secret"`
+	Failed []string `json:"failed_channels"`
 }
 
 func TestRegisterNick(t *testing.T) {
@@ -189,6 +217,7 @@ func TestRegisterNick(t *testing.T) {
 		wantErr  bool
 		wantCode int
 		want     string
+		eventErr error
 	}{
 		{
 			name:     "test req channel validation",
@@ -347,15 +376,64 @@ func TestRegisterNick(t *testing.T) {
 			wantErr:  false,
 			wantCode: http.StatusOK,
 		},
+		{
+			store: &store{
+				GetFunc: func(id string) (*chat.Chat, error) {
+					return chat.NewChannel("foo", true), nil
+				},
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test invalid invite",
+			req:      registerNickReq{Nick: "joe", Channel: "foo", Invite: "xxxyyy"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc: func(id string) (*chat.Chat, error) {
+					ch := chat.NewChannel("foo", true)
+					ch.Invites["xxxyyy"] = chat.Invite{Token: "xxxyyy", Role: chat.RoleGuest, MaxUses: 1, Expires: time.Now().Add(time.Hour)}
+					return ch, nil
+				},
+				SaveFunc: func(ch *chat.Chat) error {
+					if ch.Members["joe"].Role != chat.RoleGuest {
+						return fmt.Errorf("invite role not assigned")
+					}
+					if _, ok := ch.Invites["xxxyyy"]; ok {
+						return fmt.Errorf("invite not used up")
+					}
+					return nil
+				},
+			},
+			name:     "test saved with invite",
+			req:      registerNickReq{Nick: "joe", Channel: "foo", Invite: "xxxyyy"},
+			wantErr:  false,
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc: func(id string) (*chat.Chat, error) {
+					return chat.NewChannel("foo", false), nil
+				},
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test join broadcast error",
+			req:      registerNickReq{Nick: "joe", Channel: "foo"},
+			wantErr:  false,
+			wantCode: http.StatusOK,
+			eventErr: fmt.Errorf("nats down"),
+		},
 
 		// TODO - Test server username/pass (empty/nonempty)
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
+			ev := events{err: tc.eventErr}
+
 			var handler h.HandlerFunc
 			{
-				api := chat.NewAPI(tc.store, "admin", "test")
+				api := chat.NewAPI(tc.store, &ev, "admin", "test")
 				for path, ep := range api.Endpoints() {
 					if path == "/register_nick" {
 						handler = ep.Handler
@@ -398,6 +476,10 @@ func TestRegisterNick(t *testing.T) {
 				if got.Secret == "" {
 					t.Errorf("unexpected response. want nonempty secret")
 				}
+
+				if tc.eventErr == nil && (len(ev.sent) != 1 || ev.sent[0].Type != broker.EventJoin || ev.sent[0].Nick != tc.req.Nick) {
+					t.Errorf("join not broadcast. got: %+v", ev.sent)
+				}
 			}
 		})
 	}
@@ -495,7 +577,7 @@ func TestChannelMembers(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			var handler h.HandlerFunc
 			{
-				api := chat.NewAPI(tc.store, "admin", "test")
+				api := chat.NewAPI(tc.store, &events{}, "admin", "test")
 				for path, ep := range api.Endpoints() {
 					if path == "/channel_members" {
 						handler = ep.Handler
@@ -582,7 +664,7 @@ func TestListChannels(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			var handler h.HandlerFunc
 			{
-				api := chat.NewAPI(tc.store, "admin", "test")
+				api := chat.NewAPI(tc.store, &events{}, "admin", "test")
 				for path, ep := range api.Endpoints() {
 					if path == "/list_channels" {
 						handler = ep.Handler
@@ -626,28 +708,1150 @@ func TestListChannels(t *testing.T) {
 	}
 }
 
-func reqBody(t *testing.T, i interface{}) io.Reader {
-	data, err := json.Marshal(i)
-	if err != nil {
-		t.Fatalf("json encode err: %v", err)
-	}
-	return bytes.NewReader(data)
+type roleReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+	Target  string `json:"target"`
+	Role    string `json:"role"`
 }
 
-func respBody(t *testing.T, r io.Reader, v interface{}) {
-	err := json.NewDecoder(r).Decode(v)
-	if err != nil {
-		t.Fatalf("json encode err: %v", err)
+func TestGrantRole(t *testing.T) {
+	newChan := func(id string) (*chat.Chat, error) {
+		return &chat.Chat{
+			Name: "foo",
+			Members: map[string]chat.User{
+				"own": {Nick: "own", Secret: "ownsecret", Role: chat.RoleOwner},
+				"mod": {Nick: "mod", Secret: "modsecret", Role: chat.RoleModerator},
+				"joe": {Nick: "joe", Secret: "joesecret", Role: chat.RoleMember},
+			},
+		}, nil
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		admin    bool
+		store    *store
+		req      roleReq
+		want     chat.Role
+		wantErr  bool
+		wantCode int
+	}{
+		{
+			name:     "test req channel validation",
+			path:     "/grant_role",
+			req:      roleReq{Nick: "own", Secret: "ownsecret", Target: "joe", Role: "moderator"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req target validation",
+			path:     "/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "own", Secret: "ownsecret", Role: "moderator"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req secret validation",
+			path:     "/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "own", Target: "joe", Role: "moderator"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test invalid role",
+			path:     "/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "own", Secret: "ownsecret", Target: "joe", Role: "king"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test invalid secret",
+			path:     "/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "own", Secret: "xxxxx", Target: "joe", Role: "moderator"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test insufficient permissions",
+			path:     "/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Role: "moderator"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return fmt.Errorf("unable to save") },
+			},
+			name:     "test save failed",
+			path:     "/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "own", Secret: "ownsecret", Target: "joe", Role: "moderator"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test owner grant",
+			path:     "/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "own", Secret: "ownsecret", Target: "joe", Role: "moderator"},
+			want:     chat.RoleModerator,
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test owner revoke",
+			path:     "/revoke_role",
+			req:      roleReq{Channel: "foo", Nick: "own", Secret: "ownsecret", Target: "mod"},
+			want:     chat.RoleMember,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test admin invalid creds",
+			path:     "/admin/grant_role",
+			req:      roleReq{Channel: "foo", Nick: "joe", Role: "owner"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test admin grant",
+			path:     "/admin/grant_role",
+			admin:    true,
+			req:      roleReq{Channel: "foo", Nick: "joe", Role: "owner"},
+			want:     chat.RoleOwner,
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test admin revoke",
+			path:     "/admin/revoke_role",
+			admin:    true,
+			req:      roleReq{Channel: "foo", Nick: "own"},
+			want:     chat.RoleMember,
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var handler h.HandlerFunc
+			{
+				api := chat.NewAPI(tc.store, &events{}, "admin", "test")
+				for path, ep := range api.Endpoints() {
+					if path == tc.path {
+						handler = ep.Handler
+					}
+				}
+			}
+
+			req, _ := http.NewRequest("POST", tc.path, reqBody(t, tc.req))
+			if tc.admin {
+				req.SetBasicAuth("admin", "test")
+			}
+			rw := httptest.NewRecorder()
+
+			handler(context.Background(), rw, req)
+
+			var resp response
+			{
+				if rw.Code != tc.wantCode {
+					t.Errorf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+				}
+
+				if rw.Code == http.StatusUnauthorized {
+					return
+				}
+
+				respBody(t, rw.Body, &resp)
+				if tc.wantErr != (resp.Errors != nil) {
+					t.Errorf("unexpected err response. want: %v, got: %+v", tc.wantErr, resp.Errors)
+					return
+				}
+
+				if rw.Code != http.StatusOK {
+					return
+				}
+
+				var got chat.Role
+				json.Unmarshal(resp.Data, &got)
+				if got != tc.want {
+					t.Errorf("unexpected response. want: %v, got: %v", tc.want, got)
+				}
+			}
+		})
 	}
 }
 
-type store struct {
-	SaveFunc      func(*chat.Chat) error
-	GetFunc       func(string) (*chat.Chat, error)
-	ListChansFunc func() ([]string, error)
+type moderateReq struct {
+	Channel  string `json:"channel"`
+	Nick     string `json:"nick"`
+	Secret   string `json:"secret"`
+	Target   string `json:"target"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	Duration int64  `json:"duration"`
 }
 
-func (s *store) Save(c *chat.Chat) error              { return s.SaveFunc(c) }
-func (s *store) Get(id string) (*chat.Chat, error)    { return s.GetFunc(id) }
-func (s *store) ListChannels() ([]string, error)      { return s.ListChansFunc() }
-func (s *store) GetUnreadCount(string, string) uint64 { panic("not implemented") }
+func TestModerate(t *testing.T) {
+	newChan := func(id string) (*chat.Chat, error) {
+		return &chat.Chat{
+			Name: "foo",
+			Members: map[string]chat.User{
+				"mod": {Nick: "mod", Secret: "modsecret", Role: chat.RoleModerator},
+				"joe": {Nick: "joe", Secret: "joesecret", Role: chat.RoleMember, Email: "joe@mail"},
+				"bob": {Nick: "bob", Secret: "bobsecret", Role: chat.RoleMember},
+			},
+		}, nil
+	}
+
+	cases := []struct {
+		name      string
+		path      string
+		admin     bool
+		store     *store
+		events    *events
+		req       moderateReq
+		wantSaved bool
+		wantErr   bool
+		wantCode  int
+	}{
+		{
+			name:     "test req action validation",
+			path:     "/moderate",
+			req:      moderateReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Action: "slap"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req duration validation",
+			path:     "/moderate",
+			req:      moderateReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Action: "mute", Duration: -1},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req duration overflow",
+			path:     "/moderate",
+			req:      moderateReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Action: "mute", Duration: math.MaxInt64 / 1000},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test insufficient permissions",
+			path:     "/moderate",
+			req:      moderateReq{Channel: "foo", Nick: "bob", Secret: "bobsecret", Target: "joe", Action: "kick"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test kick",
+			path:     "/moderate",
+			req:      moderateReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Action: "kick"},
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:      "test ban",
+			path:      "/moderate",
+			req:       moderateReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Action: "ban", Reason: "spam"},
+			wantSaved: true,
+			wantCode:  http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:      "test admin mute",
+			path:      "/admin/moderate",
+			admin:     true,
+			req:       moderateReq{Channel: "foo", Nick: "mod", Action: "mute", Duration: 60},
+			wantSaved: true,
+			wantCode:  http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:   newChan,
+				SaveFunc:  func(ch *chat.Chat) error { return nil },
+				ModLogErr: fmt.Errorf("redis down"),
+			},
+			name:     "test moderation log error",
+			path:     "/moderate",
+			req:      moderateReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Action: "mute"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			events:   &events{err: fmt.Errorf("nats down")},
+			name:     "test broadcast error",
+			path:     "/moderate",
+			req:      moderateReq{Channel: "foo", Nick: "mod", Secret: "modsecret", Target: "joe", Action: "mute"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.events == nil {
+				tc.events = &events{}
+			}
+
+			var saved bool
+			if tc.store != nil && tc.store.SaveFunc != nil {
+				save := tc.store.SaveFunc
+				tc.store.SaveFunc = func(ch *chat.Chat) error { saved = true; return save(ch) }
+			}
+
+			var handler h.HandlerFunc
+			{
+				api := chat.NewAPI(tc.store, tc.events, "admin", "test")
+				for path, ep := range api.Endpoints() {
+					if path == tc.path {
+						handler = ep.Handler
+					}
+				}
+			}
+
+			req, _ := http.NewRequest("POST", tc.path, reqBody(t, tc.req))
+			if tc.admin {
+				req.SetBasicAuth("admin", "test")
+			}
+			rw := httptest.NewRecorder()
+
+			handler(context.Background(), rw, req)
+
+			var resp response
+			{
+				if rw.Code != tc.wantCode {
+					t.Errorf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+				}
+
+				respBody(t, rw.Body, &resp)
+				if tc.wantErr != (resp.Errors != nil) {
+					t.Errorf("unexpected err response. want: %v, got: %+v", tc.wantErr, resp.Errors)
+					return
+				}
+
+				if rw.Code != http.StatusOK {
+					return
+				}
+
+				if saved != tc.wantSaved {
+					t.Errorf("unexpected channel save. want: %v, got: %v", tc.wantSaved, saved)
+				}
+
+				if len(tc.store.ModLog) != 1 || len(tc.events.sent) != 1 {
+					t.Fatalf("moderation action not recorded and broadcast. log: %v, sent: %v", tc.store.ModLog, tc.events.sent)
+				}
+
+				if string(tc.events.sent[0].Type) != tc.req.Action {
+					t.Errorf("unexpected event type. want: %v, got: %v", tc.req.Action, tc.events.sent[0].Type)
+				}
+			}
+		})
+	}
+}
+
+type rotateSecretReq struct {
+	Channel   string `json:"channel"`
+	Nick      string `json:"nick"`
+	Secret    string `json:"secret"`
+	NewSecret string `json:"new_secret"`
+}
+
+func TestRotateSecret(t *testing.T) {
+	newChan := func(id string) (*chat.Chat, error) {
+		return &chat.Chat{
+			Name:   "foo",
+			Secret: "chansecret",
+			Members: map[string]chat.User{
+				"joe": {Nick: "joe", Secret: "joesecret"},
+			},
+		}, nil
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		admin    bool
+		store    *store
+		req      rotateSecretReq
+		eventErr error
+		want     string
+		wantErr  bool
+		wantCode int
+	}{
+		{
+			name:     "test req secret validation",
+			path:     "/rotate_secret",
+			req:      rotateSecretReq{Channel: "foo", Nick: "joe"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req new secret validation",
+			path:     "/rotate_secret",
+			req:      rotateSecretReq{Channel: "foo", Nick: "joe", Secret: "joesecret", NewSecret: "a b"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test invalid old secret",
+			path:     "/rotate_secret",
+			req:      rotateSecretReq{Channel: "foo", Nick: "joe", Secret: "xxxxx"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test rotate custom secret",
+			path:     "/rotate_secret",
+			req:      rotateSecretReq{Channel: "foo", Nick: "joe", Secret: "joesecret", NewSecret: "newsecret"},
+			want:     "newsecret",
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test rotate generated secret",
+			path:     "/rotate_secret",
+			req:      rotateSecretReq{Channel: "foo", Nick: "joe", Secret: "joesecret"},
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test admin reset",
+			path:     "/admin/reset_secret",
+			admin:    true,
+			req:      rotateSecretReq{Channel: "foo", Nick: "joe"},
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test admin reset broadcast error",
+			path:     "/admin/reset_secret",
+			admin:    true,
+			req:      rotateSecretReq{Channel: "foo", Nick: "joe"},
+			eventErr: fmt.Errorf("nats down"),
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test admin rotate channel secret",
+			path:     "/admin/rotate_channel_secret",
+			admin:    true,
+			req:      rotateSecretReq{Channel: "foo"},
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ev := events{err: tc.eventErr}
+
+			var handler h.HandlerFunc
+			{
+				api := chat.NewAPI(tc.store, &ev, "admin", "test")
+				for path, ep := range api.Endpoints() {
+					if path == tc.path {
+						handler = ep.Handler
+					}
+				}
+			}
+
+			req, _ := http.NewRequest("POST", tc.path, reqBody(t, tc.req))
+			if tc.admin {
+				req.SetBasicAuth("admin", "test")
+			}
+			rw := httptest.NewRecorder()
+
+			handler(context.Background(), rw, req)
+
+			var resp response
+			{
+				if rw.Code != tc.wantCode {
+					t.Errorf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+				}
+
+				respBody(t, rw.Body, &resp)
+				if tc.wantErr != (resp.Errors != nil) {
+					t.Errorf("unexpected err response. want: %v, got: %+v", tc.wantErr, resp.Errors)
+					return
+				}
+
+				if rw.Code != http.StatusOK {
+					return
+				}
+
+				var got registerNickResp
+				json.Unmarshal(resp.Data, &got)
+
+				if got.Secret == "" || got.Secret == "joesecret" || got.Secret == "chansecret" {
+					t.Errorf("secret not rotated. got: %s", got.Secret)
+				}
+
+				if tc.want != "" && got.Secret != tc.want {
+					t.Errorf("unexpected secret. want: %s, got: %s", tc.want, got.Secret)
+				}
+
+				if tc.path == "/admin/rotate_channel_secret" {
+					return
+				}
+
+				if tc.eventErr != nil {
+					if !reflect.DeepEqual(got.Failed, []string{"foo"}) {
+						t.Errorf("unexpected failed channels: %v", got.Failed)
+					}
+					return
+				}
+
+				if len(ev.sent) != 1 || ev.sent[0].Type != broker.EventSecret || ev.sent[0].Nick != "joe" {
+					t.Errorf("sessions not invalidated. sent: %+v", ev.sent)
+				}
+			}
+		})
+	}
+}
+
+type inviteReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+	Role    string `json:"role"`
+	MaxUses int    `json:"max_uses"`
+	TTL     int64  `json:"ttl"`
+}
+
+func TestCreateInvite(t *testing.T) {
+	newChan := func(id string) (*chat.Chat, error) {
+		ch := chat.NewChannel("foo", true)
+		ch.Members["own"] = chat.User{Nick: "own", Secret: "ownsecret", Role: chat.RoleOwner}
+		ch.Members["mod"] = chat.User{Nick: "mod", Secret: "modsecret", Role: chat.RoleModerator}
+		return ch, nil
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		admin    bool
+		store    *store
+		req      inviteReq
+		want     chat.Invite
+		wantErr  bool
+		wantCode int
+	}{
+		{
+			name:     "test req role validation",
+			path:     "/create_invite",
+			req:      inviteReq{Channel: "foo", Nick: "own", Secret: "ownsecret", Role: "king"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req ttl validation",
+			path:     "/create_invite",
+			req:      inviteReq{Channel: "foo", Nick: "own", Secret: "ownsecret", TTL: 100 * 24 * 3600},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req ttl overflow",
+			path:     "/create_invite",
+			req:      inviteReq{Channel: "foo", Nick: "own", Secret: "ownsecret", TTL: math.MaxInt64 / 100},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test insufficient permissions",
+			path:     "/create_invite",
+			req:      inviteReq{Channel: "foo", Nick: "mod", Secret: "modsecret"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test owner invite defaults",
+			path:     "/create_invite",
+			req:      inviteReq{Channel: "foo", Nick: "own", Secret: "ownsecret"},
+			want:     chat.Invite{Role: chat.RoleMember, MaxUses: 1, By: "own"},
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test admin invite",
+			path:     "/admin/create_invite",
+			admin:    true,
+			req:      inviteReq{Channel: "foo", Role: "moderator", MaxUses: 5, TTL: 60},
+			want:     chat.Invite{Role: chat.RoleModerator, MaxUses: 5},
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var handler h.HandlerFunc
+			{
+				api := chat.NewAPI(tc.store, &events{}, "admin", "test")
+				for path, ep := range api.Endpoints() {
+					if path == tc.path {
+						handler = ep.Handler
+					}
+				}
+			}
+
+			req, _ := http.NewRequest("POST", tc.path, reqBody(t, tc.req))
+			if tc.admin {
+				req.SetBasicAuth("admin", "test")
+			}
+			rw := httptest.NewRecorder()
+
+			handler(context.Background(), rw, req)
+
+			var resp response
+			{
+				if rw.Code != tc.wantCode {
+					t.Errorf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+				}
+
+				respBody(t, rw.Body, &resp)
+				if tc.wantErr != (resp.Errors != nil) {
+					t.Errorf("unexpected err response. want: %v, got: %+v", tc.wantErr, resp.Errors)
+					return
+				}
+
+				if rw.Code != http.StatusOK {
+					return
+				}
+
+				var got chat.Invite
+				json.Unmarshal(resp.Data, &got)
+
+				if got.Token == "" || !got.Expires.After(time.Now()) {
+					t.Errorf("invalid invite token or expiry: %+v", got)
+				}
+
+				if got.Role != tc.want.Role || got.MaxUses != tc.want.MaxUses || got.By != tc.want.By {
+					t.Errorf("unexpected invite. want: %+v, got: %+v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+type changeNickReq struct {
+	Channel string `json:"channel"`
+	Nick    string `json:"nick"`
+	Secret  string `json:"secret"`
+	NewNick string `json:"new_nick"`
+	Email   string `json:"email"`
+}
+
+func TestMembership(t *testing.T) {
+	newChan := func(id string) (*chat.Chat, error) {
+		return &chat.Chat{
+			Name: "foo",
+			Members: map[string]chat.User{
+				"joe": {Nick: "joe", Secret: "joesecret"},
+				"bob": {Nick: "bob", Secret: "bobsecret"},
+			},
+		}, nil
+	}
+
+	cases := []struct {
+		name      string
+		path      string
+		store     *store
+		req       changeNickReq
+		eventErr  error
+		wantEvent broker.EventT
+		wantErr   bool
+		wantCode  int
+	}{
+		{
+			name:     "test req new nick validation",
+			path:     "/change_nick",
+			req:      changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret", NewNick: "j"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test req email validation",
+			path:     "/update_profile",
+			req:      changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret", Email: "qwertyuiopasdfghjklvv"},
+			wantErr:  true,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test change nick invalid secret",
+			path:     "/change_nick",
+			req:      changeNickReq{Channel: "foo", Nick: "joe", Secret: "bobsecret", NewNick: "joseph"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store:    &store{GetFunc: newChan},
+			name:     "test change nick taken",
+			path:     "/change_nick",
+			req:      changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret", NewNick: "bob"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:      "test change nick",
+			path:      "/change_nick",
+			req:       changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret", NewNick: "joseph"},
+			wantEvent: broker.EventNick,
+			wantCode:  http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test change nick broadcast error",
+			path:     "/change_nick",
+			req:      changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret", NewNick: "joseph"},
+			eventErr: fmt.Errorf("nats down"),
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:     "test update profile",
+			path:     "/update_profile",
+			req:      changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret", Email: "joe@mail"},
+			wantCode: http.StatusOK,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return fmt.Errorf("unable to save") },
+			},
+			name:     "test leave save failed",
+			path:     "/leave",
+			req:      changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret"},
+			wantErr:  true,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			store: &store{
+				GetFunc:  newChan,
+				SaveFunc: func(ch *chat.Chat) error { return nil },
+			},
+			name:      "test leave",
+			path:      "/leave",
+			req:       changeNickReq{Channel: "foo", Nick: "joe", Secret: "joesecret"},
+			wantEvent: broker.EventLeave,
+			wantCode:  http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ev := events{err: tc.eventErr}
+
+			var handler h.HandlerFunc
+			{
+				api := chat.NewAPI(tc.store, &ev, "admin", "test")
+				for path, ep := range api.Endpoints() {
+					if path == tc.path {
+						handler = ep.Handler
+					}
+				}
+			}
+
+			req, _ := http.NewRequest("POST", tc.path, reqBody(t, tc.req))
+			rw := httptest.NewRecorder()
+
+			handler(context.Background(), rw, req)
+
+			if rw.Code != tc.wantCode {
+				t.Errorf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+			}
+
+			var resp response
+			respBody(t, rw.Body, &resp)
+			if tc.wantErr != (resp.Errors != nil) {
+				t.Errorf("unexpected err response. want: %v, got: %+v", tc.wantErr, resp.Errors)
+				return
+			}
+
+			if tc.wantEvent == broker.EventNick {
+				if want := tc.req.Nick + ">" + tc.req.NewNick; len(tc.store.Renamed) != 1 || tc.store.Renamed[0] != want {
+					t.Errorf("unread count not moved. want: %s, got: %v", want, tc.store.Renamed)
+				}
+			}
+
+			if tc.wantEvent == "" {
+				if len(ev.sent) != 0 {
+					t.Errorf("unexpected events sent: %+v", ev.sent)
+				}
+				return
+			}
+
+			if len(ev.sent) != 1 || ev.sent[0].Type != tc.wantEvent || ev.sent[0].Nick != tc.req.Nick {
+				t.Errorf("unexpected events sent. want: %v, got: %+v", tc.wantEvent, ev.sent)
+			}
+		})
+	}
+}
+
+type accountReq struct {
+	Nick          string `json:"nick"`
+	Secret        string `json:"secret"`
+	FullName      string `json:"name"`
+	Channel       string `json:"channel"`
+	ChannelSecret string `json:"channel_secret"`
+}
+
+func TestAccounts(t *testing.T) {
+	chans := map[string]*chat.Chat{}
+	saveErr := map[string]error{}
+	st := &store{
+		GetFunc: func(id string) (*chat.Chat, error) {
+			ch, ok := chans[id]
+			if !ok {
+				return nil, fmt.Errorf("not found")
+			}
+			cp := *ch
+			cp.Members = make(map[string]chat.User)
+			for n, u := range ch.Members {
+				cp.Members[n] = u
+			}
+			return &cp, nil
+		},
+		SaveFunc: func(ch *chat.Chat) error {
+			if err := saveErr[ch.Name]; err != nil {
+				return err
+			}
+			chans[ch.Name] = ch
+			return nil
+		},
+	}
+
+	chans["general"] = chat.NewChannel("general", false)
+	chans["private"] = chat.NewChannel("private", true)
+
+	ev := events{}
+	api := chat.NewAPI(st, &ev, "admin", "test")
+
+	call := func(path string, req accountReq) (response, int) {
+		var handler h.HandlerFunc
+		for p, ep := range api.Endpoints() {
+			if p == path {
+				handler = ep.Handler
+			}
+		}
+
+		r, _ := http.NewRequest("POST", path, reqBody(t, req))
+		rw := httptest.NewRecorder()
+
+		handler(context.Background(), rw, r)
+
+		var resp response
+		respBody(t, rw.Body, &resp)
+		return resp, rw.Code
+	}
+
+	if _, code := call("/register_account", accountReq{Nick: "joe", Secret: "joesecret"}); code != http.StatusOK {
+		t.Fatalf("unable to register account. code: %d", code)
+	}
+
+	if _, code := call("/register_account", accountReq{Nick: "joe", Secret: "othersecret"}); code == http.StatusOK {
+		t.Errorf("account nick should be unique")
+	}
+
+	st.Bots = []string{"ci"}
+
+	if _, code := call("/register_account", accountReq{Nick: "ci", Secret: "cisecret"}); code == http.StatusOK {
+		t.Errorf("bot name should be reserved")
+	}
+
+	if _, code := call("/join_channel", accountReq{Nick: "joe", Secret: "xxxxxx", Channel: "general"}); code == http.StatusOK {
+		t.Errorf("join with invalid account secret should fail")
+	}
+
+	if _, code := call("/join_channel", accountReq{Nick: "joe", Secret: "joesecret", Channel: "private"}); code == http.StatusOK {
+		t.Errorf("join private channel without channel secret should fail")
+	}
+
+	if _, code := call("/join_channel", accountReq{Nick: "joe", Secret: "joesecret", Channel: "general"}); code != http.StatusOK {
+		t.Fatalf("unable to join public channel. code: %d", code)
+	}
+
+	req := accountReq{Nick: "joe", Secret: "joesecret", Channel: "private", ChannelSecret: chans["private"].Secret}
+	if _, code := call("/join_channel", req); code != http.StatusOK {
+		t.Fatalf("unable to join private channel. code: %d", code)
+	}
+
+	if len(ev.sent) != 2 || ev.sent[0].Type != broker.EventJoin || ev.sent[1].Type != broker.EventJoin {
+		t.Errorf("joins not broadcast. got: %+v", ev.sent)
+	}
+
+	if _, code := call("/register_nick", accountReq{Nick: "joe", Channel: "general"}); code == http.StatusOK {
+		t.Errorf("per channel registration of account nick should fail")
+	}
+
+	resp, code := call("/login", accountReq{Nick: "joe", Secret: "joesecret"})
+	if code != http.StatusOK {
+		t.Fatalf("unable to login. code: %d", code)
+	}
+
+	var acc chat.Account
+	json.Unmarshal(resp.Data, &acc)
+
+	if acc.Secret != "" || !reflect.DeepEqual(acc.Channels, []string{"general", "private"}) {
+		t.Errorf("unexpected account: %+v", acc)
+	}
+
+	saveErr["private"] = fmt.Errorf("redis down")
+
+	if _, code := call("/update_account", accountReq{Nick: "joe", Secret: "joesecret", FullName: "Joe Doe"}); code == http.StatusOK {
+		t.Fatalf("account update should fail if channel can not be updated")
+	}
+
+	if st.Accounts["joe"].FullName != "" {
+		t.Errorf("account saved before all channels were updated")
+	}
+
+	delete(saveErr, "private")
+
+	st.AccountConflicts = 3
+
+	if _, code := call("/update_account", accountReq{Nick: "joe", Secret: "joesecret", FullName: "Joe Doe"}); code != http.StatusConflict {
+		t.Fatalf("account update should fail if account is repeatedly modified concurrently. code: %d", code)
+	}
+
+	st.AccountConflicts = 1
+
+	if _, code := call("/update_account", accountReq{Nick: "joe", Secret: "joesecret", FullName: "Joe Doe"}); code != http.StatusOK {
+		t.Fatalf("unable to update account. code: %d", code)
+	}
+
+	if st.Accounts["joe"].FullName != "Joe Doe" {
+		t.Errorf("account not updated")
+	}
+
+	for _, id := range []string{"general", "private"} {
+		if chans[id].Members["joe"].FullName != "Joe Doe" {
+			t.Errorf("profile not propagated to %s", id)
+		}
+	}
+
+	if _, code := call("/leave", accountReq{Nick: "joe", Secret: "joesecret", Channel: "general"}); code != http.StatusOK {
+		t.Fatalf("unable to leave channel. code: %d", code)
+	}
+
+	if got := st.Accounts["joe"].Channels; !reflect.DeepEqual(got, []string{"private"}) {
+		t.Errorf("channel not removed from account: %v", got)
+	}
+
+	resp, code = call("/rotate_secret", accountReq{Nick: "joe", Secret: "joesecret", Channel: "private"})
+	if code != http.StatusOK {
+		t.Fatalf("unable to rotate account secret. code: %d", code)
+	}
+
+	var secret registerNickResp
+	json.Unmarshal(resp.Data, &secret)
+
+	if st.Accounts["joe"].Secret != secret.Secret || chans["private"].Members["joe"].Secret != "" {
+		t.Errorf("account secret not rotated")
+	}
+	ev.err = fmt.Errorf("nats down")
+
+	resp, code = call("/rotate_secret", accountReq{Nick: "joe", Secret: secret.Secret, Channel: "private"})
+	if code != http.StatusOK {
+		t.Fatalf("account secret rotation should not fail on broadcast error. code: %d", code)
+	}
+
+	var rotated registerNickResp
+	json.Unmarshal(resp.Data, &rotated)
+
+	if rotated.Secret == "" || st.Accounts["joe"].Secret != rotated.Secret {
+		t.Errorf("rotated secret not returned: %+v", rotated)
+	}
+
+	if !reflect.DeepEqual(rotated.Failed, []string{"private"}) {
+		t.Errorf("unexpected failed channels: %v", rotated.Failed)
+	}
+
+	if _, code := call("/join_channel", accountReq{Nick: "joe", Secret: rotated.Secret, Channel: "general"}); code != http.StatusOK {
+		t.Fatalf("join should not fail on broadcast error. code: %d", code)
+	}
+
+	if got := st.Accounts["joe"].Channels; !reflect.DeepEqual(got, []string{"private", "general"}) {
+		t.Errorf("channel not added to account: %v", got)
+	}
+}
+
+func reqBody(t *testing.T, i interface{}) io.Reader {
+	data, err := json.Marshal(i)
+	if err != nil {
+		t.Fatalf("json encode err: %v", err)
+	}
+	return bytes.NewReader(data)
+}
+
+func respBody(t *testing.T, r io.Reader, v interface{}) {
+	err := json.NewDecoder(r).Decode(v)
+	if err != nil {
+		t.Fatalf("json encode err: %v", err)
+	}
+}
+
+type store struct {
+	SaveFunc      func(*chat.Chat) error
+	GetFunc       func(string) (*chat.Chat, error)
+	ListChansFunc func() ([]string, error)
+	ModLog        []broker.Event
+	ModLogErr     error
+	Accounts      map[string]*chat.Account
+	Renamed       []string
+	Bots          []string
+
+	// AccountConflicts is the number of subsequent account
+	// saves failing as if account was modified concurrently
+	AccountConflicts int
+}
+
+func (s *store) Save(c *chat.Chat) error              { return s.SaveFunc(c) }
+func (s *store) Get(id string) (*chat.Chat, error)    { return s.GetFunc(id) }
+func (s *store) ListChannels() ([]string, error)      { return s.ListChansFunc() }
+func (s *store) GetUnreadCount(string, string) uint64 { panic("not implemented") }
+
+func (s *store) RenameLastClientSeq(nick, newNick, id string) {
+	s.Renamed = append(s.Renamed, nick+">"+newNick)
+}
+
+func (s *store) AppendModerationLog(id string, e *broker.Event) error {
+	if s.ModLogErr != nil {
+		return s.ModLogErr
+	}
+	s.ModLog = append(s.ModLog, *e)
+	return nil
+}
+
+func (s *store) GetModerationLog(id string) ([]broker.Event, error) {
+	return s.ModLog, s.ModLogErr
+}
+
+func (s *store) ListAllChannels() ([]string, error) { return s.ListChansFunc() }
+
+func (s *store) GetAccount(nick string) (*chat.Account, error) {
+	acc, ok := s.Accounts[nick]
+	if !ok {
+		return nil, nil
+	}
+	cp := *acc
+	return &cp, nil
+}
+
+func (s *store) IsBot(nick string) (bool, error) {
+	for _, b := range s.Bots {
+		if b == nick {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *store) CreateAccount(acc *chat.Account) error {
+	if _, ok := s.Accounts[acc.Nick]; ok {
+		return chat.ErrConflict
+	}
+	return s.SaveAccount(acc)
+}
+
+func (s *store) SaveAccount(acc *chat.Account) error {
+	if s.Accounts == nil {
+		s.Accounts = make(map[string]*chat.Account)
+	}
+	if s.AccountConflicts > 0 {
+		s.AccountConflicts--
+		return chat.ErrConflict
+	}
+	if cur, ok := s.Accounts[acc.Nick]; ok && cur.Version != acc.Version {
+		return chat.ErrConflict
+	}
+	acc.Version++
+	cp := *acc
+	s.Accounts[acc.Nick] = &cp
+	return nil
+}
+
+type events struct {
+	sent      []broker.Event
+	announced []string
+	err       error
+}
+
+func (e *events) SendEvent(id string, ev *broker.Event) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.sent = append(e.sent, *ev)
+	return nil
+}
+
+func (e *events) AnnounceChannel(id string) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.announced = append(e.announced, id)
+	return nil
+}
@@ -1,7 +1,9 @@
 package chat
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/segmentio/ksuid"
 )
@@ -11,6 +13,8 @@ func NewChannel(name string, private bool) *Chat {
 	ch := Chat{
 		Name:    name,
 		Members: make(map[string]User),
+		Banned:  make(map[string]Ban),
+		Invites: make(map[string]Invite),
 	}
 
 	if private {
@@ -22,9 +26,45 @@ func NewChannel(name string, private bool) *Chat {
 
 // Chat represents private or channel chat
 type Chat struct {
-	Name    string          `json:"name"`
-	Secret  string          `json:"secret"`
-	Members map[string]User `json:"members"`
+	Name    string            `json:"name"`
+	Secret  string            `json:"secret"`
+	Members map[string]User   `json:"members"`
+	Banned  map[string]Ban    `json:"banned"`
+	Invites map[string]Invite `json:"invites"`
+	Bots    []string          `json:"bots,omitempty"` // Incoming webhook bot names
+	Left    map[string]Former `json:"left,omitempty"` // Members who left, keyed by nick
+
+	// Version is incremented on every save, so that stores can
+	// reject saving chat modified since it was fetched
+	Version uint64 `json:"version"`
+}
+
+// ErrConflict is returned by stores if chat or account was
+// modified concurrently, since it was fetched. It is also
+// returned when creating account with nick already taken.
+var ErrConflict = errors.New("chat: concurrent update, try again")
+
+// Invite represents chat registration invite
+type Invite struct {
+	Token   string    `json:"token"`
+	Role    Role      `json:"role"`
+	By      string    `json:"by"`
+	MaxUses int       `json:"max_uses"`
+	Uses    int       `json:"uses"`
+	Expires time.Time `json:"expires"`
+}
+
+// Ban represents banned channel member
+type Ban struct {
+	Nick   string    `json:"nick"`
+	Email  string    `json:"email"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+
+	// PreviousNicks holds nicks banned member was known by,
+	// which stay reserved after member is removed
+	PreviousNicks []string `json:"previous_nicks,omitempty"`
 }
 
 // TODO
@@ -33,30 +73,370 @@ type Chat struct {
 // Register registers user with a chat and returns secret which should
 // be stored on the client side, and used for subsequent join requests
 func (c *Chat) Register(u *User, secret string) (string, error) {
-	if _, ok := c.Members[u.Nick]; ok {
+	if c.isTaken(u.Nick) {
 		return "", fmt.Errorf("chat: this nick is already taken")
 	}
+	if c.isBanned(u) {
+		return "", fmt.Errorf("chat: this nick or email is banned from the chat")
+	}
 	u.Secret = secret
 	if secret == "" {
 		u.Secret = newSecret()
 	}
+	if u.Role == "" {
+		u.Role = RoleMember
+	}
 	c.Members[u.Nick] = *u
 	return u.Secret, nil
 }
 
+// AddBot reserves incoming webhook bot name, so that members can't
+// register or change nick to it. Bot names stay reserved once added,
+// so that messages sent by bots can't be impersonated later.
+func (c *Chat) AddBot(name string) error {
+	for _, b := range c.Bots {
+		if b == name {
+			return nil
+		}
+	}
+	if c.isTaken(name) {
+		return fmt.Errorf("chat: this nick is already taken")
+	}
+	c.Bots = append(c.Bots, name)
+	return nil
+}
+
+// Former represents member who left the chat. Nicks former member was
+// known by stay reserved, so that history is not attributed to others.
+type Former struct {
+	Nick          string   `json:"nick"`
+	Account       bool     `json:"account"`
+	PreviousNicks []string `json:"previous_nicks,omitempty"`
+}
+
 // Join attempts to join user to chat
 func (c *Chat) Join(nick, secret string) (*User, error) {
 	u, ok := c.Members[nick]
 	if !ok {
 		return nil, fmt.Errorf("chat: nick not registered")
 	}
-	if u.Secret != secret {
+	if u.Secret == "" || u.Secret != secret {
 		return nil, fmt.Errorf("chat: invalid secret")
 	}
 	u.Secret = ""
 	return &u, nil
 }
 
+// UpdateProfile updates member profile fields
+func (c *Chat) UpdateProfile(nick, fullName, email string) (*User, error) {
+	u, ok := c.Members[nick]
+	if !ok {
+		return nil, fmt.Errorf("chat: nick not registered")
+	}
+	if email != u.Email && c.isBanned(&User{Email: email}) {
+		return nil, fmt.Errorf("chat: this email is banned from the chat")
+	}
+	u.FullName = fullName
+	u.Email = email
+	c.Members[nick] = u
+	u.Secret = ""
+	return &u, nil
+}
+
+// ChangeNick renames member nick to newNick. Old nick stays reserved
+// for the member so that history messages remain attributed to them.
+func (c *Chat) ChangeNick(nick, newNick string) error {
+	u, ok := c.Members[nick]
+	if !ok {
+		return fmt.Errorf("chat: nick not registered")
+	}
+
+	if nick == newNick {
+		return nil
+	}
+
+	if u.Account {
+		return fmt.Errorf("chat: account nick can not be changed per chat")
+	}
+
+	if c.isTaken(newNick) && !u.hadNick(newNick) {
+		return fmt.Errorf("chat: this nick is already taken")
+	}
+
+	if c.isBanned(&User{Nick: newNick}) {
+		return fmt.Errorf("chat: this nick is banned from the chat")
+	}
+
+	if !u.hadNick(nick) {
+		u.PreviousNicks = append(u.PreviousNicks, nick)
+	}
+
+	u.Nick = newNick
+	delete(c.Members, nick)
+	c.Members[newNick] = u
+
+	return nil
+}
+
+// Leave unregisters member nick from chat. Member nicks stay reserved,
+// and can be taken again only by the account member rejoining the chat.
+func (c *Chat) Leave(nick string) error {
+	u, ok := c.Members[nick]
+	if !ok {
+		return fmt.Errorf("chat: nick not registered")
+	}
+	if c.Left == nil {
+		c.Left = make(map[string]Former)
+	}
+	c.Left[nick] = Former{
+		Nick:          nick,
+		Account:       u.Account,
+		PreviousNicks: u.PreviousNicks,
+	}
+	delete(c.Members, nick)
+	return nil
+}
+
+// GrantRole assigns role to a member on behalf of the user by.
+// Nil by represents chat administrator which can assign any role.
+func (c *Chat) GrantRole(by *User, nick string, role Role) error {
+	u, ok := c.Members[nick]
+	if !ok {
+		return fmt.Errorf("chat: nick not registered")
+	}
+
+	if by != nil && by.GetRole() != RoleOwner && role.level() >= by.GetRole().level() {
+		return fmt.Errorf("chat: insufficient permissions")
+	}
+
+	if err := authorize(by, &u); err != nil {
+		return err
+	}
+
+	u.Role = role
+	c.Members[nick] = u
+
+	return nil
+}
+
+// RevokeRole resets member role back to regular member
+func (c *Chat) RevokeRole(by *User, nick string) error {
+	return c.GrantRole(by, nick, RoleMember)
+}
+
+// Kick checks whether user by is allowed to disconnect member nick
+func (c *Chat) Kick(by *User, nick string) error {
+	u, ok := c.Members[nick]
+	if !ok {
+		return fmt.Errorf("chat: nick not registered")
+	}
+
+	return authorize(by, &u)
+}
+
+// Ban removes member nick from chat and prevents
+// further registrations using the same nick or email
+func (c *Chat) Ban(by *User, nick, reason string) error {
+	u, ok := c.Members[nick]
+	if !ok {
+		return fmt.Errorf("chat: nick not registered")
+	}
+
+	if err := authorize(by, &u); err != nil {
+		return err
+	}
+
+	if c.Banned == nil {
+		c.Banned = make(map[string]Ban)
+	}
+
+	b := Ban{
+		Nick:          u.Nick,
+		Email:         u.Email,
+		Reason:        reason,
+		Time:          time.Now(),
+		PreviousNicks: u.PreviousNicks,
+	}
+
+	if by != nil {
+		b.By = by.Nick
+	}
+
+	c.Banned[nick] = b
+	delete(c.Members, nick)
+
+	return nil
+}
+
+// Mute prevents member nick from sending messages until provided time.
+// Zero time lifts the mute.
+func (c *Chat) Mute(by *User, nick string, until time.Time) error {
+	u, ok := c.Members[nick]
+	if !ok {
+		return fmt.Errorf("chat: nick not registered")
+	}
+
+	if err := authorize(by, &u); err != nil {
+		return err
+	}
+
+	u.MutedUntil = until
+	c.Members[nick] = u
+
+	return nil
+}
+
+// RotateSecret generates new private chat secret
+func (c *Chat) RotateSecret() (string, error) {
+	if c.Secret == "" {
+		return "", fmt.Errorf("chat: public chat has no secret")
+	}
+	c.Secret = newSecret()
+	return c.Secret, nil
+}
+
+// ResetSecret replaces member secret with the provided one,
+// or generates a new one if secret is empty
+func (c *Chat) ResetSecret(nick, secret string) (string, error) {
+	u, ok := c.Members[nick]
+	if !ok {
+		return "", fmt.Errorf("chat: nick not registered")
+	}
+	u.Secret = secret
+	if secret == "" {
+		u.Secret = newSecret()
+	}
+	c.Members[nick] = u
+	return u.Secret, nil
+}
+
+// CreateInvite creates invite token which can be used instead of chat secret
+// to register with the chat. Registered users are assigned provided role.
+// Nil by represents chat administrator.
+func (c *Chat) CreateInvite(by *User, role Role, maxUses int, expires time.Time) (*Invite, error) {
+	if by != nil && by.GetRole() != RoleOwner {
+		return nil, fmt.Errorf("chat: insufficient permissions")
+	}
+
+	if c.Invites == nil {
+		c.Invites = make(map[string]Invite)
+	}
+
+	c.pruneInvites(time.Now())
+
+	inv := Invite{
+		Token:   newSecret(),
+		Role:    role,
+		MaxUses: maxUses,
+		Expires: expires,
+	}
+
+	if by != nil {
+		inv.By = by.Nick
+	}
+
+	c.Invites[inv.Token] = inv
+
+	return &inv, nil
+}
+
+// RedeemInvite uses up invite token and returns role it assigns.
+// Stores reject saving concurrently modified chats (ErrConflict),
+// so invite can't be redeemed more than MaxUses times.
+func (c *Chat) RedeemInvite(token string, t time.Time) (Role, error) {
+	inv, ok := c.Invites[token]
+	if !ok || !t.Before(inv.Expires) || inv.Uses >= inv.MaxUses {
+		return "", fmt.Errorf("chat: invalid or expired invite")
+	}
+
+	inv.Uses++
+
+	if inv.Uses >= inv.MaxUses {
+		delete(c.Invites, token)
+	} else {
+		c.Invites[token] = inv
+	}
+
+	return inv.Role, nil
+}
+
+func (c *Chat) pruneInvites(t time.Time) {
+	for token, inv := range c.Invites {
+		if !t.Before(inv.Expires) {
+			delete(c.Invites, token)
+		}
+	}
+}
+
+// isTaken checks whether nick is used, or was previously
+// used by any member, including banned ones
+func (c *Chat) isTaken(nick string) bool {
+	if _, ok := c.Members[nick]; ok {
+		return true
+	}
+	for _, m := range c.Members {
+		if m.hadNick(nick) {
+			return true
+		}
+	}
+	for _, b := range c.Bots {
+		if b == nick {
+			return true
+		}
+	}
+	for _, f := range c.Left {
+		if f.Nick == nick {
+			return true
+		}
+		for _, n := range f.PreviousNicks {
+			if n == nick {
+				return true
+			}
+		}
+	}
+	for _, b := range c.Banned {
+		if b.Nick == nick {
+			return true
+		}
+		for _, n := range b.PreviousNicks {
+			if n == nick {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Chat) isBanned(u *User) bool {
+	if _, ok := c.Banned[u.Nick]; ok {
+		return true
+	}
+	if u.Email == "" {
+		return false
+	}
+	for _, b := range c.Banned {
+		if b.Email == u.Email {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks whether user by is allowed to manage user u.
+// Nil by represents chat administrator.
+func authorize(by *User, u *User) error {
+	if by == nil {
+		return nil
+	}
+	if !by.CanModerate() {
+		return fmt.Errorf("chat: insufficient permissions")
+	}
+	if by.GetRole() != RoleOwner && u.GetRole().level() >= by.GetRole().level() {
+		return fmt.Errorf("chat: insufficient permissions")
+	}
+	return nil
+}
+
 func newSecret() string {
 	return ksuid.New().String()
 }
@@ -3,6 +3,7 @@ package chat_test
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/tonto/gossip/pkg/chat"
 )
@@ -235,3 +236,480 @@ func TestChannelJoin(t *testing.T) {
 		})
 	}
 }
+
+func TestChannelGrantRole(t *testing.T) {
+	members := func() map[string]chat.User {
+		return map[string]chat.User{
+			"own": chat.User{Nick: "own", Role: chat.RoleOwner},
+			"mod": chat.User{Nick: "mod", Role: chat.RoleModerator},
+			"foo": chat.User{Nick: "foo", Role: chat.RoleMember},
+			"bar": chat.User{Nick: "bar"},
+			"gst": chat.User{Nick: "gst", Role: chat.RoleGuest},
+		}
+	}
+
+	cases := []struct {
+		name    string
+		by      string
+		nick    string
+		role    chat.Role
+		wantErr bool
+	}{
+		{
+			name: "test admin grant owner",
+			nick: "foo",
+			role: chat.RoleOwner,
+		},
+		{
+			name: "test owner grant moderator",
+			by:   "own",
+			nick: "foo",
+			role: chat.RoleModerator,
+		},
+		{
+			name: "test owner demote moderator",
+			by:   "own",
+			nick: "mod",
+			role: chat.RoleGuest,
+		},
+		{
+			name: "test moderator mute member",
+			by:   "mod",
+			nick: "bar",
+			role: chat.RoleGuest,
+		},
+		{
+			name:    "test moderator grant moderator",
+			by:      "mod",
+			nick:    "foo",
+			role:    chat.RoleModerator,
+			wantErr: true,
+		},
+		{
+			name:    "test moderator demote owner",
+			by:      "mod",
+			nick:    "own",
+			role:    chat.RoleMember,
+			wantErr: true,
+		},
+		{
+			name:    "test member grant",
+			by:      "foo",
+			nick:    "gst",
+			role:    chat.RoleMember,
+			wantErr: true,
+		},
+		{
+			name:    "test nick not registered",
+			by:      "own",
+			nick:    "baz",
+			role:    chat.RoleMember,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ch := chat.Chat{Members: members()}
+
+			var by *chat.User
+			if tc.by != "" {
+				u := ch.Members[tc.by]
+				by = &u
+			}
+
+			err := ch.GrantRole(by, tc.nick, tc.role)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+
+			if tc.wantErr {
+				return
+			}
+
+			if ch.Members[tc.nick].Role != tc.role {
+				t.Errorf("role not granted. want: %v, got: %v", tc.role, ch.Members[tc.nick].Role)
+			}
+		})
+	}
+}
+
+func TestUserPermissions(t *testing.T) {
+	cases := []struct {
+		role         chat.Role
+		wantSend     bool
+		wantModerate bool
+	}{
+		{role: chat.RoleOwner, wantSend: true, wantModerate: true},
+		{role: chat.RoleModerator, wantSend: true, wantModerate: true},
+		{role: chat.RoleMember, wantSend: true, wantModerate: false},
+		{role: "", wantSend: true, wantModerate: false},
+		{role: chat.RoleGuest, wantSend: false, wantModerate: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(string(tc.role), func(t *testing.T) {
+			u := chat.User{Nick: "foo", Role: tc.role}
+			if u.CanSend() != tc.wantSend {
+				t.Errorf("CanSend = %v, want %v", u.CanSend(), tc.wantSend)
+			}
+			if u.CanModerate() != tc.wantModerate {
+				t.Errorf("CanModerate = %v, want %v", u.CanModerate(), tc.wantModerate)
+			}
+		})
+	}
+}
+
+func TestChannelBan(t *testing.T) {
+	ch := chat.NewChannel("general", false)
+
+	mod := chat.User{Nick: "mod", Role: chat.RoleModerator}
+	if _, err := ch.Register(&mod, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	joe := chat.User{Nick: "joseph", Email: "joe@mail"}
+	if _, err := ch.Register(&joe, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.ChangeNick("joseph", "joe"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.Ban(&joe, "mod", "coup"); err == nil {
+		t.Fatalf("member should not be able to ban moderator")
+	}
+
+	if err := ch.Ban(&mod, "joe", "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ch.Members["joe"]; ok {
+		t.Errorf("banned user should be removed from members")
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "joe"}, ""); err == nil {
+		t.Errorf("banned nick should not be able to register")
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "joseph"}, ""); err == nil {
+		t.Errorf("previous nick of banned member should stay reserved")
+	}
+
+	if err := ch.ChangeNick("mod", "joseph"); err == nil {
+		t.Errorf("previous nick of banned member should not be taken")
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "joe2", Email: "joe@mail"}, ""); err == nil {
+		t.Errorf("banned email should not be able to register")
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "bob"}, ""); err != nil {
+		t.Errorf("unexpected register error: %v", err)
+	}
+}
+
+func TestChannelMute(t *testing.T) {
+	ch := chat.Chat{
+		Members: map[string]chat.User{
+			"mod": chat.User{Nick: "mod", Role: chat.RoleModerator},
+			"joe": chat.User{Nick: "joe"},
+		},
+	}
+
+	mod := ch.Members["mod"]
+	until := time.Now().Add(time.Minute)
+
+	if err := ch.Mute(&mod, "joe", until); err != nil {
+		t.Fatal(err)
+	}
+
+	joe := ch.Members["joe"]
+	if !joe.IsMuted(time.Now()) {
+		t.Errorf("user should be muted")
+	}
+
+	if joe.IsMuted(until.Add(time.Second)) {
+		t.Errorf("mute should expire")
+	}
+
+	if err := ch.Mute(&mod, "joe", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	joe = ch.Members["joe"]
+	if joe.IsMuted(time.Now()) {
+		t.Errorf("mute should be lifted")
+	}
+}
+
+func TestChannelRotateSecret(t *testing.T) {
+	public := chat.NewChannel("general", false)
+	if _, err := public.RotateSecret(); err == nil {
+		t.Errorf("public channel secret should not be rotated")
+	}
+
+	private := chat.NewChannel("general", true)
+	old := private.Secret
+
+	secret, err := private.RotateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secret == old || private.Secret != secret {
+		t.Errorf("secret not rotated. old: %s, new: %s", old, private.Secret)
+	}
+}
+
+func TestChannelResetSecret(t *testing.T) {
+	ch := chat.Chat{
+		Members: map[string]chat.User{
+			"joe": chat.User{Nick: "joe", Secret: "oldsecret"},
+		},
+	}
+
+	if _, err := ch.ResetSecret("bob", ""); err == nil {
+		t.Errorf("expected error for unregistered nick")
+	}
+
+	secret, err := ch.ResetSecret("joe", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secret == "" || secret == "oldsecret" {
+		t.Errorf("secret not generated. got: %s", secret)
+	}
+
+	if _, err := ch.Join("joe", "oldsecret"); err == nil {
+		t.Errorf("old secret should be invalidated")
+	}
+
+	secret, err = ch.ResetSecret("joe", "newsecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.Join("joe", secret); err != nil || secret != "newsecret" {
+		t.Errorf("custom secret not set. got: %s, err: %v", secret, err)
+	}
+}
+
+func TestChannelInvite(t *testing.T) {
+	ch := chat.NewChannel("general", true)
+
+	own := chat.User{Nick: "own", Role: chat.RoleOwner}
+	mod := chat.User{Nick: "mod", Role: chat.RoleModerator}
+
+	if _, err := ch.CreateInvite(&mod, chat.RoleMember, 1, time.Now().Add(time.Hour)); err == nil {
+		t.Errorf("only owners should be able to create invites")
+	}
+
+	inv, err := ch.CreateInvite(&own, chat.RoleGuest, 2, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.RedeemInvite("xxx", time.Now()); err == nil {
+		t.Errorf("expected invalid invite error")
+	}
+
+	if _, err := ch.RedeemInvite(inv.Token, time.Now().Add(2*time.Hour)); err == nil {
+		t.Errorf("expected expired invite error")
+	}
+
+	for i := 0; i < 2; i++ {
+		role, err := ch.RedeemInvite(inv.Token, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role != chat.RoleGuest {
+			t.Errorf("unexpected role. want: %v, got: %v", chat.RoleGuest, role)
+		}
+	}
+
+	if _, err := ch.RedeemInvite(inv.Token, time.Now()); err == nil {
+		t.Errorf("expected invite usage limit error")
+	}
+
+	expired, err := ch.CreateInvite(nil, chat.RoleMember, 1, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.CreateInvite(nil, chat.RoleMember, 1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ch.Invites[expired.Token]; ok {
+		t.Errorf("expired invites should be pruned")
+	}
+}
+
+func TestChannelAddBot(t *testing.T) {
+	ch := chat.NewChannel("general", false)
+
+	if _, err := ch.Register(&chat.User{Nick: "joe"}, "joesecret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.AddBot("joe"); err == nil {
+		t.Errorf("expected nick taken error")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := ch.AddBot("ci"); err != nil {
+			t.Fatalf("unable to add bot: %v", err)
+		}
+	}
+
+	if !reflect.DeepEqual(ch.Bots, []string{"ci"}) {
+		t.Errorf("unexpected bots: %v", ch.Bots)
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "ci"}, ""); err == nil {
+		t.Errorf("bot name should be reserved")
+	}
+
+	if err := ch.ChangeNick("joe", "ci"); err == nil {
+		t.Errorf("member should not be able to change nick to bot name")
+	}
+}
+
+func TestChannelChangeNick(t *testing.T) {
+	ch := chat.NewChannel("general", false)
+
+	for _, n := range []string{"joe", "bob"} {
+		if _, err := ch.Register(&chat.User{Nick: n}, n+"secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ch.ChangeNick("joe", "bob"); err == nil {
+		t.Errorf("expected nick taken error")
+	}
+
+	if err := ch.ChangeNick("joe", "joseph"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.Join("joseph", "joesecret"); err != nil {
+		t.Errorf("unable to join with new nick: %v", err)
+	}
+
+	if _, err := ch.Join("joe", "joesecret"); err == nil {
+		t.Errorf("old nick should not be able to join")
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "joe"}, ""); err == nil {
+		t.Errorf("previous nick should stay reserved")
+	}
+
+	if err := ch.ChangeNick("bob", "joe"); err == nil {
+		t.Errorf("previous nick of other member should stay reserved")
+	}
+
+	if err := ch.ChangeNick("joseph", "joe"); err != nil {
+		t.Errorf("member should be able to take back previous nick: %v", err)
+	}
+
+	if got := ch.Members["joe"].PreviousNicks; !reflect.DeepEqual(got, []string{"joe", "joseph"}) {
+		t.Errorf("unexpected previous nicks: %v", got)
+	}
+}
+
+func TestChannelUpdateProfile(t *testing.T) {
+	ch := chat.Chat{
+		Members: map[string]chat.User{
+			"joe": chat.User{Nick: "joe", Secret: "joesecret", Email: "joe@mail"},
+		},
+		Banned: map[string]chat.Ban{
+			"bob": chat.Ban{Nick: "bob", Email: "bob@mail"},
+		},
+	}
+
+	if _, err := ch.UpdateProfile("joe", "Joe", "bob@mail"); err == nil {
+		t.Errorf("banned email should not be allowed")
+	}
+
+	u, err := ch.UpdateProfile("joe", "Joe Doe", "doe@mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Secret != "" {
+		t.Errorf("secret should not be returned")
+	}
+
+	if m := ch.Members["joe"]; m.FullName != "Joe Doe" || m.Email != "doe@mail" || m.Secret != "joesecret" {
+		t.Errorf("profile not updated: %+v", m)
+	}
+}
+
+func TestChannelLeave(t *testing.T) {
+	ch := chat.Chat{
+		Members: map[string]chat.User{
+			"joe": chat.User{Nick: "joe"},
+		},
+	}
+
+	if err := ch.Leave("bob"); err == nil {
+		t.Errorf("expected nick not registered error")
+	}
+
+	if err := ch.Leave("joe"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ch.Members["joe"]; ok {
+		t.Errorf("member should be removed")
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "joe"}, ""); err == nil {
+		t.Errorf("nick of member who left should stay reserved")
+	}
+}
+
+func TestChannelLeaveReservesNicks(t *testing.T) {
+	ch := chat.NewChannel("general", false)
+
+	acc := chat.NewAccount("joe", "", "", "joesecret")
+
+	if err := ch.RegisterAccount(acc, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.Register(&chat.User{Nick: "bob"}, "bobsecret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.ChangeNick("bob", "robert"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []string{"joe", "robert"} {
+		if err := ch.Leave(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, n := range []string{"joe", "bob", "robert"} {
+		if _, err := ch.Register(&chat.User{Nick: n}, ""); err == nil {
+			t.Errorf("nick %s of member who left should stay reserved", n)
+		}
+	}
+
+	if err := ch.RegisterAccount(chat.NewAccount("bob", "", "", "secret"), ""); err == nil {
+		t.Errorf("previous nick of member who left should stay reserved for accounts")
+	}
+
+	if err := ch.RegisterAccount(acc, ""); err != nil {
+		t.Fatalf("account member should be able to rejoin: %v", err)
+	}
+
+	if _, ok := ch.Left["joe"]; ok {
+		t.Errorf("rejoined member should not be reserved as former member")
+	}
+}
@@ -1,9 +1,90 @@
 package chat
 
+import (
+	"fmt"
+	"time"
+)
+
 // User represents user entity
 type User struct {
 	Nick     string `json:"nick"`
 	FullName string `json:"full_name"`
 	Email    string `json:"email"`
 	Secret   string `json:"secret"`
+	Role     Role   `json:"role"`
+
+	// Account denotes membership linked to global user account,
+	// authenticated with account credentials instead of Secret
+	Account bool `json:"account"`
+
+	MutedUntil time.Time `json:"muted_until"`
+
+	// PreviousNicks holds nicks user was known by, so that
+	// history messages can still be attributed after nick change
+	PreviousNicks []string `json:"previous_nicks,omitempty"`
+}
+
+// Role represents user role within a channel
+type Role string
+
+// Available channel roles, ordered from most to least privileged
+const (
+	RoleOwner     Role = "owner"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleGuest     Role = "guest"
+)
+
+// ParseRole validates provided role name
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleOwner, RoleModerator, RoleMember, RoleGuest:
+		return r, nil
+	}
+	return "", fmt.Errorf("chat: invalid role %q", s)
+}
+
+func (r Role) level() int {
+	switch r {
+	case RoleOwner:
+		return 3
+	case RoleModerator:
+		return 2
+	case RoleGuest:
+		return 0
+	}
+	// Members registered before roles were introduced have no role set
+	return 1
+}
+
+// GetRole returns user role, defaulting to member
+func (u *User) GetRole() Role {
+	if u.Role == "" {
+		return RoleMember
+	}
+	return u.Role
+}
+
+// CanSend checks whether user is allowed to send messages
+func (u *User) CanSend() bool {
+	return u.GetRole().level() > RoleGuest.level()
+}
+
+// CanModerate checks whether user is allowed to manage other members
+func (u *User) CanModerate() bool {
+	return u.GetRole().level() >= RoleModerator.level()
+}
+
+// IsMuted checks whether user is muted at the time t
+func (u *User) IsMuted(t time.Time) bool {
+	return t.Before(u.MutedUntil)
+}
+
+func (u *User) hadNick(nick string) bool {
+	for _, n := range u.PreviousNicks {
+		if n == nick {
+			return true
+		}
+	}
+	return false
 }
@@ -3,8 +3,10 @@
 package ingest
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/tonto/gossip/pkg/broker"
@@ -15,18 +17,32 @@ func New(mq MQ, s ChatStore) *Ingest {
 	return &Ingest{
 		mq:    mq,
 		store: s,
+		runs:  make(map[string]*run),
 	}
 }
 
-// Ingest represents chat ingester
+// Ingest represents chat ingester. Single ingest consumer
+// is run per chat, regardless of the number of subscribers.
 type Ingest struct {
 	mq    MQ
 	store ChatStore
+
+	mu   sync.Mutex
+	runs map[string]*run
+}
+
+// run represents running chat ingest consumer
+type run struct {
+	refs   int
+	closer io.Closer
 }
 
 // MQ represents ingest message queue interface
 type MQ interface {
-	SubscribeQueue(string, func(uint64, []byte)) (io.Closer, error)
+	// SubscribeDurable subscribes durable consumer shared by all cluster nodes.
+	// Message is acknowledged only if handler returns no error, otherwise
+	// it is redelivered.
+	SubscribeDurable(string, func(uint64, []byte) error) (io.Closer, error)
 }
 
 // ChatStore represents chat store interface
@@ -34,31 +50,107 @@ type ChatStore interface {
 	AppendMessage(string, *broker.Msg) error
 }
 
-// Run subscribes to ingest queue group and updates chat read model
+// Run starts chat ingest consumer if it is not already running.
+// Consumer is stopped once all returned release funcs are called.
 func (i *Ingest) Run(id string) (func(), error) {
-	closer, err := i.mq.SubscribeQueue(
-		"chat."+id,
-		func(seq uint64, data []byte) {
-			msg, err := broker.DecodeMsg(data)
-			if err != nil {
-				msg = &broker.Msg{
-					From: "ingest",
-					Text: "ingest: message unavailable: decoding error",
-					Time: time.Now(),
-				}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	r, ok := i.runs[id]
+	if !ok {
+		closer, err := i.mq.SubscribeDurable("chat."+id, handler(i.store, id))
+		if err != nil {
+			return nil, fmt.Errorf("ingest: could not subscribe: %v", err)
+		}
+
+		r = &run{closer: closer}
+		i.runs[id] = r
+	}
+
+	r.refs++
+
+	var once sync.Once
+
+	return func() { once.Do(func() { i.release(id, r) }) }, nil
+}
+
+// RunAll runs ingest for chat ids, as well as for chats received
+// on created, until ctx is done
+func (i *Ingest) RunAll(ctx context.Context, ids []string, created <-chan string) error {
+	releases := make(map[string]func())
+
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	run := func(id string) error {
+		if _, ok := releases[id]; ok {
+			return nil
+		}
+
+		release, err := i.Run(id)
+		if err != nil {
+			return err
+		}
+
+		releases[id] = release
+
+		return nil
+	}
+
+	for _, id := range ids {
+		if err := run(id); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case id := <-created:
+			if err := run(id); err != nil {
+				return err
 			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
 
-			msg.Seq = seq
+func (i *Ingest) release(id string, r *run) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-			// TODO - If AppendMessage or decode errors out, don't ack
-			// Ack only after persisting to store (since you are the only one that got the msg (queue subscription))
-			i.store.AppendMessage(id, msg)
-		},
-	)
+	r.refs--
 
-	if err != nil {
-		return nil, fmt.Errorf("ingest: could not subscribe: %v", err)
+	if r.refs > 0 {
+		return
 	}
 
-	return func() { closer.Close() }, nil
+	delete(i.runs, id)
+	r.closer.Close()
+}
+
+// handler persists chat messages to the store. Messages which could not be
+// persisted are not acknowledged, so they are redelivered by the queue.
+func handler(store ChatStore, id string) func(uint64, []byte) error {
+	return func(seq uint64, data []byte) error {
+		msg, err := broker.DecodeMsg(data)
+		if err != nil {
+			msg = &broker.Msg{
+				From: "ingest",
+				Text: "ingest: message unavailable: decoding error",
+				Time: time.Now(),
+			}
+		}
+
+		msg.Seq = seq
+
+		if err := store.AppendMessage(id, msg); err != nil {
+			return fmt.Errorf("ingest: could not persist message: %v", err)
+		}
+
+		return nil
+	}
 }
@@ -2,6 +2,7 @@ package ingest_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
@@ -107,23 +108,28 @@ func TestChatIngest(t *testing.T) {
 
 func TestChatIngestDecodingErrs(t *testing.T) {
 	cases := []struct {
-		name string
-		chat string
-		n    int
+		name  string
+		chat  string
+		n     int
+		fails int
 	}{
 		{
 			name: "test 100",
 			chat: "general",
 			n:    100,
 		},
-
-		// TODO - test AppendMessage error handling
+		{
+			name:  "redeliver on store error",
+			chat:  "general",
+			n:     100,
+			fails: 3,
+		},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			q := queue{}
-			s := store{}
+			s := store{fails: tc.fails}
 
 			for i := 0; i < tc.n; i++ {
 				d, err := json.Marshal(broker.Msg{Text: "foo bar"})
@@ -172,18 +178,19 @@ func TestChatIngestDecodingErrs(t *testing.T) {
 }
 
 type store struct {
-	data map[string][]*broker.Msg
-	err  bool
+	data  map[string][]*broker.Msg
+	fails int
 }
 
 func (s *store) AppendMessage(id string, msg *broker.Msg) error {
+	if s.fails > 0 {
+		s.fails--
+		return fmt.Errorf("error")
+	}
 	if s.data == nil {
 		s.data = make(map[string][]*broker.Msg)
 	}
 	s.data[id] = append(s.data[id], msg)
-	if s.err {
-		return fmt.Errorf("error")
-	}
 	return nil
 }
 
@@ -194,23 +201,106 @@ type queue struct {
 	}
 	purged chan struct{}
 	err    bool
+	subs   int
+	closed int
 }
 
-func (q *queue) SubscribeQueue(id string, f func(uint64, []byte)) (io.Closer, error) {
+// SubscribeDurable delivers queued messages, redelivering
+// each message until it is acknowledged
+func (q *queue) SubscribeDurable(id string, f func(uint64, []byte) error) (io.Closer, error) {
 	if q.err {
 		return nil, fmt.Errorf("error")
 	}
-	q.purged = make(chan struct{})
+	q.subs++
+	purged := make(chan struct{}, 1)
+	q.purged = purged
 	go func() {
 		for _, m := range q.data {
-			d := m.msg
-			f(m.seq, d)
+			for f(m.seq, m.msg) != nil {
+			}
 		}
-		q.purged <- struct{}{}
+		purged <- struct{}{}
 	}()
-	return &cl{}, nil
+	return &cl{q: q}, nil
+}
+
+type cl struct {
+	q *queue
+}
+
+func (c *cl) Close() error {
+	c.q.closed++
+	return nil
+}
+
+func TestChatIngestRefCount(t *testing.T) {
+	q := queue{}
+	ig := ingest.New(&q, &store{})
+
+	release1, err := ig.Run("general")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-q.purged
+
+	release2, err := ig.Run("general")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.subs != 1 {
+		t.Fatalf("expected single ingest subscription, got: %d", q.subs)
+	}
+
+	release1()
+	release1()
+
+	if q.closed != 0 {
+		t.Fatalf("ingest closed while still referenced")
+	}
+
+	release2()
+
+	if q.closed != 1 {
+		t.Fatalf("ingest not closed after release")
+	}
+
+	if _, err := ig.Run("general"); err != nil {
+		t.Fatal(err)
+	}
+
+	<-q.purged
+
+	if q.subs != 2 {
+		t.Fatalf("expected ingest to be restarted")
+	}
 }
 
-type cl struct{}
+func TestChatIngestRunAll(t *testing.T) {
+	q := queue{}
+	ig := ingest.New(&q, &store{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	created := make(chan string)
+	done := make(chan error)
+
+	go func() { done <- ig.RunAll(ctx, []string{"general", "random"}, created) }()
 
-func (c *cl) Close() error { return nil }
+	created <- "new"
+	created <- "general"
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if q.subs != 3 {
+		t.Errorf("unexpected number of ingest subscriptions. want: 3, got: %d", q.subs)
+	}
+
+	if q.closed != 3 {
+		t.Errorf("unexpected number of closed ingest subscriptions. want: 3, got: %d", q.closed)
+	}
+}
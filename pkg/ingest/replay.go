@@ -0,0 +1,141 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// NewReplay creates new chat history replay instance
+func NewReplay(log Log, s ChatStore) *Replay {
+	return &Replay{
+		log:   log,
+		store: s,
+	}
+}
+
+// Replay represents chat history read model rebuild, which
+// re-ingests chat messages retained by the message queue log
+type Replay struct {
+	log   Log
+	store ChatStore
+}
+
+// Log represents message queue log interface
+type Log interface {
+	SubscribeSeq(string, string, uint64, func(uint64, []byte)) (io.Closer, error)
+	SubscribeTimestamp(string, string, time.Time, func(uint64, []byte)) (io.Closer, error)
+	LastSeq(string) (uint64, error)
+}
+
+// Progress represents chat replay progress
+type Progress struct {
+	Chat string
+	N    int    // Number of replayed messages
+	Seq  uint64 // Last replayed seq
+	Last uint64 // Last seq to be replayed
+}
+
+const (
+	// progressEvery represents number of replayed messages between progress reports
+	progressEvery = 1000
+
+	// idleTimeout represents max time to wait for the next message. Replay ends
+	// early if the rest of the range is no longer retained by the log.
+	idleTimeout = 5 * time.Second
+)
+
+// Run replays chat id history starting at seq start, up to the last message
+// published when the replay was started. Progress is reported periodically,
+// and once the replay is done. Since appends are idempotent, replay can be
+// run while ingest is running.
+func (r *Replay) Run(ctx context.Context, id string, start uint64, progress func(Progress)) error {
+	return r.run(ctx, id, progress, func(f func(uint64, []byte)) (io.Closer, error) {
+		return r.log.SubscribeSeq("chat."+id, "", start, f)
+	})
+}
+
+// RunFrom replays chat id history starting at time t. See Run.
+func (r *Replay) RunFrom(ctx context.Context, id string, t time.Time, progress func(Progress)) error {
+	return r.run(ctx, id, progress, func(f func(uint64, []byte)) (io.Closer, error) {
+		return r.log.SubscribeTimestamp("chat."+id, "", t, f)
+	})
+}
+
+type logMsg struct {
+	seq  uint64
+	data []byte
+}
+
+func (r *Replay) run(ctx context.Context, id string, progress func(Progress), subscribe func(func(uint64, []byte)) (io.Closer, error)) error {
+	last, err := r.log.LastSeq("chat." + id)
+	if err != nil {
+		return fmt.Errorf("ingest: could not fetch last seq: %v", err)
+	}
+
+	p := Progress{Chat: id, Last: last}
+
+	if last == 0 {
+		progress(p)
+		return nil
+	}
+
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mc := make(chan logMsg)
+
+	closer, err := subscribe(func(seq uint64, data []byte) {
+		select {
+		case mc <- logMsg{seq: seq, data: data}:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("ingest: could not subscribe: %v", err)
+	}
+
+	defer closer.Close()
+
+	persist := handler(r.store, id)
+
+	for {
+		select {
+		case m := <-mc:
+			if m.seq > last {
+				progress(p)
+				return nil
+			}
+
+			if err := persist(m.seq, m.data); err != nil {
+				return err
+			}
+
+			p.N++
+			p.Seq = m.seq
+
+			if m.seq == last {
+				progress(p)
+				return nil
+			}
+
+			if p.N%progressEvery == 0 {
+				progress(p)
+			}
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(idleTimeout)
+		case <-idle.C:
+			progress(p)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package ingest_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/tonto/gossip/pkg/ingest"
+)
+
+func TestReplay(t *testing.T) {
+	cases := []struct {
+		name      string
+		n         int
+		start     uint64
+		from      time.Time
+		fails     int
+		wantSeqs  int
+		wantFirst uint64
+		wantErr   bool
+	}{
+		{
+			name: "empty log",
+		},
+		{
+			name:      "from seq 1",
+			n:         2500,
+			start:     1,
+			wantSeqs:  2500,
+			wantFirst: 1,
+		},
+		{
+			name:      "from seq",
+			n:         10,
+			start:     4,
+			wantSeqs:  7,
+			wantFirst: 4,
+		},
+		{
+			name:      "from timestamp",
+			n:         10,
+			from:      time.Unix(5, 0),
+			wantSeqs:  6,
+			wantFirst: 5,
+		},
+		{
+			name:    "store error",
+			n:       10,
+			start:   1,
+			fails:   1,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := mqlog{n: tc.n}
+			s := store{fails: tc.fails}
+
+			r := ingest.NewReplay(&l, &s)
+
+			var reports []ingest.Progress
+			progress := func(p ingest.Progress) { reports = append(reports, p) }
+
+			var err error
+			if tc.from.IsZero() {
+				err = r.Run(context.Background(), "general", tc.start, progress)
+			} else {
+				err = r.RunFrom(context.Background(), "general", tc.from, progress)
+			}
+
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			msgs := s.data["general"]
+
+			if len(msgs) != tc.wantSeqs {
+				t.Fatalf("unexpected number of replayed messages. want: %d, got: %d", tc.wantSeqs, len(msgs))
+			}
+
+			if len(msgs) > 0 && msgs[0].Seq != tc.wantFirst {
+				t.Errorf("unexpected first replayed seq. want: %d, got: %d", tc.wantFirst, msgs[0].Seq)
+			}
+
+			if len(reports) == 0 {
+				t.Fatalf("progress not reported")
+			}
+
+			last := reports[len(reports)-1]
+			if last.N != tc.wantSeqs || last.Last != uint64(tc.n) {
+				t.Errorf("unexpected final progress: %+v", last)
+			}
+
+			if want := tc.wantSeqs/1000 + 1; len(reports) != want {
+				t.Errorf("unexpected number of progress reports. want: %d, got: %d", want, len(reports))
+			}
+		})
+	}
+}
+
+// mqlog represents message queue log holding n messages,
+// with message at seq published at unix time seq
+type mqlog struct {
+	n int
+}
+
+func (l *mqlog) SubscribeSeq(id string, conn string, start uint64, f func(uint64, []byte)) (io.Closer, error) {
+	return l.deliver(start, f)
+}
+
+func (l *mqlog) SubscribeTimestamp(id string, conn string, t time.Time, f func(uint64, []byte)) (io.Closer, error) {
+	return l.deliver(uint64(t.Unix()), f)
+}
+
+func (l *mqlog) LastSeq(string) (uint64, error) { return uint64(l.n), nil }
+
+func (l *mqlog) deliver(start uint64, f func(uint64, []byte)) (io.Closer, error) {
+	go func() {
+		for seq := start; seq <= uint64(l.n); seq++ {
+			data, _ := broker.EncodeMsg(&broker.Msg{Text: fmt.Sprintf("msg number %d", seq)})
+			f(seq, data)
+		}
+	}()
+	return &cl{q: &queue{}}, nil
+}
@@ -0,0 +1,136 @@
+// Package fs provides local filesystem attachment blob storage
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tonto/gossip/pkg/attachment"
+)
+
+// New creates new filesystem blob store rooted at dir
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fs: could not create blob dir: %v", err)
+	}
+
+	return &Store{dir: dir}, nil
+}
+
+// Store represents filesystem blob store. Blob info is
+// stored next to the blob in a json sidecar file.
+type Store struct {
+	dir string
+}
+
+// Put stores blob read from r under key
+func (s *Store) Put(c context.Context, key string, r io.Reader, info attachment.Info) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(p, r); err != nil {
+		return err
+	}
+
+	// Info is written last, so that blobs are never found partially written
+	return writeFile(p+".json", bytes.NewReader(meta))
+}
+
+// Get opens blob stored under key
+func (s *Store) Get(c context.Context, key string) (io.ReadCloser, *attachment.Info, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := stat(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+// Stat returns info of blob stored under key
+func (s *Store) Stat(c context.Context, key string) (*attachment.Info, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return stat(p)
+}
+
+// stat reads info sidecar of blob stored at p
+func stat(p string) (*attachment.Info, error) {
+	meta, err := ioutil.ReadFile(p + ".json")
+	if os.IsNotExist(err) {
+		return nil, attachment.ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var info attachment.Info
+
+	if err := json.Unmarshal(meta, &info); err != nil {
+		return nil, fmt.Errorf("fs: invalid blob info: %v", err)
+	}
+
+	return &info, nil
+}
+
+func (s *Store) path(key string) (string, error) {
+	for _, el := range strings.Split(key, "/") {
+		if el == "" || el == "." || el == ".." {
+			return "", fmt.Errorf("fs: invalid blob key")
+		}
+	}
+
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// writeFile writes r to a temp file which is then renamed to p
+func writeFile(p string, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
@@ -0,0 +1,94 @@
+package fs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tonto/gossip/pkg/attachment"
+	"github.com/tonto/gossip/pkg/platform/fs"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := attachment.Info{Name: "cat.png", MIME: "image/png", Size: 4}
+
+	if err := s.Put(context.Background(), "general/1", strings.NewReader("data"), info); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		key      string
+		want     string
+		wantInfo *attachment.Info
+		wantErr  error
+	}{
+		{
+			name:     "get",
+			key:      "general/1",
+			want:     "data",
+			wantInfo: &info,
+		},
+		{
+			name:    "not found",
+			key:     "general/2",
+			wantErr: attachment.ErrNotFound,
+		},
+		{
+			name: "invalid key",
+			key:  "general/../../etc",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stat, statErr := s.Stat(context.Background(), tc.key)
+
+			rc, got, err := s.Get(context.Background(), tc.key)
+			if tc.wantInfo == nil {
+				if err == nil || (tc.wantErr != nil && err != tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if statErr == nil || (tc.wantErr != nil && statErr != tc.wantErr) {
+					t.Fatalf("unexpected stat error: %v", statErr)
+				}
+				return
+			}
+
+			if statErr != nil {
+				t.Fatal(statErr)
+			}
+
+			if *stat != *tc.wantInfo {
+				t.Errorf("unexpected stat info. want: %+v, got: %+v", *tc.wantInfo, *stat)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+
+			data, _ := ioutil.ReadAll(rc)
+			if string(data) != tc.want {
+				t.Errorf("unexpected blob. want: %s, got: %s", tc.want, data)
+			}
+
+			if *got != *tc.wantInfo {
+				t.Errorf("unexpected info. want: %+v, got: %+v", *tc.wantInfo, *got)
+			}
+		})
+	}
+}
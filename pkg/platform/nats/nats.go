@@ -7,6 +7,14 @@ import (
 	"github.com/nats-io/go-nats-streaming"
 )
 
+const (
+	// ackWait represents time after which unacknowledged messages are redelivered
+	ackWait = 30 * time.Second
+
+	// lastSeqTimeout represents max time to wait for the last message of a subject
+	lastSeqTimeout = 2 * time.Second
+)
+
 // TODO - don't pass in conn
 func New(conn stan.Conn) *NATS {
 	return &NATS{
@@ -18,13 +26,46 @@ type NATS struct {
 	conn stan.Conn
 }
 
-func (n *NATS) SubscribeQueue(subj string, f func(uint64, []byte)) (io.Closer, error) {
+// SubscribeDurable subscribes to subj using durable ingest queue group,
+// so that each message is handled by a single cluster node. Messages are
+// acknowledged only once f succeeds, and are redelivered after ackWait otherwise.
+func (n *NATS) SubscribeDurable(subj string, f func(uint64, []byte) error) (io.Closer, error) {
 	return n.conn.QueueSubscribe(
 		subj,
 		"ingest",
 		func(m *stan.Msg) {
-			f(m.Sequence, m.Data)
+			if err := f(m.Sequence, m.Data); err != nil {
+				return
+			}
+			m.Ack()
+		},
+		stan.DurableName("ingest"),
+		stan.DeliverAllAvailable(),
+		stan.SetManualAckMode(),
+		stan.AckWait(ackWait),
+		stan.MaxInflight(1),
+	)
+}
+
+// SubscribeGroup subscribes to subj using durable queue group, so that each
+// message is handled by a single group member. Unlike SubscribeDurable, newly
+// created group starts with messages published after the subscription.
+// Messages are acknowledged only once f succeeds. Messages are handled one
+// at a time, in order, so group throughput is limited by f latency.
+func (n *NATS) SubscribeGroup(subj, group string, f func(uint64, []byte) error) (io.Closer, error) {
+	return n.conn.QueueSubscribe(
+		subj,
+		group,
+		func(m *stan.Msg) {
+			if err := f(m.Sequence, m.Data); err != nil {
+				return
+			}
+			m.Ack()
 		},
+		stan.DurableName(group),
+		stan.SetManualAckMode(),
+		stan.AckWait(ackWait),
+		stan.MaxInflight(1),
 	)
 }
 
@@ -48,6 +89,35 @@ func (n *NATS) SubscribeTimestamp(id string, nick string, t time.Time, f func(ui
 	)
 }
 
+// LastSeq returns seq of the last message published to subj,
+// or 0 if no message was received within lastSeqTimeout
+func (n *NATS) LastSeq(subj string) (uint64, error) {
+	seqc := make(chan uint64, 1)
+
+	sub, err := n.conn.Subscribe(
+		subj,
+		func(m *stan.Msg) {
+			select {
+			case seqc <- m.Sequence:
+			default:
+			}
+		},
+		stan.StartWithLastReceived(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	defer sub.Close()
+
+	select {
+	case seq := <-seqc:
+		return seq, nil
+	case <-time.After(lastSeqTimeout):
+		return 0, nil
+	}
+}
+
 func (n *NATS) Send(id string, msg []byte) error {
 	return n.conn.Publish(id, msg)
 }
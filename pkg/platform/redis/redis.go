@@ -3,29 +3,50 @@ package redis
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/tonto/gossip/pkg/agent"
 	"github.com/tonto/gossip/pkg/broker"
 	"github.com/tonto/gossip/pkg/chat"
+	"github.com/tonto/gossip/pkg/webhook"
 )
 
 const (
-	maxHistorySize int64 = 1000
+	maxHistorySize       int64 = 1000
+	maxModerationLogSize int64 = 1000
+	maxDeadLetters       int64 = 1000
 )
 
 const (
 	chanListKey             = "channel.list"
-	historyPrefix           = "history"
+	historyPrefix           = "history.seq" // Sorted set scored by message seq
 	chatPrefix              = "chat"
 	chatLastSeqPrefix       = "last_seq"
 	chatClientLastSeqPrefix = "client.last_seq"
+	moderationPrefix        = "moderation"
+	accountPrefix           = "account"
+	msgIDPrefix             = "msg_id"
+	webhookPrefix           = "webhook"       // Hash of webhooks keyed by id
+	deadLetterPrefix        = "webhook.dead"  // List of undelivered webhook payloads
+	tokenPrefix             = "webhook.token" // Hash of incoming webhook tokens keyed by token hash
+	ticketPrefix            = "agent.ticket"  // Single use event stream tickets
+	botsKey                 = "webhook.bots"  // Set of incoming webhook bot names
 )
 
+// NewStore creates new redis store connected to host,
+// using default redis port unless host specifies one
 func NewStore(host string) (*Store, error) {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = host + ":6379"
+	}
+
 	opts := redis.Options{
-		Addr: host + ":6379",
+		Addr: addr,
 	}
 
 	client := redis.NewClient(&opts)
@@ -44,6 +65,11 @@ type Store struct {
 	client *redis.Client
 }
 
+// Close closes redis connection
+func (s *Store) Close() error {
+	return s.client.Close()
+}
+
 func (s *Store) Get(id string) (*chat.Chat, error) {
 	val, err := s.client.Get(chatID(id)).Result()
 	if err != nil {
@@ -60,18 +86,15 @@ func (s *Store) Get(id string) (*chat.Chat, error) {
 	return &ct, nil
 }
 
+// GetRecent returns last n chat id messages ordered by seq,
+// and the seq following the last returned message
 func (s *Store) GetRecent(id string, n int64) ([]broker.Msg, uint64, error) {
-	cmd := s.client.LRange(chatHistoryID(id), -n, -1)
-	if cmd.Err() != nil {
-		return nil, 0, cmd.Err()
-	}
-
-	data, err := cmd.Result()
+	data, err := s.client.ZRange(chatHistoryID(id), -n, -1).Result()
 	if err != nil {
 		return nil, 0, err
 	}
 
-	if data == nil || len(data) == 0 {
+	if len(data) == 0 {
 		return nil, 0, nil
 	}
 
@@ -79,10 +102,9 @@ func (s *Store) GetRecent(id string, n int64) ([]broker.Msg, uint64, error) {
 	msgs := make([]broker.Msg, len(data))
 
 	for i, m := range data {
-		var msg broker.Msg
 		err = json.NewDecoder(strings.NewReader(m)).Decode(&msgs[i])
 		if err != nil {
-			msg.Text = "message unavailable!"
+			msgs[i].Text = "message unavailable!"
 		} else {
 			seq = msgs[i].Seq
 		}
@@ -91,6 +113,49 @@ func (s *Store) GetRecent(id string, n int64) ([]broker.Msg, uint64, error) {
 	return msgs, (seq + 1), nil
 }
 
+// GetRange returns retained chat id messages with seq in [from, to) range.
+// If the range is not fully retained in history false is returned.
+func (s *Store) GetRange(id string, from, to uint64) ([]broker.Msg, bool, error) {
+	key := chatHistoryID(id)
+
+	first, err := s.client.ZRangeWithScores(key, 0, 0).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	last, err := s.client.ZRangeWithScores(key, -1, -1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(first) == 0 || len(last) == 0 || from < uint64(first[0].Score) || to-1 > uint64(last[0].Score) {
+		return nil, false, nil
+	}
+
+	data, err := s.client.ZRangeByScore(key, redis.ZRangeBy{
+		Min: strconv.FormatUint(from, 10),
+		Max: "(" + strconv.FormatUint(to, 10),
+	}).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	msgs := make([]broker.Msg, 0, len(data))
+
+	for _, d := range data {
+		var msg broker.Msg
+		if err := json.Unmarshal([]byte(d), &msg); err != nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, true, nil
+}
+
+// AppendMessage stores message to chat id history keyed by message seq.
+// Appending the same seq more than once replaces the stored message,
+// so redelivered messages are neither duplicated nor reordered.
 func (s *Store) AppendMessage(id string, m *broker.Msg) error {
 	data, err := json.Marshal(m)
 	if err != nil {
@@ -98,34 +163,56 @@ func (s *Store) AppendMessage(id string, m *broker.Msg) error {
 	}
 
 	key := chatHistoryID(id)
+	seq := strconv.FormatUint(m.Seq, 10)
+
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(key, seq, seq)
+		pipe.ZAdd(key, redis.Z{Score: float64(m.Seq), Member: data})
+		pipe.ZRemRangeByRank(key, 0, -maxHistorySize-1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	if err := s.client.RPush(key, data).Err(); err != nil {
+	if err := s.updateChatSeq(id, m.Seq); err != nil {
 		return err
 	}
 
-	s.updateChannelSeq(id, m.Seq)
+	if m.ID != "" {
+		s.client.SetXX(msgID(id, m.From, m.ID), m.Seq, broker.DedupWindow)
+	}
 
-	return s.client.LTrim(key, -maxHistorySize, -1).Err()
+	return nil
 }
 
-func (s *Store) updateChannelSeq(id string, seq uint64) {
-	var currSeq int64
+// updateChatSeq raises last chat id seq to seq. Unlike history,
+// last seq is never trimmed, so unread counts are not capped.
+func (s *Store) updateChatSeq(id string, seq uint64) error {
+	key := chatLastSeqID(id)
+
+	for {
+		err := s.client.Watch(func(tx *redis.Tx) error {
+			val, err := tx.Get(key).Uint64()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+
+			if val >= seq {
+				return nil
+			}
+
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(key, seq, 0)
+				return nil
+			})
+			return err
+		}, key)
 
-	val, err := s.client.Get(chatLastSeqID(id)).Result()
-	if err != nil {
-		if err != redis.Nil {
-			return
+		if err != redis.TxFailedErr {
+			return err
 		}
-		val = "0"
 	}
-
-	currSeq, _ = strconv.ParseInt(val, 10, 64)
-
-	if uint64(currSeq) >= seq {
-		return
-	}
-
-	s.client.Set(chatLastSeqID(id), seq, 0)
 }
 
 func (s *Store) UpdateLastClientSeq(nick string, id string, seq uint64) {
@@ -148,6 +235,23 @@ func (s *Store) UpdateLastClientSeq(nick string, id string, seq uint64) {
 	s.client.Set(chatClientLastSeqID(nick, id), seq, 0)
 }
 
+// RenameLastClientSeq moves last chat id seq read by nick to newNick,
+// so that unread count is kept after nick change
+func (s *Store) RenameLastClientSeq(nick, newNick, id string) {
+	val, err := s.client.Get(chatClientLastSeqID(nick, id)).Result()
+	if err != nil {
+		return
+	}
+
+	s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(chatClientLastSeqID(newNick, id), val, 0)
+		pipe.Del(chatClientLastSeqID(nick, id))
+		return nil
+	})
+}
+
+// GetUnreadCount returns number of chat id
+// messages following the last seq nick has read
 func (s *Store) GetUnreadCount(nick string, id string) uint64 {
 	val, err := s.client.Get(chatClientLastSeqID(nick, id)).Result()
 	if err != nil {
@@ -157,52 +261,442 @@ func (s *Store) GetUnreadCount(nick string, id string) uint64 {
 		val = "0"
 	}
 
-	useq, err := strconv.ParseInt(val, 10, 64)
+	useq, err := strconv.ParseUint(val, 10, 64)
 	if err != nil {
 		return 0
 	}
 
-	val, err = s.client.Get(chatLastSeqID(id)).Result()
-	if err != nil {
+	cseq, err := s.client.Get(chatLastSeqID(id)).Uint64()
+	if err != nil || cseq <= useq {
 		return 0
 	}
 
-	cseq, err := strconv.ParseInt(val, 10, 64)
+	return cseq - useq
+}
+
+// Save saves chat if it was not modified since it was fetched,
+// otherwise chat.ErrConflict is returned
+func (s *Store) Save(ct *chat.Chat) error {
+	key := chatID(ct.Name)
+
+	err := s.client.Watch(func(tx *redis.Tx) error {
+		val, err := tx.Get(key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		if err == nil {
+			var cur chat.Chat
+			if err := json.Unmarshal([]byte(val), &cur); err == nil && cur.Version != ct.Version {
+				return chat.ErrConflict
+			}
+		}
+
+		next := *ct
+		next.Version++
+
+		data, err := json.Marshal(&next)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, data, 0)
+			// Save only public channels
+			if ct.Secret == "" {
+				pipe.SAdd(chanListKey, ct.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		ct.Version = next.Version
+
+		return nil
+	}, key)
+
+	if err == redis.TxFailedErr {
+		return chat.ErrConflict
+	}
+
+	return err
+}
+
+func (s *Store) AppendModerationLog(id string, e *broker.Event) error {
+	data, err := json.Marshal(e)
 	if err != nil {
-		return 0
+		return err
 	}
 
-	delta := cseq - useq
+	key := chatModerationID(id)
 
-	if delta <= 0 {
-		return 0
+	if err := s.client.RPush(key, data).Err(); err != nil {
+		return err
 	}
 
-	return uint64(delta)
+	return s.client.LTrim(key, -maxModerationLogSize, -1).Err()
 }
 
-func (s *Store) Save(ct *chat.Chat) error {
-	data, err := json.Marshal(ct)
+func (s *Store) GetModerationLog(id string) ([]broker.Event, error) {
+	data, err := s.client.LRange(chatModerationID(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]broker.Event, 0, len(data))
+
+	for _, d := range data {
+		var e broker.Event
+		if err := json.Unmarshal([]byte(d), &e); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// GetWebhooks returns webhooks registered to chat id
+func (s *Store) GetWebhooks(id string) ([]webhook.Webhook, error) {
+	data, err := s.client.HVals(chatWebhookID(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]webhook.Webhook, 0, len(data))
+
+	for _, d := range data {
+		var w webhook.Webhook
+		if err := json.Unmarshal([]byte(d), &w); err != nil {
+			continue
+		}
+		hooks = append(hooks, w)
+	}
+
+	return hooks, nil
+}
+
+func (s *Store) SaveWebhook(id string, w *webhook.Webhook) error {
+	data, err := json.Marshal(w)
 	if err != nil {
 		return err
 	}
 
-	cmd := s.client.Set(chatID(ct.Name), data, 0)
-	if err := cmd.Err(); err != nil {
+	return s.client.HSet(chatWebhookID(id), w.ID, data).Err()
+}
+
+// RemoveWebhook removes chat id webhook, returning false if it does not exist
+func (s *Store) RemoveWebhook(id, hookID string) (bool, error) {
+	n, err := s.client.HDel(chatWebhookID(id), hookID).Result()
+	return n > 0, err
+}
+
+func (s *Store) AppendDeadLetter(id string, dl *webhook.DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	key := chatDeadLetterID(id)
+
+	if err := s.client.RPush(key, data).Err(); err != nil {
+		return err
+	}
+
+	return s.client.LTrim(key, -maxDeadLetters, -1).Err()
+}
+
+func (s *Store) GetDeadLetters(id string) ([]webhook.DeadLetter, error) {
+	data, err := s.client.LRange(chatDeadLetterID(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	dl := make([]webhook.DeadLetter, 0, len(data))
+
+	for _, d := range data {
+		var l webhook.DeadLetter
+		if err := json.Unmarshal([]byte(d), &l); err != nil {
+			continue
+		}
+		dl = append(dl, l)
+	}
+
+	return dl, nil
+}
+
+// GetToken returns chat id incoming webhook token by its hash,
+// or nil if it does not exist
+func (s *Store) GetToken(id, hash string) (*webhook.Token, error) {
+	val, err := s.client.HGet(chatTokenID(id), hash).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var t webhook.Token
+
+	if err := json.Unmarshal([]byte(val), &t); err != nil {
+		return nil, fmt.Errorf("store: unable to unmarshal token. invalid format: %v", err)
+	}
+
+	return &t, nil
+}
+
+func (s *Store) GetTokens(id string) ([]webhook.Token, error) {
+	data, err := s.client.HVals(chatTokenID(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]webhook.Token, 0, len(data))
+
+	for _, d := range data {
+		var t webhook.Token
+		if err := json.Unmarshal([]byte(d), &t); err != nil {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+func (s *Store) SaveToken(id string, t *webhook.Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return s.client.HSet(chatTokenID(id), t.Hash, data).Err()
+}
+
+// RevokeToken removes chat id token by token id, returning false if it does not exist
+func (s *Store) RevokeToken(id, tokenID string) (bool, error) {
+	tokens, err := s.GetTokens(id)
+	if err != nil {
+		return false, err
+	}
+
+	for _, t := range tokens {
+		if t.ID != tokenID {
+			continue
+		}
+
+		n, err := s.client.HDel(chatTokenID(id), t.Hash).Result()
+		return n > 0, err
+	}
+
+	return false, nil
+}
+
+func (s *Store) SaveTicket(ticket string, t *agent.Ticket, ttl time.Duration) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ticketID(ticket), data, ttl).Err()
+}
+
+// TakeTicket returns and removes ticket, so that it can be used only once.
+// Returns nil if ticket does not exist or has expired.
+func (s *Store) TakeTicket(ticket string) (*agent.Ticket, error) {
+	var get *redis.StringCmd
+
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ticketID(ticket))
+		pipe.Del(ticketID(ticket))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	val, err := get.Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var t agent.Ticket
+
+	if err := json.Unmarshal([]byte(val), &t); err != nil {
+		return nil, fmt.Errorf("store: unable to unmarshal ticket. invalid format: %v", err)
+	}
+
+	return &t, nil
+}
+
+func (s *Store) GetAccount(nick string) (*chat.Account, error) {
+	val, err := s.client.Get(accountID(nick)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var acc chat.Account
+
+	err = json.Unmarshal([]byte(val), &acc)
+	if err != nil {
+		return nil, fmt.Errorf("store: unable to unmarshal account. invalid format: %v", err)
+	}
+
+	return &acc, nil
+}
+
+// CreateAccount saves new account, returning chat.ErrConflict
+// if account with the same nick already exists
+func (s *Store) CreateAccount(acc *chat.Account) error {
+	next := *acc
+	next.Version = 1
+
+	data, err := json.Marshal(&next)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.client.SetNX(accountID(acc.Nick), data, 0).Result()
+	if err != nil {
 		return err
 	}
 
-	//  TODO - Transaction
+	if !ok {
+		return chat.ErrConflict
+	}
 
-	// Save only public channels
-	if ct.Secret == "" {
-		cmd := s.client.SAdd(chanListKey, ct.Name)
-		if err := cmd.Err(); err != nil {
+	acc.Version = next.Version
+
+	return nil
+}
+
+// SaveAccount saves account if it was not modified since it was
+// fetched, otherwise chat.ErrConflict is returned
+func (s *Store) SaveAccount(acc *chat.Account) error {
+	key := accountID(acc.Nick)
+
+	err := s.client.Watch(func(tx *redis.Tx) error {
+		val, err := tx.Get(key).Result()
+		if err != nil && err != redis.Nil {
 			return err
 		}
+
+		if err == nil {
+			var cur chat.Account
+			if err := json.Unmarshal([]byte(val), &cur); err == nil && cur.Version != acc.Version {
+				return chat.ErrConflict
+			}
+		}
+
+		next := *acc
+		next.Version++
+
+		data, err := json.Marshal(&next)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, data, 0)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		acc.Version = next.Version
+
+		return nil
+	}, key)
+
+	if err == redis.TxFailedErr {
+		return chat.ErrConflict
+	}
+
+	return err
+}
+
+// ReserveBot reserves incoming webhook bot name, so
+// that it can't be registered as an account nick
+func (s *Store) ReserveBot(nick string) error {
+	return s.client.SAdd(botsKey, nick).Err()
+}
+
+// IsBot returns whether nick is reserved as incoming webhook bot name
+func (s *Store) IsBot(nick string) (bool, error) {
+	return s.client.SIsMember(botsKey, nick).Result()
+}
+
+// ListAllChannels lists both public and private channels
+func (s *Store) ListAllChannels() ([]string, error) {
+	var (
+		chans  []string
+		cursor uint64
+	)
+
+	prefix := chatID("")
+
+	for {
+		keys, next, err := s.client.Scan(cursor, prefix+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range keys {
+			chans = append(chans, strings.TrimPrefix(k, prefix))
+		}
+
+		if next == 0 {
+			return chans, nil
+		}
+
+		cursor = next
 	}
+}
+
+// ReserveMsgID reserves client message id sent by nick to chat id for ttl.
+// If message id was already reserved, seq of the stored message is returned,
+// or 0 if it was not stored yet.
+func (s *Store) ReserveMsgID(id, nick, msgid string, ttl time.Duration) (uint64, bool, error) {
+	key := msgID(id, nick, msgid)
 
-	return cmd.Err()
+	ok, err := s.client.SetNX(key, 0, ttl).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if ok {
+		return 0, true, nil
+	}
+
+	seq, err := s.client.Get(key).Uint64()
+	if err != nil && err != redis.Nil {
+		return 0, false, err
+	}
+
+	return seq, false, nil
+}
+
+// GetMsgSeq returns seq of stored message with client message id
+// sent by nick to chat id, or 0 if it was not stored yet
+func (s *Store) GetMsgSeq(id, nick, msgid string) (uint64, error) {
+	seq, err := s.client.Get(msgID(id, nick, msgid)).Uint64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// ReleaseMsgID removes client message id reservation
+func (s *Store) ReleaseMsgID(id, nick, msgid string) {
+	s.client.Del(msgID(id, nick, msgid))
 }
 
 func (s *Store) ListChannels() ([]string, error) {
@@ -227,5 +721,33 @@ func chatLastSeqID(id string) string {
 }
 
 func chatClientLastSeqID(nick, id string) string {
-	return fmt.Sprintf("%s.%s.%s", chatClientLastSeqID, nick, id)
+	return fmt.Sprintf("%s.%s.%s", chatClientLastSeqPrefix, nick, id)
+}
+
+func msgID(id, nick, msgid string) string {
+	return fmt.Sprintf("%s.%s.%s.%s", msgIDPrefix, id, nick, msgid)
+}
+
+func accountID(nick string) string {
+	return fmt.Sprintf("%s.%s", accountPrefix, nick)
+}
+
+func chatModerationID(id string) string {
+	return fmt.Sprintf("%s.%s.%s", moderationPrefix, chatPrefix, id)
+}
+
+func chatWebhookID(id string) string {
+	return fmt.Sprintf("%s.%s.%s", webhookPrefix, chatPrefix, id)
+}
+
+func chatDeadLetterID(id string) string {
+	return fmt.Sprintf("%s.%s.%s", deadLetterPrefix, chatPrefix, id)
+}
+
+func chatTokenID(id string) string {
+	return fmt.Sprintf("%s.%s.%s", tokenPrefix, chatPrefix, id)
+}
+
+func ticketID(ticket string) string {
+	return fmt.Sprintf("%s.%s", ticketPrefix, ticket)
 }
@@ -0,0 +1,262 @@
+package redis_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/tonto/gossip/pkg/agent"
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/tonto/gossip/pkg/chat"
+	"github.com/tonto/gossip/pkg/platform/redis"
+)
+
+func TestSave(t *testing.T) {
+	s := newStore(t)
+
+	ct := chat.NewChannel("general", false)
+
+	if err := s.Save(ct); err != nil {
+		t.Fatalf("could not save chat: %v", err)
+	}
+
+	stale, err := s.Get("general")
+	if err != nil {
+		t.Fatalf("could not get chat: %v", err)
+	}
+
+	ct.Members["joe"] = chat.User{Nick: "joe"}
+
+	if err := s.Save(ct); err != nil {
+		t.Fatalf("could not save chat: %v", err)
+	}
+
+	stale.Members["jane"] = chat.User{Nick: "jane"}
+
+	if err := s.Save(stale); err != chat.ErrConflict {
+		t.Fatalf("stale chat saved. want: %v, got: %v", chat.ErrConflict, err)
+	}
+
+	got, err := s.Get("general")
+	if err != nil {
+		t.Fatalf("could not get chat: %v", err)
+	}
+
+	if got.Version != 2 || got.Version != ct.Version {
+		t.Errorf("unexpected version. want: 2, got: %d (%d)", got.Version, ct.Version)
+	}
+
+	if _, ok := got.Members["joe"]; !ok {
+		t.Errorf("saved member missing")
+	}
+
+	if _, ok := got.Members["jane"]; ok {
+		t.Errorf("stale member saved")
+	}
+}
+
+func TestSaveAccount(t *testing.T) {
+	s := newStore(t)
+
+	acc := chat.NewAccount("joe", "", "", "joesecret")
+
+	if err := s.CreateAccount(acc); err != nil {
+		t.Fatalf("could not create account: %v", err)
+	}
+
+	if err := s.CreateAccount(chat.NewAccount("joe", "", "", "othersecret")); err != chat.ErrConflict {
+		t.Fatalf("existing account overwritten. want: %v, got: %v", chat.ErrConflict, err)
+	}
+
+	stale, err := s.GetAccount("joe")
+	if err != nil {
+		t.Fatalf("could not get account: %v", err)
+	}
+
+	acc.Channels = []string{"general"}
+
+	if err := s.SaveAccount(acc); err != nil {
+		t.Fatalf("could not save account: %v", err)
+	}
+
+	stale.Channels = []string{"private"}
+
+	if err := s.SaveAccount(stale); err != chat.ErrConflict {
+		t.Fatalf("stale account saved. want: %v, got: %v", chat.ErrConflict, err)
+	}
+
+	got, err := s.GetAccount("joe")
+	if err != nil {
+		t.Fatalf("could not get account: %v", err)
+	}
+
+	if got.Version != 2 || got.Version != acc.Version {
+		t.Errorf("unexpected version. want: 2, got: %d (%d)", got.Version, acc.Version)
+	}
+
+	if got.Secret != "joesecret" || !reflect.DeepEqual(got.Channels, []string{"general"}) {
+		t.Errorf("unexpected account: %+v", got)
+	}
+}
+
+func TestAppendMessage(t *testing.T) {
+	s := newStore(t)
+
+	// Out of order and redelivered messages
+	for _, seq := range []uint64{2, 1, 3, 2} {
+		if err := s.AppendMessage("general", &broker.Msg{Seq: seq, From: "bob", Text: "hi"}); err != nil {
+			t.Fatalf("could not append message: %v", err)
+		}
+	}
+
+	msgs, seq, err := s.GetRecent("general", 10)
+	if err != nil {
+		t.Fatalf("could not get recent messages: %v", err)
+	}
+
+	if seq != 4 {
+		t.Errorf("unexpected next seq. want: 4, got: %d", seq)
+	}
+
+	var got []uint64
+	for _, m := range msgs {
+		got = append(got, m.Seq)
+	}
+
+	if !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Errorf("unexpected history. want: [1 2 3], got: %v", got)
+	}
+
+	// History batch of a channel with less than max history count
+	// messages starts at the first seq
+	if msgs, ok, err := s.GetRange("general", 1, 4); err != nil || !ok || len(msgs) != 3 {
+		t.Errorf("unexpected range from first seq: %d messages, ok: %v (%v)", len(msgs), ok, err)
+	}
+}
+
+func TestAppendMessageTrim(t *testing.T) {
+	s := newStore(t)
+
+	for seq := uint64(1); seq <= 1005; seq++ {
+		if err := s.AppendMessage("general", &broker.Msg{Seq: seq, From: "bob", Text: "hi"}); err != nil {
+			t.Fatalf("could not append message: %v", err)
+		}
+	}
+
+	msgs, _, err := s.GetRecent("general", 2000)
+	if err != nil {
+		t.Fatalf("could not get recent messages: %v", err)
+	}
+
+	if len(msgs) != 1000 || msgs[0].Seq != 6 || msgs[999].Seq != 1005 {
+		t.Fatalf("unexpected trimmed history: %d messages", len(msgs))
+	}
+
+	if _, ok, err := s.GetRange("general", 5, 10); err != nil || ok {
+		t.Errorf("trimmed range reported as retained (%v)", err)
+	}
+
+	if msgs, ok, err := s.GetRange("general", 6, 10); err != nil || !ok || len(msgs) != 4 {
+		t.Errorf("unexpected retained range: %d messages, ok: %v (%v)", len(msgs), ok, err)
+	}
+
+	if n := s.GetUnreadCount("joe", "general"); n != 1005 {
+		t.Errorf("unexpected unread count. want: 1005, got: %d", n)
+	}
+
+	s.UpdateLastClientSeq("joe", "general", 5)
+
+	if n := s.GetUnreadCount("joe", "general"); n != 1000 {
+		t.Errorf("unexpected unread count. want: 1000, got: %d", n)
+	}
+}
+
+func TestRenameLastClientSeq(t *testing.T) {
+	s := newStore(t)
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		if err := s.AppendMessage("general", &broker.Msg{Seq: seq, From: "bob", Text: "hi"}); err != nil {
+			t.Fatalf("could not append message: %v", err)
+		}
+	}
+
+	s.UpdateLastClientSeq("joe", "general", 3)
+	s.RenameLastClientSeq("joe", "joseph", "general")
+
+	if n := s.GetUnreadCount("joseph", "general"); n != 2 {
+		t.Errorf("unexpected unread count after rename. want: 2, got: %d", n)
+	}
+
+	if n := s.GetUnreadCount("joe", "general"); n != 5 {
+		t.Errorf("previous nick seq not removed. want: 5, got: %d", n)
+	}
+}
+
+func TestGetMsgSeq(t *testing.T) {
+	s := newStore(t)
+
+	if _, ok, err := s.ReserveMsgID("general", "ci_bot", "build-1", time.Minute); err != nil || !ok {
+		t.Fatalf("could not reserve message id: %v", err)
+	}
+
+	if seq, err := s.GetMsgSeq("general", "ci_bot", "build-1"); err != nil || seq != 0 {
+		t.Errorf("unexpected seq of message not stored yet: %d (%v)", seq, err)
+	}
+
+	if err := s.AppendMessage("general", &broker.Msg{Seq: 7, From: "ci_bot", ID: "build-1", Text: "build passed"}); err != nil {
+		t.Fatalf("could not append message: %v", err)
+	}
+
+	if seq, err := s.GetMsgSeq("general", "ci_bot", "build-1"); err != nil || seq != 7 {
+		t.Errorf("unexpected stored message seq. want: 7, got: %d (%v)", seq, err)
+	}
+
+	if seq, err := s.GetMsgSeq("general", "ci_bot", "build-2"); err != nil || seq != 0 {
+		t.Errorf("unexpected seq of unknown message: %d (%v)", seq, err)
+	}
+}
+
+func TestReserveBot(t *testing.T) {
+	s := newStore(t)
+
+	if err := s.ReserveBot("ci_bot"); err != nil {
+		t.Fatalf("could not reserve bot: %v", err)
+	}
+
+	for nick, want := range map[string]bool{"ci_bot": true, "joe": false} {
+		if got, err := s.IsBot(nick); err != nil || got != want {
+			t.Errorf("unexpected %s bot check. want: %v, got: %v (%v)", nick, want, got, err)
+		}
+	}
+}
+
+func TestTakeTicket(t *testing.T) {
+	s := newStore(t)
+
+	want := agent.Ticket{Channel: "general", Nick: "joe", Secret: "secret"}
+
+	if err := s.SaveTicket("t1", &want, time.Minute); err != nil {
+		t.Fatalf("could not save ticket: %v", err)
+	}
+
+	got, err := s.TakeTicket("t1")
+	if err != nil || got == nil || *got != want {
+		t.Fatalf("unexpected ticket. want: %+v, got: %+v (%v)", want, got, err)
+	}
+
+	if got, err := s.TakeTicket("t1"); err != nil || got != nil {
+		t.Errorf("ticket taken twice: %+v (%v)", got, err)
+	}
+}
+
+func newStore(t *testing.T) *redis.Store {
+	mr := miniredis.RunT(t)
+
+	s, err := redis.NewStore(mr.Addr())
+	if err != nil {
+		t.Fatalf("could not connect to redis: %v", err)
+	}
+
+	return s
+}
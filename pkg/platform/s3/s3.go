@@ -0,0 +1,212 @@
+// Package s3 provides S3 compatible attachment blob storage
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tonto/gossip/pkg/attachment"
+)
+
+// New creates new S3 compatible blob store. Endpoint includes scheme,
+// eg. https://s3.eu-west-1.amazonaws.com or http://minio:9000.
+// Objects are addressed path style, as endpoint/bucket/key.
+func New(endpoint, bucket, region, accessKey, secretKey string) *Store {
+	return &Store{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Store represents S3 compatible blob store. Blob info
+// is stored as object content type and metadata.
+type Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+const metaName = "X-Amz-Meta-Name"
+
+// Put uploads blob read from r under key
+func (s *Store) Put(c context.Context, key string, r io.Reader, info attachment.Info) error {
+	req, err := http.NewRequest("PUT", s.url(key), r)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = info.Size
+	req.Header.Set("Content-Type", info.MIME)
+	req.Header.Set(metaName, url.PathEscape(info.Name))
+
+	resp, err := s.do(c, req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+// Get downloads blob stored under key
+func (s *Store) Get(c context.Context, key string) (io.ReadCloser, *attachment.Info, error) {
+	req, err := http.NewRequest("GET", s.url(key), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := s.do(c, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp.Body, info(resp.Header), nil
+}
+
+// Stat returns info of blob stored under key, without downloading it
+func (s *Store) Stat(c context.Context, key string) (*attachment.Info, error) {
+	req, err := http.NewRequest("HEAD", s.url(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(c, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	return info(resp.Header), nil
+}
+
+// info reads blob info from object response headers
+func info(h http.Header) *attachment.Info {
+	name, err := url.PathUnescape(h.Get(metaName))
+	if err != nil {
+		name = h.Get(metaName)
+	}
+
+	size, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+
+	return &attachment.Info{
+		Name: name,
+		MIME: h.Get("Content-Type"),
+		Size: size,
+	}
+}
+
+func (s *Store) url(key string) string {
+	segs := strings.Split(key, "/")
+	for i := range segs {
+		segs[i] = url.PathEscape(segs[i])
+	}
+	return s.endpoint + "/" + s.bucket + "/" + strings.Join(segs, "/")
+}
+
+// do signs and sends req. Responses other than 2xx are returned as errors.
+func (s *Store) do(c context.Context, req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req.WithContext(c))
+	if err != nil {
+		return nil, fmt.Errorf("s3: request failed: %v", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, attachment.ErrNotFound
+	}
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	return resp, nil
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign signs req using AWS signature version 4. Payload is not signed,
+// so that request body can be streamed.
+func (s *Store) sign(req *http.Request, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+
+	if req.Header.Get(metaName) != "" {
+		signed = append(signed, strings.ToLower(metaName))
+	}
+
+	var headers strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		strings.Join(signed, ";"),
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	sum := sha256.Sum256([]byte(canonical))
+
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey,
+		scope,
+		strings.Join(signed, ";"),
+		hex.EncodeToString(hmacSHA256(key, toSign)),
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
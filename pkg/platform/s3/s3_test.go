@@ -0,0 +1,135 @@
+package s3_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tonto/gossip/pkg/attachment"
+	"github.com/tonto/gossip/pkg/platform/s3"
+)
+
+// standIn represents local S3 stand-in, storing objects in memory
+type standIn struct {
+	sync.Mutex
+	objects map[string]object
+}
+
+type object struct {
+	data   []byte
+	header http.Header
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.Method {
+	case "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		s.objects[r.URL.Path] = object{data: data, header: r.Header}
+	case "GET", "HEAD":
+		o, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", o.header.Get("Content-Type"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		w.Header().Set("X-Amz-Meta-Name", o.header.Get("X-Amz-Meta-Name"))
+		if r.Method == "GET" {
+			w.Write(o.data)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	srv := httptest.NewServer(&standIn{objects: make(map[string]object)})
+	defer srv.Close()
+
+	s := s3.New(srv.URL, "attachments", "us-east-1", "key", "secret")
+
+	info := attachment.Info{Name: "my cat.png", MIME: "image/png", Size: 4}
+
+	if err := s.Put(context.Background(), "general/1", strings.NewReader("data"), info); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		store    *s3.Store
+		key      string
+		want     string
+		wantInfo *attachment.Info
+		wantErr  error
+	}{
+		{
+			name:     "get",
+			store:    s,
+			key:      "general/1",
+			want:     "data",
+			wantInfo: &info,
+		},
+		{
+			name:    "not found",
+			store:   s,
+			key:     "general/2",
+			wantErr: attachment.ErrNotFound,
+		},
+		{
+			name:  "unauthorized",
+			store: s3.New(srv.URL, "attachments", "us-east-1", "other", "secret"),
+			key:   "general/1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stat, statErr := tc.store.Stat(context.Background(), tc.key)
+
+			rc, got, err := tc.store.Get(context.Background(), tc.key)
+			if tc.wantInfo == nil {
+				if err == nil || (tc.wantErr != nil && err != tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if statErr == nil || (tc.wantErr != nil && statErr != tc.wantErr) {
+					t.Fatalf("unexpected stat error: %v", statErr)
+				}
+				return
+			}
+
+			if statErr != nil {
+				t.Fatal(statErr)
+			}
+
+			if *stat != *tc.wantInfo {
+				t.Errorf("unexpected stat info. want: %+v, got: %+v", *tc.wantInfo, *stat)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+
+			data, _ := ioutil.ReadAll(rc)
+			if string(data) != tc.want {
+				t.Errorf("unexpected blob. want: %s, got: %s", tc.want, data)
+			}
+
+			if *got != *tc.wantInfo {
+				t.Errorf("unexpected info. want: %+v, got: %+v", *tc.wantInfo, *got)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/tonto/gossip/pkg/chat"
+	h "github.com/tonto/kit/http"
+)
+
+const (
+	maxChanNameLen = 25
+	maxURLLen      = 2048
+	maxWebhooks    = 10 // Max webhooks per chat
+)
+
+// NewAPI creates new webhook api
+func NewAPI(chats ChatStore, store Store, b Sender, admin, password string) *API {
+	api := API{
+		chats:   chats,
+		store:   store,
+		broker:  b,
+		limiter: &limiter{buckets: make(map[string]*bucket)},
+	}
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/register",
+		api.register,
+		chat.WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/list",
+		api.list,
+		chat.WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/remove",
+		api.remove,
+		chat.WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/dead_letters",
+		api.deadLetters,
+		chat.WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/create_token",
+		api.createToken,
+		chat.WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/list_tokens",
+		api.listTokens,
+		chat.WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterEndpoint(
+		"POST",
+		"/admin/revoke_token",
+		api.revokeToken,
+		chat.WithHTTPBasicAuth(admin, password),
+	)
+
+	api.RegisterHandler("POST", "/incoming", api.incoming)
+
+	return &api
+}
+
+// API represents webhook api service
+type API struct {
+	h.BaseService
+	chats   ChatStore
+	store   Store
+	broker  Sender
+	limiter *limiter
+}
+
+// ChatStore represents chat store interface
+type ChatStore interface {
+	Get(string) (*chat.Chat, error)
+	Save(*chat.Chat) error
+	GetAccount(string) (*chat.Account, error)
+	ReserveBot(string) error
+}
+
+// Store represents webhook store interface
+type Store interface {
+	GetWebhooks(string) ([]Webhook, error)
+	SaveWebhook(string, *Webhook) error
+	RemoveWebhook(string, string) (bool, error)
+	AppendDeadLetter(string, *DeadLetter) error
+	GetDeadLetters(string) ([]DeadLetter, error)
+
+	// GetToken returns chat token by hash, or nil if it does not exist
+	GetToken(string, string) (*Token, error)
+	GetTokens(string) ([]Token, error)
+	SaveToken(string, *Token) error
+	RevokeToken(string, string) (bool, error)
+
+	// GetMsgSeq returns seq of stored message with client message
+	// id sent by nick to chat, or 0 if it was not stored yet
+	GetMsgSeq(string, string, string) (uint64, error)
+}
+
+// Prefix returns api prefix for this service
+func (api *API) Prefix() string { return "webhook" }
+
+func validateChannel(ch string) error {
+	if ch == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(ch) > maxChanNameLen {
+		return fmt.Errorf("channel name must not exceed %d characters", maxChanNameLen)
+	}
+	return nil
+}
+
+type registerReq struct {
+	Channel string  `json:"channel"`
+	URL     string  `json:"url"`
+	Events  []Event `json:"events"`
+}
+
+func (r *registerReq) Validate() error {
+	if err := validateChannel(r.Channel); err != nil {
+		return err
+	}
+	if len(r.URL) > maxURLLen {
+		return fmt.Errorf("url must not exceed %d characters", maxURLLen)
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be absolute http(s) url")
+	}
+	if checkHost(u) != nil {
+		return fmt.Errorf("url must not target localhost or private network")
+	}
+	for _, e := range r.Events {
+		if !e.valid() {
+			return fmt.Errorf("unsupported event %q", e)
+		}
+	}
+	return nil
+}
+
+// register registers chat webhook. Generated signing
+// secret is returned only once, on registration.
+func (api *API) register(c context.Context, w http.ResponseWriter, req *registerReq) (*h.Response, error) {
+	if _, err := api.chats.Get(req.Channel); err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	hooks, err := api.store.GetWebhooks(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch webhooks")
+	}
+
+	if len(hooks) >= maxWebhooks {
+		return nil, fmt.Errorf("exceeded max number of webhooks per channel (%d)", maxWebhooks)
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate webhook secret")
+	}
+
+	hook := Webhook{
+		ID:      ksuid.New().String(),
+		URL:     req.URL,
+		Secret:  secret,
+		Events:  req.Events,
+		Created: time.Now(),
+	}
+
+	if err := api.store.SaveWebhook(req.Channel, &hook); err != nil {
+		return nil, fmt.Errorf("could not save webhook")
+	}
+
+	return h.NewResponse(hook, http.StatusOK), nil
+}
+
+type channelReq struct {
+	Channel string `json:"channel"`
+}
+
+func (r *channelReq) Validate() error {
+	return validateChannel(r.Channel)
+}
+
+// list lists chat webhooks, omitting their secrets
+func (api *API) list(c context.Context, w http.ResponseWriter, req *channelReq) (*h.Response, error) {
+	hooks, err := api.store.GetWebhooks(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch webhooks")
+	}
+
+	if hooks == nil {
+		hooks = []Webhook{}
+	}
+
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+
+	return h.NewResponse(hooks, http.StatusOK), nil
+}
+
+type removeReq struct {
+	Channel string `json:"channel"`
+	ID      string `json:"id"`
+}
+
+func (r *removeReq) Validate() error {
+	if r.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	return validateChannel(r.Channel)
+}
+
+func (api *API) remove(c context.Context, w http.ResponseWriter, req *removeReq) (*h.Response, error) {
+	ok, err := api.store.RemoveWebhook(req.Channel, req.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not remove webhook")
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("webhook not found")
+	}
+
+	return h.NewResponse(nil, http.StatusOK), nil
+}
+
+// deadLetters lists chat payloads which could not be delivered
+func (api *API) deadLetters(c context.Context, w http.ResponseWriter, req *channelReq) (*h.Response, error) {
+	dl, err := api.store.GetDeadLetters(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch dead letters")
+	}
+
+	if dl == nil {
+		dl = []DeadLetter{}
+	}
+
+	return h.NewResponse(dl, http.StatusOK), nil
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,255 @@
+package webhook_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/tonto/gossip/pkg/chat"
+	"github.com/tonto/gossip/pkg/webhook"
+)
+
+func TestRegister(t *testing.T) {
+	cases := []struct {
+		name     string
+		req      map[string]interface{}
+		hooks    int
+		password string
+		storeErr error
+		wantCode int
+	}{
+		{
+			name:     "register",
+			req:      map[string]interface{}{"channel": "general", "url": "https://example.com/hook"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "register with events",
+			req:      map[string]interface{}{"channel": "general", "url": "https://example.com/hook", "events": []string{"join", "moderation"}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "unauthorized",
+			req:      map[string]interface{}{"channel": "general", "url": "https://example.com/hook"},
+			password: "invalid",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "missing channel",
+			req:      map[string]interface{}{"url": "https://example.com/hook"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid url",
+			req:      map[string]interface{}{"channel": "general", "url": "ftp://example.com"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "relative url",
+			req:      map[string]interface{}{"channel": "general", "url": "/hook"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "localhost url",
+			req:      map[string]interface{}{"channel": "general", "url": "http://localhost:8080/hook"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "loopback url",
+			req:      map[string]interface{}{"channel": "general", "url": "http://127.0.0.2/hook"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "ipv6 loopback url",
+			req:      map[string]interface{}{"channel": "general", "url": "http://[::1]/hook"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "private network url",
+			req:      map[string]interface{}{"channel": "general", "url": "https://192.168.1.10/hook"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "metadata url",
+			req:      map[string]interface{}{"channel": "general", "url": "http://169.254.169.254/latest/meta-data"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unsupported event",
+			req:      map[string]interface{}{"channel": "general", "url": "https://example.com/hook", "events": []string{"typing"}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown channel",
+			req:      map[string]interface{}{"channel": "random", "url": "https://example.com/hook"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "too many webhooks",
+			req:      map[string]interface{}{"channel": "general", "url": "https://example.com/hook"},
+			hooks:    10,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "store error",
+			req:      map[string]interface{}{"channel": "general", "url": "https://example.com/hook"},
+			storeErr: fmt.Errorf("redis down"),
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := store{hooks: make(map[string][]webhook.Webhook), err: tc.storeErr}
+			for i := 0; i < tc.hooks; i++ {
+				st.hooks["general"] = append(st.hooks["general"], webhook.Webhook{ID: fmt.Sprint(i)})
+			}
+
+			rw := call(t, webhook.NewAPI(&chats{}, &st, &sender{}, "admin", "test"), "/admin/register", tc.password, tc.req)
+
+			if rw.Code != tc.wantCode {
+				t.Fatalf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+			}
+
+			if rw.Code != http.StatusOK {
+				if len(st.hooks["general"]) != tc.hooks {
+					t.Errorf("unexpected webhook saved")
+				}
+				return
+			}
+
+			var resp struct {
+				Data webhook.Webhook `json:"data"`
+			}
+
+			json.NewDecoder(rw.Body).Decode(&resp)
+
+			if resp.Data.ID == "" || len(resp.Data.Secret) != 64 {
+				t.Errorf("unexpected response: %+v", resp.Data)
+			}
+
+			if len(st.hooks["general"]) != 1 || st.hooks["general"][0].Secret != resp.Data.Secret {
+				t.Errorf("webhook not saved: %+v", st.hooks)
+			}
+		})
+	}
+}
+
+func TestManage(t *testing.T) {
+	st := store{
+		hooks: map[string][]webhook.Webhook{
+			"general": {{ID: "h1", URL: "https://example.com/hook", Secret: "secret"}},
+		},
+		dead: []webhook.DeadLetter{{Webhook: "h1", Error: "webhook responded with status 500", Attempts: 4}},
+	}
+
+	api := webhook.NewAPI(&chats{}, &st, &sender{}, "admin", "test")
+
+	var list struct {
+		Data []webhook.Webhook `json:"data"`
+	}
+
+	rw := call(t, api, "/admin/list", "", map[string]interface{}{"channel": "general"})
+	json.NewDecoder(rw.Body).Decode(&list)
+
+	if rw.Code != http.StatusOK || len(list.Data) != 1 || list.Data[0].ID != "h1" {
+		t.Fatalf("unexpected webhook list: %d %+v", rw.Code, list.Data)
+	}
+
+	if list.Data[0].Secret != "" {
+		t.Errorf("webhook secret listed")
+	}
+
+	if st.hooks["general"][0].Secret != "secret" {
+		t.Errorf("stored webhook modified")
+	}
+
+	var dead struct {
+		Data []webhook.DeadLetter `json:"data"`
+	}
+
+	rw = call(t, api, "/admin/dead_letters", "", map[string]interface{}{"channel": "general"})
+	json.NewDecoder(rw.Body).Decode(&dead)
+
+	if rw.Code != http.StatusOK || len(dead.Data) != 1 || dead.Data[0].Attempts != 4 {
+		t.Errorf("unexpected dead letters: %d %+v", rw.Code, dead.Data)
+	}
+
+	if rw := call(t, api, "/admin/remove", "", map[string]interface{}{"channel": "general", "id": "h2"}); rw.Code == http.StatusOK {
+		t.Errorf("removed unknown webhook")
+	}
+
+	if rw := call(t, api, "/admin/remove", "", map[string]interface{}{"channel": "general", "id": "h1"}); rw.Code != http.StatusOK {
+		t.Errorf("could not remove webhook: %d", rw.Code)
+	}
+
+	if len(st.hooks["general"]) != 0 {
+		t.Errorf("webhook not removed")
+	}
+}
+
+func call(t *testing.T, api *webhook.API, path, password string, req interface{}) *httptest.ResponseRecorder {
+	if password == "" {
+		password = "test"
+	}
+
+	for p, ep := range api.Endpoints() {
+		if p != path {
+			continue
+		}
+
+		body, _ := json.Marshal(req)
+
+		r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		r.SetBasicAuth("admin", password)
+
+		rw := httptest.NewRecorder()
+		ep.Handler(context.Background(), rw, r)
+
+		return rw
+	}
+
+	t.Fatalf("endpoint %s not registered", path)
+	return nil
+}
+
+type chats struct {
+	sync.Mutex
+	saved *chat.Chat
+	bots  []string
+}
+
+func (c *chats) Get(id string) (*chat.Chat, error) {
+	if id != "general" {
+		return nil, fmt.Errorf("not found")
+	}
+	ch := chat.NewChannel(id, false)
+	ch.Members["joe"] = chat.User{Nick: "joe", PreviousNicks: []string{"joey"}}
+	return ch, nil
+}
+
+func (c *chats) Save(ch *chat.Chat) error {
+	c.Lock()
+	defer c.Unlock()
+	c.saved = ch
+	return nil
+}
+
+func (c *chats) GetAccount(nick string) (*chat.Account, error) {
+	if nick == "jane" {
+		return &chat.Account{Nick: nick}, nil
+	}
+	return nil, nil
+}
+
+func (c *chats) ReserveBot(nick string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.bots = append(c.bots, nick)
+	return nil
+}
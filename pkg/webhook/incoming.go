@@ -0,0 +1,396 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/tonto/gossip/pkg/broker"
+	h "github.com/tonto/kit/http"
+	"github.com/tonto/kit/http/respond"
+)
+
+const (
+	maxTokens  = 10 // Max incoming webhook tokens per chat
+	defRate    = 30 // Default incoming webhook rate in messages per minute
+	maxRate    = 600
+	minBotLen  = 3
+	maxBotLen  = 20
+	maxBodyLen = 64 << 10
+
+	maxTextLen  = 1024
+	maxCodeLen  = 4096
+	maxLangLen  = 32
+	maxMsgIDLen = 64
+
+	// seqTimeout is max time incoming webhook waits for sent
+	// message to be stored, polling store every seqPoll
+	seqTimeout = 2 * time.Second
+	seqPoll    = 50 * time.Millisecond
+)
+
+var botRe = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+
+// Token represents incoming webhook token, allowing external systems
+// to post messages to the chat under the bot name. Only token hash
+// is stored, the token itself is returned once, on creation.
+type Token struct {
+	ID      string    `json:"id"`
+	Bot     string    `json:"bot"`
+	Rate    int       `json:"rate"` // Max messages per minute
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Sender represents chat message broker interface
+type Sender interface {
+	Send(string, *broker.Msg) error
+}
+
+// limiter rate limits incoming webhook tokens using token buckets
+// refilled at token rate per minute. Limits are enforced per node.
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow(id string, rate int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: float64(rate), last: now}
+		l.buckets[id] = b
+	}
+
+	b.tokens = math.Min(float64(rate), b.tokens+now.Sub(b.last).Minutes()*float64(rate))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func (l *limiter) remove(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, id)
+}
+
+type createTokenReq struct {
+	Channel string `json:"channel"`
+	Bot     string `json:"bot"`
+	Rate    int    `json:"rate"`
+}
+
+func (r *createTokenReq) Validate() error {
+	if err := validateChannel(r.Channel); err != nil {
+		return err
+	}
+	if len(r.Bot) < minBotLen || len(r.Bot) > maxBotLen {
+		return fmt.Errorf("bot name must be between %d and %d characters long", minBotLen, maxBotLen)
+	}
+	if !botRe.MatchString(r.Bot) {
+		return fmt.Errorf("bot name must contain only alphanumeric and underscores")
+	}
+	if r.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	if r.Rate > maxRate {
+		return fmt.Errorf("rate must not exceed %d messages per minute", maxRate)
+	}
+	return nil
+}
+
+type createTokenResp struct {
+	Token
+	Secret string `json:"token"`
+}
+
+// createToken creates incoming webhook token. Bot name must
+// not be taken by a chat member or account, so that bots can't
+// impersonate chat members, and is reserved in the chat and
+// among accounts, so that members can't impersonate bots.
+func (api *API) createToken(c context.Context, w http.ResponseWriter, req *createTokenReq) (*h.Response, error) {
+	ch, err := api.chats.Get(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch channel")
+	}
+
+	if _, ok := ch.Members[req.Bot]; ok {
+		return nil, fmt.Errorf("bot name is taken by channel member")
+	}
+
+	acc, err := api.chats.GetAccount(req.Bot)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch account")
+	}
+
+	if acc != nil {
+		return nil, fmt.Errorf("bot name is taken by an account")
+	}
+
+	tokens, err := api.store.GetTokens(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch tokens")
+	}
+
+	if len(tokens) >= maxTokens {
+		return nil, fmt.Errorf("exceeded max number of tokens per channel (%d)", maxTokens)
+	}
+
+	if err := ch.AddBot(req.Bot); err != nil {
+		return nil, fmt.Errorf("bot name is taken in the channel")
+	}
+
+	if err := api.chats.Save(ch); err != nil {
+		return nil, fmt.Errorf("could not reserve bot name")
+	}
+
+	if err := api.chats.ReserveBot(req.Bot); err != nil {
+		return nil, fmt.Errorf("could not reserve bot name")
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate token")
+	}
+
+	t := Token{
+		ID:      ksuid.New().String(),
+		Bot:     req.Bot,
+		Rate:    req.Rate,
+		Hash:    hashToken(secret),
+		Created: time.Now(),
+	}
+
+	if t.Rate == 0 {
+		t.Rate = defRate
+	}
+
+	if err := api.store.SaveToken(req.Channel, &t); err != nil {
+		return nil, fmt.Errorf("could not save token")
+	}
+
+	t.Hash = ""
+
+	return h.NewResponse(createTokenResp{Token: t, Secret: secret}, http.StatusOK), nil
+}
+
+func (api *API) listTokens(c context.Context, w http.ResponseWriter, req *channelReq) (*h.Response, error) {
+	tokens, err := api.store.GetTokens(req.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch tokens")
+	}
+
+	if tokens == nil {
+		tokens = []Token{}
+	}
+
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+
+	return h.NewResponse(tokens, http.StatusOK), nil
+}
+
+func (api *API) revokeToken(c context.Context, w http.ResponseWriter, req *removeReq) (*h.Response, error) {
+	ok, err := api.store.RevokeToken(req.Channel, req.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not revoke token")
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("token not found")
+	}
+
+	api.limiter.remove(req.ID)
+
+	return h.NewResponse(nil, http.StatusOK), nil
+}
+
+type incomingReq struct {
+	Text string            `json:"text"`
+	Kind broker.Kind       `json:"kind"`
+	Lang string            `json:"lang"`
+	Meta map[string]string `json:"meta"`
+	ID   string            `json:"id"` // Optional message id, retries with the same id are not resent
+}
+
+func (r *incomingReq) Validate() error {
+	if len(r.ID) > maxMsgIDLen {
+		return fmt.Errorf("exceeded max message id length of %d", maxMsgIDLen)
+	}
+
+	max := maxTextLen
+
+	switch r.Kind {
+	case "", broker.KindText, broker.KindMarkdown:
+		if r.Lang != "" {
+			return fmt.Errorf("language is allowed only in code messages")
+		}
+	case broker.KindCode:
+		max = maxCodeLen
+		if len(r.Lang) > maxLangLen {
+			return fmt.Errorf("exceeded max code language length of %d characters", maxLangLen)
+		}
+	default:
+		return fmt.Errorf("unsupported message kind %q", r.Kind)
+	}
+
+	if r.Text == "" {
+		return fmt.Errorf("sent empty message")
+	}
+
+	if len(r.Text) > max {
+		return fmt.Errorf("exceeded max message length of %d characters", max)
+	}
+
+	return nil
+}
+
+type sendResp struct {
+	ID        string `json:"id"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// incoming sends message posted by external system to the chat, as
+// the token bot. Messages carry token id in webhook meta field. Token is
+// sent as Authorization bearer token, or in token query param. Messages
+// sent without id are assigned one, which is returned so that the request
+// can be safely retried. Response carries seq assigned to the message, or
+// is sent with accepted status if the message was not stored within seqTimeout.
+func (api *API) incoming(c context.Context, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	channel, secret := q.Get("channel"), q.Get("token")
+
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		secret = strings.TrimPrefix(v, "Bearer ")
+	}
+
+	if channel == "" || secret == "" {
+		respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, fmt.Errorf("channel and token are required")))
+		return
+	}
+
+	t, err := api.store.GetToken(channel, hashToken(secret))
+	if err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusInternalServerError, fmt.Errorf("could not fetch token")))
+		return
+	}
+
+	if t == nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusForbidden, fmt.Errorf("invalid token")))
+		return
+	}
+
+	if !api.limiter.allow(t.ID, t.Rate, time.Now()) {
+		respond.WithJSON(w, r, h.NewError(http.StatusTooManyRequests, fmt.Errorf("exceeded rate limit of %d messages per minute", t.Rate)))
+		return
+	}
+
+	var req incomingReq
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodyLen)).Decode(&req); err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)))
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusBadRequest, err))
+		return
+	}
+
+	meta := map[string]string{"webhook": t.ID}
+	for k, v := range req.Meta {
+		if k != "webhook" {
+			meta[k] = v
+		}
+	}
+
+	msg := broker.Msg{
+		From: t.Bot,
+		Text: req.Text,
+		Kind: req.Kind,
+		Lang: req.Lang,
+		Meta: meta,
+		ID:   req.ID,
+		Time: time.Now(),
+	}
+
+	// Message id maps to message seq once the message is stored
+	if msg.ID == "" {
+		msg.ID = ksuid.New().String()
+	}
+
+	err = api.broker.Send(channel, &msg)
+	if dup, ok := err.(*broker.DuplicateError); ok {
+		respond.WithJSON(w, r, h.NewResponse(sendResp{ID: msg.ID, Seq: dup.Seq, Duplicate: true}, http.StatusOK))
+		return
+	}
+
+	if err != nil {
+		respond.WithJSON(w, r, h.NewError(http.StatusInternalServerError, fmt.Errorf("could not send message")))
+		return
+	}
+
+	seq := api.awaitSeq(c, channel, msg.From, msg.ID)
+	if seq == 0 {
+		respond.WithJSON(w, r, h.NewResponse(sendResp{ID: msg.ID}, http.StatusAccepted))
+		return
+	}
+
+	respond.WithJSON(w, r, h.NewResponse(sendResp{ID: msg.ID, Seq: seq}, http.StatusOK))
+}
+
+// awaitSeq returns seq of message msgid sent by nick to chat id once it is
+// stored, or 0 if it is not stored within seqTimeout
+func (api *API) awaitSeq(c context.Context, id, nick, msgid string) uint64 {
+	timeout := time.NewTimer(seqTimeout)
+	defer timeout.Stop()
+
+	tick := time.NewTicker(seqPoll)
+	defer tick.Stop()
+
+	for {
+		seq, err := api.store.GetMsgSeq(id, nick, msgid)
+		if err == nil && seq != 0 {
+			return seq
+		}
+
+		select {
+		case <-tick.C:
+		case <-timeout.C:
+			return 0
+		case <-c.Done():
+			return 0
+		}
+	}
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,382 @@
+package webhook_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/tonto/gossip/pkg/webhook"
+)
+
+func TestCreateToken(t *testing.T) {
+	cases := []struct {
+		name     string
+		req      map[string]interface{}
+		tokens   int
+		wantCode int
+		wantRate int
+	}{
+		{
+			name:     "create",
+			req:      map[string]interface{}{"channel": "general", "bot": "ci_bot"},
+			wantCode: http.StatusOK,
+			wantRate: 30,
+		},
+		{
+			name:     "create with rate",
+			req:      map[string]interface{}{"channel": "general", "bot": "ci_bot", "rate": 5},
+			wantCode: http.StatusOK,
+			wantRate: 5,
+		},
+		{
+			name:     "invalid bot name",
+			req:      map[string]interface{}{"channel": "general", "bot": "ci bot"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "short bot name",
+			req:      map[string]interface{}{"channel": "general", "bot": "ci"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "rate too high",
+			req:      map[string]interface{}{"channel": "general", "bot": "ci_bot", "rate": 1000},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "bot name taken by member",
+			req:      map[string]interface{}{"channel": "general", "bot": "joe"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "bot name reserved in channel",
+			req:      map[string]interface{}{"channel": "general", "bot": "joey"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "bot name taken by account",
+			req:      map[string]interface{}{"channel": "general", "bot": "jane"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "unknown channel",
+			req:      map[string]interface{}{"channel": "random", "bot": "ci_bot"},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "too many tokens",
+			req:      map[string]interface{}{"channel": "general", "bot": "ci_bot"},
+			tokens:   10,
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := store{tokens: make(map[string][]webhook.Token)}
+			for i := 0; i < tc.tokens; i++ {
+				st.tokens["general"] = append(st.tokens["general"], webhook.Token{ID: fmt.Sprint(i)})
+			}
+
+			cs := chats{}
+
+			rw := call(t, webhook.NewAPI(&cs, &st, &sender{}, "admin", "test"), "/admin/create_token", "", tc.req)
+
+			if rw.Code != tc.wantCode {
+				t.Fatalf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+			}
+
+			if rw.Code != http.StatusOK {
+				if len(st.tokens["general"]) != tc.tokens {
+					t.Errorf("unexpected token saved")
+				}
+				return
+			}
+
+			var resp struct {
+				Data struct {
+					webhook.Token
+					Secret string `json:"token"`
+				} `json:"data"`
+			}
+
+			json.NewDecoder(rw.Body).Decode(&resp)
+
+			if resp.Data.ID == "" || resp.Data.Secret == "" || resp.Data.Hash != "" || resp.Data.Rate != tc.wantRate {
+				t.Errorf("unexpected response: %+v", resp.Data)
+			}
+
+			if len(st.tokens["general"]) != 1 || st.tokens["general"][0].Hash != hash(resp.Data.Secret) {
+				t.Errorf("token hash not saved: %+v", st.tokens)
+			}
+
+			if cs.saved == nil || !reflect.DeepEqual(cs.saved.Bots, []string{"ci_bot"}) {
+				t.Errorf("bot name not reserved in channel: %+v", cs.saved)
+			}
+
+			if !reflect.DeepEqual(cs.bots, []string{"ci_bot"}) {
+				t.Errorf("bot name not reserved: %v", cs.bots)
+			}
+		})
+	}
+}
+
+func TestIncoming(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    string
+		bearer   string
+		body     string
+		sendErr  error
+		wantCode int
+		wantSent bool
+		wantSeq  uint64
+	}{
+		{
+			name:     "send",
+			query:    "?channel=general&token=secret",
+			body:     `{"text": "build passed"}`,
+			wantCode: http.StatusOK,
+			wantSent: true,
+			wantSeq:  1,
+		},
+		{
+			name:     "send with bearer token",
+			query:    "?channel=general",
+			bearer:   "secret",
+			body:     `{"text": "build passed"}`,
+			wantCode: http.StatusOK,
+			wantSent: true,
+			wantSeq:  1,
+		},
+		{
+			name:     "invalid bearer token",
+			query:    "?channel=general",
+			bearer:   "invalid",
+			body:     `{"text": "build passed"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "send code",
+			query:    "?channel=general&token=secret",
+			body:     `{"text": "FAIL: TestSend", "kind": "code", "lang": "text"}`,
+			wantCode: http.StatusOK,
+			wantSent: true,
+			wantSeq:  1,
+		},
+		{
+			name:     "missing token",
+			query:    "?channel=general",
+			body:     `{"text": "build passed"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid token",
+			query:    "?channel=general&token=invalid",
+			body:     `{"text": "build passed"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "token of other channel",
+			query:    "?channel=random&token=secret",
+			body:     `{"text": "build passed"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "invalid body",
+			query:    "?channel=general&token=secret",
+			body:     `{"text":`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "empty message",
+			query:    "?channel=general&token=secret",
+			body:     `{}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "too long",
+			query:    "?channel=general&token=secret",
+			body:     `{"text": "` + strings.Repeat("x", 2048) + `"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "attachment",
+			query:    "?channel=general&token=secret",
+			body:     `{"text": "hi", "kind": "attachment"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "system message",
+			query:    "?channel=general&token=secret",
+			body:     `{"text": "hi", "kind": "system"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "duplicate",
+			query:    "?channel=general&token=secret",
+			body:     `{"text": "build passed", "id": "build-1"}`,
+			sendErr:  &broker.DuplicateError{Seq: 3},
+			wantCode: http.StatusOK,
+			wantSeq:  3,
+		},
+		{
+			name:     "send error",
+			query:    "?channel=general&token=secret",
+			body:     `{"text": "build passed"}`,
+			sendErr:  fmt.Errorf("nats down"),
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := store{tokens: map[string][]webhook.Token{
+				"general": {{ID: "t1", Bot: "ci_bot", Rate: 10, Hash: hash("secret")}},
+			}}
+
+			s := sender{err: tc.sendErr, st: &st}
+
+			rw := post(t, webhook.NewAPI(&chats{}, &st, &s, "admin", "test"), tc.query, tc.body, tc.bearer)
+
+			if rw.Code != tc.wantCode {
+				t.Fatalf("unexpected response code. want: %d, got: %d", tc.wantCode, rw.Code)
+			}
+
+			var resp struct {
+				Data struct {
+					ID  string `json:"id"`
+					Seq uint64 `json:"seq"`
+				} `json:"data"`
+			}
+
+			json.NewDecoder(rw.Body).Decode(&resp)
+
+			if resp.Data.Seq != tc.wantSeq {
+				t.Errorf("unexpected seq. want: %d, got: %d", tc.wantSeq, resp.Data.Seq)
+			}
+
+			if !tc.wantSent {
+				return
+			}
+
+			if len(s.sent) != 1 {
+				t.Fatalf("expected message to be sent")
+			}
+
+			msg := s.sent[0]
+
+			if msg.From != "ci_bot" || msg.Meta["webhook"] != "t1" || msg.Time.IsZero() {
+				t.Errorf("unexpected message sent: %+v", msg)
+			}
+
+			if msg.ID == "" || resp.Data.ID != msg.ID {
+				t.Errorf("message id not returned. want: %s, got: %s", msg.ID, resp.Data.ID)
+			}
+		})
+	}
+}
+
+func TestIncomingRateLimit(t *testing.T) {
+	st := store{tokens: map[string][]webhook.Token{
+		"general": {{ID: "t1", Bot: "ci_bot", Rate: 2, Hash: hash("secret")}},
+	}}
+
+	s := sender{st: &st}
+
+	api := webhook.NewAPI(&chats{}, &st, &s, "admin", "test")
+
+	for i := 0; i < 2; i++ {
+		if rw := post(t, api, "?channel=general&token=secret", `{"text": "hi"}`, ""); rw.Code != http.StatusOK {
+			t.Fatalf("unexpected response code: %d", rw.Code)
+		}
+	}
+
+	if rw := post(t, api, "?channel=general&token=secret", `{"text": "hi"}`, ""); rw.Code != http.StatusTooManyRequests {
+		t.Errorf("rate limit not enforced. got: %d", rw.Code)
+	}
+
+	var list struct {
+		Data []webhook.Token `json:"data"`
+	}
+
+	rw := call(t, api, "/admin/list_tokens", "", map[string]interface{}{"channel": "general"})
+	json.NewDecoder(rw.Body).Decode(&list)
+
+	if len(list.Data) != 1 || list.Data[0].ID != "t1" || list.Data[0].Hash != "" {
+		t.Errorf("unexpected token list: %+v", list.Data)
+	}
+
+	if rw := call(t, api, "/admin/revoke_token", "", map[string]interface{}{"channel": "general", "id": "t1"}); rw.Code != http.StatusOK {
+		t.Fatalf("could not revoke token: %d", rw.Code)
+	}
+
+	if rw := post(t, api, "?channel=general&token=secret", `{"text": "hi"}`, ""); rw.Code != http.StatusForbidden {
+		t.Errorf("revoked token accepted. got: %d", rw.Code)
+	}
+
+	if len(s.sent) != 2 {
+		t.Errorf("unexpected number of messages sent: %d", len(s.sent))
+	}
+}
+
+func post(t *testing.T, api *webhook.API, query, body, bearer string) *httptest.ResponseRecorder {
+	ep, ok := api.Endpoints()["/incoming"]
+	if !ok {
+		t.Fatalf("endpoint /incoming not registered")
+	}
+
+	r := httptest.NewRequest("POST", "/incoming"+query, bytes.NewBufferString(body))
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	rw := httptest.NewRecorder()
+	ep.Handler(context.Background(), rw, r)
+
+	return rw
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+type sender struct {
+	sync.Mutex
+	sent []broker.Msg
+	err  error
+
+	// st stores sent messages with seq assigned, as ingest would
+	st *store
+}
+
+func (s *sender) Send(id string, msg *broker.Msg) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, *msg)
+
+	if s.st != nil {
+		s.st.Lock()
+		if s.st.seqs == nil {
+			s.st.seqs = make(map[string]uint64)
+		}
+		s.st.seqs[id+"/"+msg.From+"/"+msg.ID] = uint64(len(s.sent))
+		s.st.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+// Package webhook provides outgoing chat webhooks, notifying external
+// services of chat messages, member joins and moderation events, and
+// incoming webhooks, allowing external services to post chat messages
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tonto/gossip/pkg/broker"
+)
+
+// Event represents webhook event type
+type Event string
+
+// Webhook event types
+const (
+	EventMessage    Event = "message"
+	EventJoin       Event = "join"
+	EventModeration Event = "moderation" // kick, ban and mute
+)
+
+func (e Event) valid() bool {
+	switch e {
+	case EventMessage, EventJoin, EventModeration:
+		return true
+	}
+	return false
+}
+
+// Webhook represents chat webhook registration
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"` // Payload signing key
+	Events  []Event   `json:"events"`           // Subscribed events, all if empty
+	Created time.Time `json:"created"`
+}
+
+// Wants returns whether w is subscribed to event e
+func (w *Webhook) Wants(e Event) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, ev := range w.Events {
+		if ev == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload represents webhook request body. ID identifies the chat
+// message or event being delivered, and is the same for all webhooks
+// and redeliveries, so receivers can use it to discard duplicates.
+type Payload struct {
+	ID      string        `json:"id"`
+	Type    Event         `json:"type"`
+	Channel string        `json:"channel"`
+	Message *broker.Msg   `json:"message,omitempty"`
+	Event   *broker.Event `json:"event,omitempty"`
+	Time    time.Time     `json:"time"`
+}
+
+// DeadLetter represents payload which could not be delivered to webhook
+type DeadLetter struct {
+	Webhook  string          `json:"webhook"`
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Time     time.Time       `json:"time"`
+}
+
+// SignatureHeader is the request header carrying payload signature
+const SignatureHeader = "X-Gossip-Signature"
+
+// Sign returns signature of webhook payload body, sent in SignatureHeader.
+// Signature is hex encoded HMAC-SHA256 of the body keyed by webhook secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// privateNets are networks webhooks are not delivered to, so that
+// webhooks can't be used to reach internal services or cloud
+// instance metadata endpoint (169.254.169.254)
+var privateNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(c)
+	}
+	return nets
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// errPrivateAddr is returned when dialing private webhook address
+var errPrivateAddr = errors.New("webhook: private address not allowed")
+
+// checkHost returns error if webhook url u targets localhost or private
+// address. Host names are checked again once resolved, when dialed.
+func checkHost(u *url.URL) error {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil && isPrivate(ip) {
+		return errPrivateAddr
+	}
+
+	return nil
+}
+
+// checkDial is net.Dialer Control func rejecting connections to private addresses
+func checkDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivate(ip) {
+		return errPrivateAddr
+	}
+
+	return nil
+}
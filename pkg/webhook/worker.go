@@ -0,0 +1,460 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tonto/gossip/pkg/broker"
+)
+
+// Delivery defaults. Payloads are queued per webhook and delivered one at
+// a time, each within deadline, so that failing webhook delays only its own
+// queue, by at most deadline per payload.
+const (
+	defAttempts  = 4
+	defBackoff   = time.Second
+	defTimeout   = 5 * time.Second
+	defDeadline  = 20 * time.Second
+	defQueueSize = 1000
+)
+
+// queueIdle represents time after which idle webhook queue is stopped
+const queueIdle = time.Minute
+
+// group is the message queue consumer group shared by all workers
+const group = "webhook"
+
+// NewWorker creates new webhook delivery worker
+func NewWorker(mq MQ, store Store, opts ...Option) *Worker {
+	cfg := config{
+		attempts:  defAttempts,
+		backoff:   defBackoff,
+		timeout:   defTimeout,
+		deadline:  defDeadline,
+		queueSize: defQueueSize,
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	dialer := net.Dialer{
+		Timeout:   cfg.timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if !cfg.private {
+		// Resolved addresses are checked, so that host
+		// names can't be used to reach private networks
+		dialer.Control = checkDial
+	}
+
+	return &Worker{
+		mq:     mq,
+		store:  store,
+		cfg:    cfg,
+		queues: make(map[string]chan *delivery),
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Worker delivers chat messages and events to registered webhooks. Each
+// message is delivered by a single worker, regardless of the number of
+// workers running. Messages are acknowledged once queued for delivery,
+// so that message queue consumption is not limited by webhook latency.
+type Worker struct {
+	mq     MQ
+	store  Store
+	client *http.Client
+	cfg    config
+
+	mu      sync.Mutex
+	queues  map[string]chan *delivery // Keyed by chat and webhook id
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// delivery represents payload queued for delivery to webhook
+type delivery struct {
+	hook Webhook
+	p    *Payload
+	body []byte
+}
+
+// MQ represents webhook worker message queue interface
+type MQ interface {
+	// SubscribeGroup subscribes durable consumer group shared by all workers,
+	// starting with new messages. Message is acknowledged only if handler
+	// returns no error, otherwise it is redelivered.
+	SubscribeGroup(string, string, func(uint64, []byte) error) (io.Closer, error)
+}
+
+type config struct {
+	attempts  int
+	backoff   time.Duration
+	timeout   time.Duration
+	deadline  time.Duration
+	queueSize int
+	private   bool
+}
+
+// Option represents webhook worker option
+type Option func(*config)
+
+// WithRetries sets max number of delivery attempts, and backoff
+// before the first retry, which is doubled on each next retry
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.attempts = attempts
+		c.backoff = backoff
+	}
+}
+
+// WithTimeout sets webhook request timeout
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) { c.timeout = d }
+}
+
+// WithDeadline sets max time allowed for delivery of
+// a message to a webhook, including retries
+func WithDeadline(d time.Duration) Option {
+	return func(c *config) { c.deadline = d }
+}
+
+// WithQueueSize sets max number of payloads queued for delivery
+// per webhook. Payloads exceeding it are dead lettered.
+func WithQueueSize(n int) Option {
+	return func(c *config) { c.queueSize = n }
+}
+
+// WithPrivateNetworks allows delivery to webhooks on
+// localhost and private networks, which is denied by default
+func WithPrivateNetworks() Option {
+	return func(c *config) { c.private = true }
+}
+
+// RunAll runs webhook delivery for chat ids, as well as for chats
+// received on created, until ctx is done. Payloads still queued
+// once ctx is done are dead lettered.
+func (w *Worker) RunAll(ctx context.Context, ids []string, created <-chan string) error {
+	var closers []io.Closer
+
+	// Delivery queues are stopped on return, even if ctx is not done
+	ctx, cancel := context.WithCancel(ctx)
+
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+
+		w.mu.Lock()
+		w.stopped = true
+		w.mu.Unlock()
+
+		cancel()
+		w.wg.Wait()
+	}()
+
+	running := make(map[string]bool)
+
+	run := func(id string) error {
+		if running[id] {
+			return nil
+		}
+
+		mc, err := w.mq.SubscribeGroup("chat."+id, group, w.msgHandler(ctx, id))
+		if err != nil {
+			return fmt.Errorf("webhook: could not subscribe: %v", err)
+		}
+
+		closers = append(closers, mc)
+
+		ec, err := w.mq.SubscribeGroup("events."+id, group, w.eventHandler(ctx, id))
+		if err != nil {
+			return fmt.Errorf("webhook: could not subscribe: %v", err)
+		}
+
+		closers = append(closers, ec)
+		running[id] = true
+
+		return nil
+	}
+
+	for _, id := range ids {
+		if err := run(id); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case id := <-created:
+			if err := run(id); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (w *Worker) msgHandler(ctx context.Context, id string) func(uint64, []byte) error {
+	return func(seq uint64, data []byte) error {
+		msg, err := broker.DecodeMsg(data)
+		if err != nil {
+			// Undecodable message can never be delivered
+			return nil
+		}
+
+		msg.Seq = seq
+
+		return w.dispatch(ctx, &Payload{
+			ID:      fmt.Sprintf("chat.%s.%d", id, seq),
+			Type:    EventMessage,
+			Channel: id,
+			Message: msg,
+			Time:    msg.Time,
+		})
+	}
+}
+
+func (w *Worker) eventHandler(ctx context.Context, id string) func(uint64, []byte) error {
+	return func(seq uint64, data []byte) error {
+		e, err := broker.DecodeEvent(data)
+		if err != nil {
+			return nil
+		}
+
+		var t Event
+
+		switch e.Type {
+		case broker.EventJoin:
+			t = EventJoin
+		case broker.EventKick, broker.EventBan, broker.EventMute:
+			t = EventModeration
+		default:
+			return nil
+		}
+
+		return w.dispatch(ctx, &Payload{
+			ID:      fmt.Sprintf("events.%s.%d", id, seq),
+			Type:    t,
+			Channel: id,
+			Event:   e,
+			Time:    e.Time,
+		})
+	}
+}
+
+// dispatch queues p for delivery to all chat webhooks subscribed to its
+// type. Returned error causes the message to be redelivered, so it is
+// returned only if webhooks could not be fetched, or worker is stopped.
+// Once queued the message is never redelivered, so that webhooks which
+// already received it don't receive it again, and payloads which could
+// not be delivered to a webhook are dead lettered instead.
+func (w *Worker) dispatch(ctx context.Context, p *Payload) error {
+	hooks, err := w.store.GetWebhooks(p.Channel)
+	if err != nil {
+		return fmt.Errorf("webhook: could not fetch webhooks: %v", err)
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil
+	}
+
+	var full []*delivery
+
+	w.mu.Lock()
+
+	if w.stopped || ctx.Err() != nil {
+		w.mu.Unlock()
+		return fmt.Errorf("webhook: worker stopped")
+	}
+
+	for _, hook := range hooks {
+		if !hook.Wants(p.Type) {
+			continue
+		}
+
+		d := &delivery{hook: hook, p: p, body: body}
+
+		select {
+		case w.queue(ctx, p.Channel, hook.ID) <- d:
+		default:
+			full = append(full, d)
+		}
+	}
+
+	w.mu.Unlock()
+
+	for _, d := range full {
+		w.deadLetter(d, 0, fmt.Errorf("webhook delivery queue is full"))
+	}
+
+	return nil
+}
+
+// queue returns delivery queue of chat id webhook, starting it if not
+// running. It must be called with w.mu held.
+func (w *Worker) queue(ctx context.Context, id, hookID string) chan *delivery {
+	key := id + "/" + hookID
+
+	q, ok := w.queues[key]
+	if !ok {
+		q = make(chan *delivery, w.cfg.queueSize)
+		w.queues[key] = q
+		w.wg.Add(1)
+		go w.run(ctx, key, q)
+	}
+
+	return q
+}
+
+// run delivers payloads queued in q one at a time, in order they were
+// queued, until ctx is done or q stays idle for queueIdle. Payloads left
+// in q once ctx is done are dead lettered.
+func (w *Worker) run(ctx context.Context, key string, q chan *delivery) {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case d := <-q:
+			w.deliver(ctx, d)
+		case <-time.After(queueIdle):
+			w.mu.Lock()
+			if len(q) == 0 {
+				delete(w.queues, key)
+				w.mu.Unlock()
+				return
+			}
+			w.mu.Unlock()
+		case <-ctx.Done():
+			w.mu.Lock()
+			delete(w.queues, key)
+			w.mu.Unlock()
+
+			for {
+				select {
+				case d := <-q:
+					w.deadLetter(d, 0, fmt.Errorf("webhook worker stopped"))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts queued payload to its webhook, retrying with exponential
+// backoff until delivery deadline. Payload is moved to the chat dead letter
+// list once all attempts fail, or if the webhook rejects it with a client error.
+func (w *Worker) deliver(ctx context.Context, d *delivery) {
+	var (
+		err     error
+		retry   bool
+		attempt int
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.deadline)
+	defer cancel()
+
+	backoff := w.cfg.backoff
+
+	for attempt = 1; ; attempt++ {
+		retry, err = w.post(ctx, &d.hook, d.p, d.body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= w.cfg.attempts || ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		backoff *= 2
+	}
+
+	w.deadLetter(d, attempt, err)
+}
+
+// deadLetter moves payload which could not be delivered
+// after attempts to the chat dead letter list
+func (w *Worker) deadLetter(d *delivery, attempts int, cause error) {
+	err := w.store.AppendDeadLetter(d.p.Channel, &DeadLetter{
+		Webhook:  d.hook.ID,
+		URL:      d.hook.URL,
+		Payload:  d.body,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("webhook: could not store dead letter %s for webhook %s: %v", d.p.ID, d.hook.ID, err)
+	}
+}
+
+// post sends signed payload to hook, returning whether
+// failed request should be retried
+func (w *Worker) post(ctx context.Context, hook *Webhook, p *Payload, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gossip-webhook")
+	req.Header.Set("X-Gossip-Event", string(p.Type))
+	req.Header.Set("X-Gossip-Delivery", p.ID)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, errPrivateAddr), err
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+}
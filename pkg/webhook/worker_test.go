@@ -0,0 +1,572 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tonto/gossip/pkg/broker"
+	"github.com/tonto/gossip/pkg/webhook"
+)
+
+func TestDeliver(t *testing.T) {
+	msg, _ := broker.EncodeMsg(&broker.Msg{From: "joe", Text: "hi", Time: time.Now()})
+	join, _ := broker.EncodeEvent(&broker.Event{Type: broker.EventJoin, Nick: "joe", By: "joe", Time: time.Now()})
+	kick, _ := broker.EncodeEvent(&broker.Event{Type: broker.EventKick, Nick: "joe", By: "jane", Time: time.Now()})
+	nick, _ := broker.EncodeEvent(&broker.Event{Type: broker.EventNick, Nick: "joe", By: "joe", Time: time.Now()})
+
+	cases := []struct {
+		name         string
+		events       []webhook.Event
+		subj         string
+		data         []byte
+		status       []int // Response status per attempt, 200 once exhausted
+		storeErr     error
+		deadErr      error
+		public       bool // Worker delivers only to public addresses
+		wantType     webhook.Event
+		wantCalls    int
+		wantDead     bool
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:      "message",
+			subj:      "chat.general",
+			data:      msg,
+			wantType:  webhook.EventMessage,
+			wantCalls: 1,
+		},
+		{
+			name:      "join",
+			subj:      "events.general",
+			data:      join,
+			wantType:  webhook.EventJoin,
+			wantCalls: 1,
+		},
+		{
+			name:      "moderation",
+			subj:      "events.general",
+			data:      kick,
+			wantType:  webhook.EventModeration,
+			wantCalls: 1,
+		},
+		{
+			name: "unsupported event",
+			subj: "events.general",
+			data: nick,
+		},
+		{
+			name:   "not subscribed",
+			events: []webhook.Event{webhook.EventJoin},
+			subj:   "chat.general",
+			data:   msg,
+		},
+		{
+			name:      "retry",
+			subj:      "chat.general",
+			data:      msg,
+			status:    []int{http.StatusInternalServerError, http.StatusTooManyRequests},
+			wantType:  webhook.EventMessage,
+			wantCalls: 3,
+		},
+		{
+			name:         "retries exhausted",
+			subj:         "chat.general",
+			data:         msg,
+			status:       []int{500, 500, 500},
+			wantCalls:    3,
+			wantDead:     true,
+			wantAttempts: 3,
+		},
+		{
+			name:         "rejected",
+			subj:         "chat.general",
+			data:         msg,
+			status:       []int{http.StatusGone},
+			wantCalls:    1,
+			wantDead:     true,
+			wantAttempts: 1,
+		},
+		{
+			name:      "dead letter error",
+			subj:      "chat.general",
+			data:      msg,
+			status:    []int{http.StatusGone},
+			deadErr:   fmt.Errorf("redis down"),
+			wantCalls: 1,
+		},
+		{
+			name:         "private address",
+			subj:         "chat.general",
+			data:         msg,
+			public:       true,
+			wantDead:     true,
+			wantAttempts: 1,
+		},
+		{
+			name:     "store error",
+			subj:     "chat.general",
+			data:     msg,
+			storeErr: fmt.Errorf("redis down"),
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				calls int
+				got   webhook.Payload
+			)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if sig := r.Header.Get(webhook.SignatureHeader); sig != webhook.Sign("secret", body) {
+					t.Errorf("invalid signature: %s", sig)
+				}
+
+				json.Unmarshal(body, &got)
+
+				if calls < len(tc.status) {
+					w.WriteHeader(tc.status[calls])
+				}
+
+				calls++
+			}))
+			defer srv.Close()
+
+			st := store{
+				hooks: map[string][]webhook.Webhook{
+					"general": {{ID: "h1", URL: srv.URL, Secret: "secret", Events: tc.events}},
+				},
+				err:     tc.storeErr,
+				deadErr: tc.deadErr,
+			}
+
+			mq := mq{handlers: make(map[string]func(uint64, []byte) error)}
+
+			opts := []webhook.Option{webhook.WithRetries(3, time.Millisecond)}
+			if !tc.public {
+				opts = append(opts, webhook.WithPrivateNetworks())
+			}
+
+			w := webhook.NewWorker(&mq, &st, opts...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			done := make(chan error)
+			go func() { done <- w.RunAll(ctx, []string{"general"}, nil) }()
+
+			h := mq.wait(t, tc.subj)
+
+			err := h(7, tc.data)
+			if tc.wantErr != (err != nil) {
+				t.Errorf("unexpected handler error: %v", err)
+			}
+
+			// Payloads are delivered once handler returns
+			waitFor(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return calls == tc.wantCalls && tc.wantDead == (st.deadCount() == 1)
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if calls != tc.wantCalls {
+				t.Errorf("unexpected number of requests. want: %d, got: %d", tc.wantCalls, calls)
+			}
+
+			if tc.wantType != "" {
+				if got.Type != tc.wantType || got.Channel != "general" || got.ID != tc.subj+".7" {
+					t.Errorf("unexpected payload: %+v", got)
+				}
+			}
+
+			if tc.wantDead != (len(st.dead) == 1) {
+				t.Fatalf("unexpected dead letters: %+v", st.dead)
+			}
+
+			if tc.wantDead && (st.dead[0].Attempts != tc.wantAttempts || st.dead[0].Webhook != "h1") {
+				t.Errorf("unexpected dead letter: %+v", st.dead[0])
+			}
+
+			cancel()
+
+			if err := <-done; err != nil {
+				t.Errorf("unexpected run error: %v", err)
+			}
+
+			if !mq.closed() {
+				t.Errorf("subscriptions not closed")
+			}
+		})
+	}
+}
+
+func TestDeliverDeadline(t *testing.T) {
+	msg, _ := broker.EncodeMsg(&broker.Msg{From: "joe", Text: "hi", Time: time.Now()})
+
+	var (
+		mu      sync.Mutex
+		fastGot int
+	)
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fastGot++
+		mu.Unlock()
+	}))
+	defer fast.Close()
+
+	release := make(chan struct{})
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	st := store{
+		hooks: map[string][]webhook.Webhook{
+			"general": {
+				{ID: "slow", URL: slow.URL, Secret: "secret"},
+				{ID: "fast", URL: fast.URL, Secret: "secret"},
+			},
+		},
+	}
+
+	mq := mq{handlers: make(map[string]func(uint64, []byte) error)}
+
+	w := webhook.NewWorker(
+		&mq,
+		&st,
+		webhook.WithRetries(3, time.Millisecond),
+		webhook.WithTimeout(time.Minute),
+		webhook.WithDeadline(50*time.Millisecond),
+		webhook.WithPrivateNetworks(),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go w.RunAll(ctx, []string{"general"}, nil)
+
+	h := mq.wait(t, "chat.general")
+
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := h(seq, msg); err != nil {
+			t.Errorf("unexpected handler error: %v", err)
+		}
+	}
+
+	// Slow webhook does not delay delivery to the fast one
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return fastGot == 2
+	})
+
+	// Each payload to the slow webhook is dead lettered after deadline
+	waitFor(t, func() bool { return st.deadCount() == 2 })
+
+	for _, dl := range st.dead {
+		if dl.Webhook != "slow" {
+			t.Errorf("unexpected dead letter: %+v", dl)
+		}
+	}
+}
+
+func TestDeliverQueue(t *testing.T) {
+	msg, _ := broker.EncodeMsg(&broker.Msg{From: "joe", Text: "hi", Time: time.Now()})
+
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+
+	st := store{
+		hooks: map[string][]webhook.Webhook{
+			"general": {{ID: "slow", URL: slow.URL, Secret: "secret"}},
+		},
+	}
+
+	mq := mq{handlers: make(map[string]func(uint64, []byte) error)}
+
+	w := webhook.NewWorker(
+		&mq,
+		&st,
+		webhook.WithTimeout(time.Minute),
+		webhook.WithDeadline(time.Minute),
+		webhook.WithQueueSize(1),
+		webhook.WithPrivateNetworks(),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- w.RunAll(ctx, []string{"general"}, nil) }()
+
+	h := mq.wait(t, "chat.general")
+
+	if err := h(1, msg); err != nil {
+		t.Fatalf("unexpected handler error: %v", err)
+	}
+
+	<-received
+
+	// Handler does not wait for the webhook. Second payload
+	// is queued, and the third one exceeds the queue size.
+	start := time.Now()
+
+	for seq := uint64(2); seq <= 3; seq++ {
+		if err := h(seq, msg); err != nil {
+			t.Errorf("unexpected handler error: %v", err)
+		}
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("handler blocked by webhook delivery: %v", d)
+	}
+
+	if n := st.deadCount(); n != 1 {
+		t.Fatalf("unexpected dead letters: %+v", st.dead)
+	}
+
+	var p webhook.Payload
+	json.Unmarshal(st.dead[0].Payload, &p)
+
+	if p.ID != "chat.general.3" || st.dead[0].Attempts != 0 {
+		t.Errorf("unexpected dead letter: %+v (%s)", st.dead[0], p.ID)
+	}
+
+	close(release)
+
+	<-received
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Errorf("unexpected run error: %v", err)
+	}
+
+	if err := h(4, msg); err == nil {
+		t.Errorf("stopped worker should not acknowledge messages")
+	}
+}
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 test vector from RFC 4231, test case 2
+	want := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+
+	if got := webhook.Sign("Jefe", []byte("what do ya want for nothing?")); got != want {
+		t.Errorf("unexpected signature. want: %s, got: %s", want, got)
+	}
+}
+
+type mq struct {
+	sync.Mutex
+	handlers map[string]func(uint64, []byte) error
+	open     int
+}
+
+func (q *mq) SubscribeGroup(subj, group string, f func(uint64, []byte) error) (io.Closer, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if group != "webhook" {
+		return nil, fmt.Errorf("unexpected group %s", group)
+	}
+
+	q.handlers[subj] = f
+	q.open++
+
+	return closer{q}, nil
+}
+
+func (q *mq) wait(t *testing.T, subj string) func(uint64, []byte) error {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		q.Lock()
+		h, ok := q.handlers[subj]
+		q.Unlock()
+		if ok {
+			return h
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s not subscribed", subj)
+	return nil
+}
+
+func (q *mq) closed() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.open == 0
+}
+
+type closer struct{ q *mq }
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("condition not met before deadline")
+}
+
+func (c closer) Close() error {
+	c.q.Lock()
+	defer c.q.Unlock()
+	c.q.open--
+	return nil
+}
+
+type store struct {
+	sync.Mutex
+	hooks  map[string][]webhook.Webhook
+	dead   []webhook.DeadLetter
+	tokens map[string][]webhook.Token
+	seqs   map[string]uint64 // Stored message seqs, keyed by chat, nick and message id
+	err    error
+
+	deadErr error
+}
+
+func (s *store) GetWebhooks(id string) ([]webhook.Webhook, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return append([]webhook.Webhook(nil), s.hooks[id]...), nil
+}
+
+func (s *store) SaveWebhook(id string, w *webhook.Webhook) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.hooks[id] = append(s.hooks[id], *w)
+	return nil
+}
+
+func (s *store) RemoveWebhook(id, hookID string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return false, s.err
+	}
+	for i, w := range s.hooks[id] {
+		if w.ID == hookID {
+			s.hooks[id] = append(s.hooks[id][:i], s.hooks[id][i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *store) AppendDeadLetter(id string, dl *webhook.DeadLetter) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.deadErr != nil {
+		return s.deadErr
+	}
+	s.dead = append(s.dead, *dl)
+	return nil
+}
+
+func (s *store) deadCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.dead)
+}
+
+func (s *store) GetDeadLetters(id string) ([]webhook.DeadLetter, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.dead, nil
+}
+
+func (s *store) GetMsgSeq(id, nick, msgid string) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.seqs[id+"/"+nick+"/"+msgid], nil
+}
+
+func (s *store) GetToken(id, hash string) (*webhook.Token, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	for _, t := range s.tokens[id] {
+		if t.Hash == hash {
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *store) GetTokens(id string) ([]webhook.Token, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return append([]webhook.Token(nil), s.tokens[id]...), nil
+}
+
+func (s *store) SaveToken(id string, t *webhook.Token) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.tokens[id] = append(s.tokens[id], *t)
+	return nil
+}
+
+func (s *store) RevokeToken(id, tokenID string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return false, s.err
+	}
+	for i, t := range s.tokens[id] {
+		if t.ID == tokenID {
+			s.tokens[id] = append(s.tokens[id][:i], s.tokens[id][i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}